@@ -0,0 +1,151 @@
+// SolarEdge inverter simulator, serving the SunSpec map over Modbus TCP for development & testing.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+	logger "github.com/stefannilsson/solaredgedc/logger"
+	simulator "github.com/stefannilsson/solaredgedc/simulator"
+)
+
+func main() {
+	listen := flag.String("listen", simulator.DEFAULT_LISTEN, "Address to serve Modbus TCP on")
+	unitId := flag.Int("unit", simulator.DEFAULT_UNIT_ID, "Modbus unit id (slave id)")
+	serial := flag.String("serial", simulator.DEFAULT_SERIAL, "Serial number")
+	model := flag.String("model", "", "Model name (default depends on -phases)")
+	version := flag.String("version", simulator.DEFAULT_VERSION, "Firmware version")
+	phases := flag.Int("phases", 3, "1 (SunSpec model 101) or 3 (model 103)")
+	peak := flag.Float64("peak", simulator.DEFAULT_PEAK_POWER, "AC power (W) at noon")
+	sunrise := flag.String("sunrise", "06:00", "Time of day production starts (HH:MM)")
+	sunset := flag.String("sunset", "20:00", "Time of day production ends (HH:MM)")
+	start := flag.String("start", "", "Simulated start time (RFC 3339, default now)")
+	speed := flag.Float64("speed", 1, "Time acceleration, e.g. 60 = one simulated hour per minute")
+	energy := flag.Float64("energy", 0, "Initial lifetime energy (Wh)")
+	values := flag.String("set", "", "Fixed values overriding the curve, e.g. 'I_Status=7,I_Temp_Sink=85.5'")
+	scaleFactors := flag.String("sf", "", "Scale factor overrides, e.g. 'I_AC_Power_SF=-1,I_AC_Current_SF=-3'")
+	errorRate := flag.Float64("error_rate", 0, "Fraction (0-1) of requests answered with a 'server device failure' exception")
+	disconnectRate := flag.Float64("disconnect_rate", 0, "Fraction (0-1) of requests answered by dropping the connection")
+	latency := flag.Duration("latency", 0, "Response latency, e.g. 200ms")
+	latencyJitter := flag.Duration("latency_jitter", 0, "Random latency added on top of -latency")
+	ignoreWrites := flag.Bool("ignore_writes", false, "Acknowledge power control writes without applying them")
+	commitError := flag.Uint("commit_error", 0, "Error code read back from the power control commit register (0 = success)")
+	logLevel := flag.String("log_level", "INFO", "{DEBUG, INFO, WARNING, ERROR}")
+	flag.Parse()
+
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		exit(fmt.Errorf("unknown -log_level '%s', expected one of DEBUG, INFO, WARNING, ERROR", *logLevel))
+	}
+	logger.Configure(logger.Config{Level: level, Format: logger.FORMAT_TEXT})
+
+	config := simulator.Config{
+		Listen:         *listen,
+		Serial:         *serial,
+		Model:          *model,
+		Version:        *version,
+		PeakPower:      *peak,
+		Speed:          *speed,
+		Energy:         *energy,
+		ErrorRate:      *errorRate,
+		DisconnectRate: *disconnectRate,
+		Latency:        *latency,
+		LatencyJitter:  *latencyJitter,
+		IgnoreWrites:   *ignoreWrites,
+	}
+
+	if *commitError > 0xFFFF {
+		exit(fmt.Errorf("invalid -commit_error %d, expected 0-65535", *commitError))
+	}
+	config.CommitError = uint16(*commitError)
+
+	if *unitId < 1 || *unitId > 247 {
+		exit(fmt.Errorf("invalid -unit %d, expected 1-247", *unitId))
+	}
+	config.UnitId = byte(*unitId)
+
+	switch *phases {
+	case 1:
+		config.InverterModel = sunspec.Model_INVERTER_SINGLE_PHASE
+	case 3:
+		config.InverterModel = sunspec.Model_INVERTER_THREE_PHASE
+	default:
+		exit(fmt.Errorf("invalid -phases %d, expected 1 or 3", *phases))
+	}
+
+	if config.Sunrise, err = simulator.ParseTimeOfDay(*sunrise); err != nil {
+		exit(err)
+	}
+	if config.Sunset, err = simulator.ParseTimeOfDay(*sunset); err != nil {
+		exit(err)
+	}
+	if *start != "" {
+		if config.Start, err = time.Parse(time.RFC3339, *start); err != nil {
+			exit(fmt.Errorf("invalid -start '%s', expected RFC 3339 (e.g. 2021-06-21T12:00:00+02:00)", *start))
+		}
+	}
+
+	if config.Values, err = parseValues(*values); err != nil {
+		exit(fmt.Errorf("invalid -set: %w", err))
+	}
+	sfs, err := parseValues(*scaleFactors)
+	if err != nil {
+		exit(fmt.Errorf("invalid -sf: %w", err))
+	}
+	config.ScaleFactors = map[string]int16{}
+	for name, sf := range sfs {
+		if sf != float64(int16(sf)) {
+			exit(fmt.Errorf("invalid -sf: %s=%v, expected an integer", name, sf))
+		}
+		config.ScaleFactors[name] = int16(sf)
+	}
+
+	sim, err := simulator.New(config)
+	if err != nil {
+		exit(err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		sim.Close()
+	}()
+
+	if err := sim.Serve(); err != nil {
+		exit(err)
+	}
+}
+
+// Parse 'NAME=value,...'
+func parseValues(list string) (map[string]float64, error) {
+	values := map[string]float64{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("'%s', expected NAME=value", entry)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s', expected a number", entry)
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+	return values, nil
+}
+
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
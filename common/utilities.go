@@ -3,6 +3,7 @@ package utilities
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"runtime/trace"
@@ -26,8 +27,32 @@ func BytesToUint32(bytes []byte) uint32 {
 	return resultsUint32
 }
 
+func BytesToFloat32(bytes []byte) float32 {
+	resultsUint32 := binary.BigEndian.Uint32(bytes)
+	return math.Float32frombits(resultsUint32)
+}
+
+func BytesToUint64(bytes []byte) uint64 {
+	resultsUint64 := binary.BigEndian.Uint64(bytes)
+	return resultsUint64
+}
+
+// Reverse the order of the 16-bit registers, for values transmitted least significant word first.
+func SwapWords(bytes []byte) []byte {
+	swapped := make([]byte, len(bytes))
+	for i := 0; i+1 < len(bytes); i += 2 {
+		j := len(bytes) - i - 2
+		swapped[j], swapped[j+1] = bytes[i], bytes[i+1]
+	}
+	return swapped
+}
+
 func TimeNowInUnixMs() int64 {
-	return time.Now().UnixNano() / int64(time.Millisecond)
+	return TimeInUnixMs(time.Now())
+}
+
+func TimeInUnixMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
 // get a [a-z0-9] random {strlen} long string.
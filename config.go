@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	Configuration file schema (YAML), see solaredgedc.example.yaml.
+	All settings are optional, and are overridden by ENVironment variables and app flags.
+*/
+type ConfigFile struct {
+	Log     ConfigFileLog     `yaml:"log"`
+	Modbus  ConfigFileModbus  `yaml:"modbus"`
+	Mqtt    ConfigFileMqtt    `yaml:"mqtt"`
+	Metrics ConfigFileMetrics `yaml:"metrics"`
+	Influx  ConfigFileInflux  `yaml:"influx"`
+}
+
+type ConfigFileInflux struct {
+	URL    *string `yaml:"url"` // http(s)://host:8086, udp://host:8089 or file:///path
+	Org    *string `yaml:"org"`
+	Bucket *string `yaml:"bucket"`
+	Token  *string `yaml:"token"`
+}
+
+type ConfigFileMetrics struct {
+	Listen *string `yaml:"listen"` // e.g. ':9100'
+}
+
+type ConfigFileLog struct {
+	Level      *string           `yaml:"level"`      // {DEBUG, INFO, WARNING, ERROR}
+	Format     *string           `yaml:"format"`     // {text, json}
+	Components map[string]string `yaml:"components"` // per component level, e.g. {modbus: ERROR}
+}
+
+type ConfigFileModbus struct {
+	Mode         *string `yaml:"mode"` // {tcp, rtu, replay}
+	Hostname     *string `yaml:"hostname"`
+	Port         *int    `yaml:"port"`
+	SlaveId      *int    `yaml:"slave_id"`
+	PollInterval *int64  `yaml:"poll_interval"` // ms
+	RecordFile   *string `yaml:"record_file"`   // record all raw block reads
+	ReplayFile   *string `yaml:"replay_file"`   // recording to replay in 'replay' mode
+
+	Serial  ConfigFileSerial   `yaml:"serial"`
+	Devices []ConfigFileDevice `yaml:"devices"`
+	Control ConfigFileControl  `yaml:"control"`
+}
+
+type ConfigFileControl struct {
+	Enabled       *bool   `yaml:"enabled"`
+	RevertTimeout *string `yaml:"revert_timeout"` // duration, e.g. 15m, 0 = never
+}
+
+type ConfigFileSerial struct {
+	Device   *string `yaml:"device"`
+	BaudRate *int    `yaml:"baud_rate"`
+	DataBits *int    `yaml:"data_bits"`
+	Parity   *string `yaml:"parity"` // {N, E, O}
+	StopBits *int    `yaml:"stop_bits"`
+}
+
+type ConfigFileDevice struct {
+	Alias    string `yaml:"alias"`
+	Hostname string `yaml:"hostname"` // serial device in RTU mode
+	Port     *int   `yaml:"port"`
+	SlaveId  *int   `yaml:"slave_id"`
+}
+
+type ConfigFileMqtt struct {
+	URI      *string `yaml:"uri"`
+	ClientId *string `yaml:"client_id"`
+	Username *string `yaml:"username"`
+	Password *string `yaml:"password"`
+	Qos      *int    `yaml:"qos"`
+	Topic    *string `yaml:"topic"`
+
+	AvailabilityTopic *string `yaml:"availability_topic"` // (default {topic}/availability)
+
+	HomeAssistant ConfigFileHomeAssistant `yaml:"homeassistant"`
+	Store         ConfigFileStore         `yaml:"store"`
+
+	TLS ConfigFileTLS `yaml:"tls"`
+}
+
+type ConfigFileHomeAssistant struct {
+	Discovery *bool   `yaml:"discovery"`
+	Prefix    *string `yaml:"prefix"` // (default homeassistant)
+}
+
+type ConfigFileStore struct {
+	Directory   *string `yaml:"directory"`
+	MaxMessages *int    `yaml:"max_messages"`
+	MaxAge      *string `yaml:"max_age"` // duration, e.g. 72h
+}
+
+type ConfigFileTLS struct {
+	CAFile             *string `yaml:"ca_file"`
+	CertFile           *string `yaml:"cert_file"`
+	KeyFile            *string `yaml:"key_file"`
+	ServerName         *string `yaml:"server_name"`
+	MinVersion         *string `yaml:"min_version"` // {1.0, 1.1, 1.2, 1.3}
+	InsecureSkipVerify *bool   `yaml:"insecure_skip_verify"`
+}
+
+// Read and decode the configuration file, unknown keys are reported as errors.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	defer file.Close()
+
+	config := &ConfigFile{}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("config file '%s': %w", path, err)
+	}
+
+	return config, nil
+}
+
+// All configuration errors found, reported at once.
+type ConfigErrors []string
+
+func (errs ConfigErrors) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  - %s", strings.Join(errs, "\n  - "))
+}
+
+func (errs *ConfigErrors) Add(format string, args ...interface{}) {
+	*errs = append(*errs, fmt.Sprintf(format, args...))
+}
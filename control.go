@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	MQTTClient "github.com/eclipse/paho.mqtt.golang"
+	logger "github.com/stefannilsson/solaredgedc/logger"
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+	mqtt "github.com/stefannilsson/solaredgedc/publisher"
+)
+
+const (
+	CONTROL_QUEUE_SIZE = 16 // commands per device waiting for the Modbus connection, further ones are rejected
+)
+
+/*
+	'control' subcommand: read or change the advanced power control settings of a device with the regular Modbus
+	settings, e.g. 'solaredgedc control -modbus_hostname 10.0.0.5 -active_power_limit 0 -revert_after 1h'.
+	With a revert timeout the command waits, and reverts the change once it passes (or on Ctrl+C).
+*/
+func RunControl(args []string) int {
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: solaredgedc control [flags]")
+		flag.PrintDefaults()
+	}
+	flagActivePowerLimit := flag.Int("active_power_limit", -1, "Active power limit, % of nominal power (0-100)")
+	flagReactivePowerConfig := flag.Int("reactive_power_config", -1, "Reactive power mode {0: fixed CosPhi, 1: fixed Q, 2: CosPhi(P), 3: Q(U)+Q(P), 4: RRCR}")
+	flagAdvancedPowerControl := flag.String("advanced_power_control", "", "Enable advanced power control {true, false}")
+	flagRestoreDefaults := flag.Bool("restore_defaults", false, "Restore the power control default settings")
+	flagRevertAfter := flag.Duration("revert_after", 0, "Wait and revert the change after this time, ex: 30m (default: keep the change)")
+	flagDevice := flag.String("device", "", "Alias of the device to control, if several are configured (default: the first)")
+
+	logConfig, modbusConfig, _, _, err := parseArgumentsConfig(args, false)
+	errs := ConfigErrors{}
+	if err != nil {
+		errs = err.(ConfigErrors)
+	}
+
+	change := modbus.PowerControlChange{}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "active_power_limit":
+			change.ActivePowerLimit = flagActivePowerLimit
+		case "reactive_power_config":
+			change.ReactivePowerConfig = flagReactivePowerConfig
+		case "advanced_power_control":
+			enabled, err := strconv.ParseBool(*flagAdvancedPowerControl)
+			if err != nil {
+				errs.Add("invalid advanced power control '%s', expected true or false", *flagAdvancedPowerControl)
+			}
+			change.AdvancedPowerControl = &enabled
+		}
+	})
+	changing := change.ActivePowerLimit != nil || change.ReactivePowerConfig != nil || change.AdvancedPowerControl != nil
+	if changing {
+		if err := change.Validate(); err != nil {
+			errs.Add("%v", err)
+		}
+	}
+	if *flagRestoreDefaults && changing {
+		errs.Add("power control defaults can't be restored while changing settings")
+	}
+	if *flagRevertAfter < 0 || (*flagRevertAfter > 0 && !changing) {
+		errs.Add("a revert timeout requires a change of settings, and must be positive")
+	}
+	if modbusConfig.mode == modbus.MODE_REPLAY {
+		errs.Add("power control settings can't be written to a replayed recording")
+	}
+
+	device := selectDevice(modbusConfig, *flagDevice, &errs)
+
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, errs)
+		return 2
+	}
+	logger.Configure(LoggerConfig(logConfig))
+
+	client, err := connectDevice(modbusConfig, device)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer modbus.CloseAll()
+	controller := modbus.NewPowerController(client)
+	reverted := make(chan *modbus.PowerControlState, 1)
+	controller.OnRevert = func(state *modbus.PowerControlState, err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		reverted <- state
+	}
+
+	var state *modbus.PowerControlState
+	switch {
+	case *flagRestoreDefaults:
+		state, err = controller.RestoreDefaults()
+	case changing:
+		state, err = controller.Apply(change, *flagRevertAfter)
+	default:
+		state, err = controller.Read()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(state)
+	if *flagRevertAfter == 0 {
+		return 0
+	}
+
+	// Wait for the revert (retried by the controller until successful), or revert right away on Ctrl+C (or SIGTERM).
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	fmt.Fprintln(os.Stderr, "Waiting to revert, press Ctrl+C to revert now...")
+
+	select {
+	case state = <-reverted:
+	case <-interrupt:
+		state, err = controller.Revert()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	fmt.Println(state)
+	return 0
+}
+
+/*
+	Power control command, published to '{device topic}/control/set' as JSON (all fields optional), or as a plain
+	number setting the active power limit. Changes are reverted after 'revert_after' (default the configured revert
+	timeout, "0s" keeps them), or right away with 'revert'.
+*/
+type controlCommand struct {
+	AdvancedPowerControl *bool   `json:"advanced_power_control"`
+	ActivePowerLimit     *int    `json:"active_power_limit"`
+	ReactivePowerConfig  *int    `json:"reactive_power_config"`
+	RevertAfter          *string `json:"revert_after"` // duration, e.g. 15m
+	Revert               bool    `json:"revert"`
+	RestoreDefaults      bool    `json:"restore_defaults"`
+}
+
+// Settings published (retained) to '{device topic}/control' on startup and after every change.
+type controlState struct {
+	AdvancedPowerControl bool    `json:"advanced_power_control"`
+	ActivePowerLimit     int     `json:"active_power_limit"`
+	ReactivePowerConfig  int     `json:"reactive_power_config"`
+	RevertAt             *string `json:"revert_at,omitempty"`
+}
+
+// Accept power control commands for a device on '{topic}/control/set', failures are published to '{topic}/control/error'.
+func HandleControlCommands(modbusClient *modbus.ModbusClient, topic string, modbusConfig *ModbusFlags, mqttConfig *MqttFlags, mqttClient MQTTClient.Client) {
+	controller := modbus.NewPowerController(modbusClient)
+	alias := modbusClient.Alias
+
+	publish := func(state *modbus.PowerControlState, err error) {
+		if err != nil {
+			errorLog.WithField("device", alias).Errorf("Power control: %v", err)
+			payload, _ := json.Marshal(map[string]string{"error": err.Error()})
+			mqttClient.Publish(topic+"/control/error", byte(mqttConfig.qos), false, payload)
+			return
+		}
+		payload := controlState{
+			AdvancedPowerControl: state.Settings.AdvancedPowerControl,
+			ActivePowerLimit:     state.Settings.ActivePowerLimit,
+			ReactivePowerConfig:  state.Settings.ReactivePowerConfig,
+		}
+		if !state.RevertAt.IsZero() {
+			revertAt := state.RevertAt.UTC().Format(time.RFC3339)
+			payload.RevertAt = &revertAt
+		}
+		encoded, _ := json.Marshal(payload)
+		mqttClient.Publish(topic+"/control", byte(mqttConfig.qos), true, encoded)
+	}
+	controller.OnRevert = publish
+	publish(controller.Read())
+
+	/*
+		Commands are run one at a time by a worker per device, as they wait for the Modbus connection (e.g. behind a
+		poll, or an unreachable inverter) and the MQTT client's handlers must not block.
+	*/
+	type queuedCommand struct {
+		command     *controlCommand
+		revertAfter time.Duration
+	}
+	queue := make(chan queuedCommand, CONTROL_QUEUE_SIZE)
+	go func() {
+		for queued := range queue {
+			command := queued.command
+			switch {
+			case command.RestoreDefaults:
+				publish(controller.RestoreDefaults())
+			case command.Revert:
+				publish(controller.Revert())
+			default:
+				change := modbus.PowerControlChange{
+					AdvancedPowerControl: command.AdvancedPowerControl,
+					ActivePowerLimit:     command.ActivePowerLimit,
+					ReactivePowerConfig:  command.ReactivePowerConfig,
+				}
+				publish(controller.Apply(change, queued.revertAfter))
+			}
+		}
+	}()
+
+	mqtt.Subscribe(mqttClient, topic+"/control/set", byte(mqttConfig.qos), func(client MQTTClient.Client, message MQTTClient.Message) {
+		command, revertAfter, err := parseControlMessage(message, modbusConfig.control.revertTimeout)
+		if err != nil {
+			publish(nil, err)
+			return
+		}
+		infoLog.WithField("device", alias).Printf("Power control command received: %s", strings.TrimSpace(string(message.Payload())))
+
+		select {
+		case queue <- queuedCommand{command: command, revertAfter: revertAfter}:
+		default:
+			publish(nil, fmt.Errorf("command rejected, %d commands already waiting for the Modbus connection", CONTROL_QUEUE_SIZE))
+		}
+	})
+}
+
+/*
+	Parse a command message, rejecting retained ones: they're delivered again on every (re)connect, reapplying a
+	stale command and postponing its revert each time.
+*/
+func parseControlMessage(message MQTTClient.Message, defaultRevertAfter time.Duration) (*controlCommand, time.Duration, error) {
+	if message.Retained() {
+		return nil, 0, fmt.Errorf("retained command '%s' ignored, commands must be published without retain", message.Payload())
+	}
+	return parseControlCommand(message.Payload(), defaultRevertAfter)
+}
+
+// Parse a command payload, and its revert timeout (the default unless given).
+func parseControlCommand(payload []byte, defaultRevertAfter time.Duration) (*controlCommand, time.Duration, error) {
+	command := &controlCommand{}
+	if limit, err := strconv.Atoi(strings.TrimSpace(string(payload))); err == nil {
+		command.ActivePowerLimit = &limit
+	} else if err := json.Unmarshal(payload, command); err != nil {
+		return nil, 0, fmt.Errorf("invalid command '%s', expected a JSON object or an active power limit", payload)
+	}
+
+	revertAfter := defaultRevertAfter
+	if command.RevertAfter != nil {
+		duration, err := time.ParseDuration(*command.RevertAfter)
+		if err != nil || duration < 0 {
+			return nil, 0, fmt.Errorf("invalid revert_after '%s', expected a duration, e.g. 15m", *command.RevertAfter)
+		}
+		revertAfter = duration
+	}
+	if command.Revert && command.RestoreDefaults {
+		return nil, 0, fmt.Errorf("invalid command, either revert or restore_defaults")
+	}
+	return command, revertAfter, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseControlCommand(t *testing.T) {
+	tests := []struct {
+		name            string
+		payload         string
+		limit           *int
+		revert          bool
+		restoreDefaults bool
+		revertAfter     time.Duration
+	}{
+		{name: "plain number", payload: "40", limit: intValue(40), revertAfter: 15 * time.Minute},
+		{name: "plain number with whitespace", payload: " 0\n", limit: intValue(0), revertAfter: 15 * time.Minute},
+		{name: "JSON", payload: `{"active_power_limit": 40, "revert_after": "1h"}`, limit: intValue(40), revertAfter: time.Hour},
+		{name: "JSON kept", payload: `{"active_power_limit": 40, "revert_after": "0s"}`, limit: intValue(40), revertAfter: 0},
+		{name: "revert", payload: `{"revert": true}`, revert: true, revertAfter: 15 * time.Minute},
+		{name: "restore defaults", payload: `{"restore_defaults": true}`, restoreDefaults: true, revertAfter: 15 * time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			command, revertAfter, err := parseControlCommand([]byte(test.payload), 15*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (command.ActivePowerLimit == nil) != (test.limit == nil) || (test.limit != nil && *command.ActivePowerLimit != *test.limit) {
+				t.Errorf("active power limit %v, want %v", command.ActivePowerLimit, test.limit)
+			}
+			if command.Revert != test.revert || command.RestoreDefaults != test.restoreDefaults || revertAfter != test.revertAfter {
+				t.Errorf("revert %t, restore defaults %t, revert after %v, want %t, %t, %v", command.Revert, command.RestoreDefaults, revertAfter, test.revert, test.restoreDefaults, test.revertAfter)
+			}
+		})
+	}
+
+	// JSON fields other than the active power limit.
+	command, _, err := parseControlCommand([]byte(`{"advanced_power_control": true, "reactive_power_config": 1}`), 0)
+	if err != nil || command.AdvancedPowerControl == nil || !*command.AdvancedPowerControl || command.ReactivePowerConfig == nil || *command.ReactivePowerConfig != 1 {
+		t.Errorf("parseControlCommand() = %+v, %v", command, err)
+	}
+}
+
+func TestParseControlCommandErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		err     string
+	}{
+		{"neither JSON nor a number", "forty", "invalid command 'forty'"},
+		{"decimal number", "40.5", "invalid command '40.5'"},
+		{"wrong JSON type", `{"active_power_limit": "40"}`, "invalid command"},
+		{"bad revert_after", `{"active_power_limit": 40, "revert_after": "soon"}`, "invalid revert_after 'soon'"},
+		{"revert_after without unit", `{"revert_after": "10"}`, "invalid revert_after '10'"},
+		{"negative revert_after", `{"revert_after": "-1m"}`, "invalid revert_after '-1m'"},
+		{"revert and restore defaults", `{"revert": true, "restore_defaults": true}`, "either revert or restore_defaults"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			command, _, err := parseControlCommand([]byte(test.payload), 15*time.Minute)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseControlCommand() = %+v, %v, want error %q", command, err, test.err)
+			}
+		})
+	}
+}
+
+// Message as delivered by the MQTT client.
+type controlMessage struct {
+	payload  string
+	retained bool
+}
+
+func (message *controlMessage) Duplicate() bool   { return false }
+func (message *controlMessage) Qos() byte         { return 1 }
+func (message *controlMessage) Retained() bool    { return message.retained }
+func (message *controlMessage) Topic() string     { return "solaredge/control/set" }
+func (message *controlMessage) MessageID() uint16 { return 1 }
+func (message *controlMessage) Payload() []byte   { return []byte(message.payload) }
+func (message *controlMessage) Ack()              {}
+
+func TestParseControlMessage(t *testing.T) {
+	command, revertAfter, err := parseControlMessage(&controlMessage{payload: "50"}, 15*time.Minute)
+	if err != nil || command.ActivePowerLimit == nil || *command.ActivePowerLimit != 50 || revertAfter != 15*time.Minute {
+		t.Errorf("parseControlMessage() = %+v, %v, %v, want limit 50 reverted after 15m", command, revertAfter, err)
+	}
+
+	// Retained commands would be reapplied on every reconnect.
+	for _, payload := range []string{"50", `{"revert": true}`} {
+		command, _, err := parseControlMessage(&controlMessage{payload: payload, retained: true}, 15*time.Minute)
+		if err == nil || !strings.Contains(err.Error(), "retained command") {
+			t.Errorf("parseControlMessage() of retained %s = %+v, %v, want an error", payload, command, err)
+		}
+	}
+}
+
+func intValue(value int) *int {
+	return &value
+}
@@ -0,0 +1,65 @@
+package mapping
+
+import (
+	"sort"
+	"strconv"
+
+	models "github.com/stefannilsson/solaredgedc/datamodels"
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+/* Indexes (1-based) of all batteries with at least one successfully parsed value. */
+func BatteryIndexes(parsed *ParsedValues) []int {
+	found := map[int]bool{}
+	for key := range parsed.Scaled {
+		prefix := regexpBatteryPrefix.FindString(key)
+		if prefix == "" {
+			continue
+		}
+		if index, err := strconv.Atoi(prefix[1 : len(prefix)-1]); err == nil {
+			found[index] = true
+		}
+	}
+
+	indexes := []int{}
+	for index := range found {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+/*
+	Move successfully parsed values of the n-th battery into the common BatteryReading.
+	Fields that are missing, or could not be mapped, are left nil. The latter are reported in the returned error.
+*/
+func ToBatteryReading(parsed *ParsedValues, battery int) (*models.BatteryReading, error) {
+	values := newFieldReader(parsed.Scaled, sunspec.BatteryPrefix(battery))
+
+	batteryRead := &models.BatteryReading{
+		BatteryId:          values.String("B_SerialNumber"),
+		BatteryIndex:       battery,
+		Manufacturer:       values.String("B_Manufacturer"),
+		Model:              values.String("B_Model"),
+		Version:            values.String("B_Version"),
+		RatedEnergy_WH:     values.Float("B_RatedEnergy"),
+		MaxChargePower:     values.Float("B_MaxChargePower"),
+		MaxDischargePower:  values.Float("B_MaxDischargePower"),
+		DC_Voltage:         values.Float("B_DC_Voltage"),
+		DC_Current:         values.Float("B_DC_Current"),
+		DC_Power:           values.Float("B_DC_Power"),
+		Energy_Exported_WH: values.Uint64("B_Export_Energy_WH"),
+		Energy_Imported_WH: values.Uint64("B_Import_Energy_WH"),
+		AvailableEnergy_WH: values.Float("B_Energy_Available"),
+		StateOfEnergy:      values.Float("B_SOE"),
+		StateOfHealth:      values.Float("B_SOH"),
+		Temp_Average:       values.Float("B_Temp_Average"),
+		BatteryStatus:      values.Uint32("B_Status"),
+	}
+
+	timestamp := parsed.Time
+	batteryRead.Time = &timestamp
+
+	return batteryRead, values.Err()
+}
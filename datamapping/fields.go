@@ -0,0 +1,119 @@
+package mapping
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+/*
+	Checked, typed access to parsed values. Missing values are returned as 'nil', values of an unexpected
+	type are returned as 'nil' as well and collected as errors (instead of panicking on a type assertion).
+*/
+type fieldReader struct {
+	values map[string]interface{}
+	prefix string // e.g. "M1_" for meter 1
+	errors []string
+}
+
+func newFieldReader(values map[string]interface{}, prefix string) *fieldReader {
+	return &fieldReader{values: values, prefix: prefix}
+}
+
+func (reader *fieldReader) mismatch(key string, value interface{}, expected string) {
+	reader.errors = append(reader.errors, fmt.Sprintf("'%s%s' is %T, expected %s", reader.prefix, key, value, expected))
+}
+
+// Numeric value as float64. Unscaled integers (registers without scale factor) are converted, NaN/Inf are left out.
+func (reader *fieldReader) Float(key string) *float64 {
+	value, found := reader.values[reader.prefix+key]
+	if !found || value == nil {
+		return nil
+	}
+
+	var float64Value float64
+	switch v := value.(type) {
+	case float64:
+		float64Value = v
+	case float32:
+		float64Value = float64(v)
+	case int16:
+		float64Value = float64(v)
+	case uint16:
+		float64Value = float64(v)
+	case uint32:
+		float64Value = float64(v)
+	case uint64:
+		float64Value = float64(v)
+	default:
+		reader.mismatch(key, value, "a number")
+		return nil
+	}
+
+	if math.IsNaN(float64Value) || math.IsInf(float64Value, 0) {
+		return nil
+	}
+	return &float64Value
+}
+
+func (reader *fieldReader) String(key string) *string {
+	value, found := reader.values[reader.prefix+key]
+	if !found || value == nil {
+		return nil
+	}
+
+	if v, ok := value.(string); ok {
+		return &v
+	}
+	reader.mismatch(key, value, "string")
+	return nil
+}
+
+func (reader *fieldReader) Uint16(key string) *uint16 {
+	value, found := reader.values[reader.prefix+key]
+	if !found || value == nil {
+		return nil
+	}
+
+	if v, ok := value.(uint16); ok {
+		return &v
+	}
+	reader.mismatch(key, value, "uint16")
+	return nil
+}
+
+func (reader *fieldReader) Uint32(key string) *uint32 {
+	value, found := reader.values[reader.prefix+key]
+	if !found || value == nil {
+		return nil
+	}
+
+	if v, ok := value.(uint32); ok {
+		return &v
+	}
+	reader.mismatch(key, value, "uint32")
+	return nil
+}
+
+func (reader *fieldReader) Uint64(key string) *uint64 {
+	value, found := reader.values[reader.prefix+key]
+	if !found || value == nil {
+		return nil
+	}
+
+	if v, ok := value.(uint64); ok {
+		return &v
+	}
+	reader.mismatch(key, value, "uint64")
+	return nil
+}
+
+// All type mismatches found so far, or nil.
+func (reader *fieldReader) Err() error {
+	if len(reader.errors) == 0 {
+		return nil
+	}
+	sort.Strings(reader.errors)
+	return fmt.Errorf("unexpected value types: %s", strings.Join(reader.errors, ", "))
+}
@@ -0,0 +1,75 @@
+package mapping
+
+import (
+	"sort"
+	"strconv"
+
+	models "github.com/stefannilsson/solaredgedc/datamodels"
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+/* Indexes (1-based) of all meters with at least one successfully parsed value. */
+func MeterIndexes(parsed *ParsedValues) []int {
+	found := map[int]bool{}
+	for key := range parsed.Scaled {
+		prefix := regexpMeterPrefix.FindString(key)
+		if prefix == "" {
+			continue
+		}
+		if index, err := strconv.Atoi(prefix[1 : len(prefix)-1]); err == nil {
+			found[index] = true
+		}
+	}
+
+	indexes := []int{}
+	for index := range found {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+/*
+	Move successfully parsed values of the n-th meter into the common MeterReading.
+	Fields that are missing, or could not be mapped, are left nil. The latter are reported in the returned error.
+*/
+func ToMeterReading(parsed *ParsedValues, meter int) (*models.MeterReading, error) {
+	values := newFieldReader(parsed.Scaled, sunspec.MeterPrefix(meter))
+
+	meterRead := &models.MeterReading{
+		MeterId:               values.String("C_SerialNumber"),
+		MeterIndex:            meter,
+		MeterType:             values.Uint16("C_SunSpec_DID"),
+		AC_Current:            values.Float("M_AC_Current"),
+		AC_Current_L1:         values.Float("M_AC_Current_A"),
+		AC_Current_L2:         values.Float("M_AC_Current_B"),
+		AC_Current_L3:         values.Float("M_AC_Current_C"),
+		AC_Voltage_L_N:        values.Float("M_AC_Voltage_LN"),
+		AC_Voltage_L1_N:       values.Float("M_AC_Voltage_AN"),
+		AC_Voltage_L2_N:       values.Float("M_AC_Voltage_BN"),
+		AC_Voltage_L3_N:       values.Float("M_AC_Voltage_CN"),
+		AC_Voltage_L_L:        values.Float("M_AC_Voltage_LL"),
+		AC_Voltage_L1_L2:      values.Float("M_AC_Voltage_AB"),
+		AC_Voltage_L2_L3:      values.Float("M_AC_Voltage_BC"),
+		AC_Voltage_L3_L1:      values.Float("M_AC_Voltage_CA"),
+		AC_Frequency:          values.Float("M_AC_Freq"),
+		AC_Power:              values.Float("M_AC_Power"),
+		AC_Power_L1:           values.Float("M_AC_Power_A"),
+		AC_Power_L2:           values.Float("M_AC_Power_B"),
+		AC_Power_L3:           values.Float("M_AC_Power_C"),
+		AC_VA:                 values.Float("M_AC_VA"),
+		AC_VAR:                values.Float("M_AC_VAR"),
+		AC_PF:                 values.Float("M_AC_PF"),
+		AC_PF_L1:              values.Float("M_AC_PF_A"),
+		AC_PF_L2:              values.Float("M_AC_PF_B"),
+		AC_PF_L3:              values.Float("M_AC_PF_C"),
+		AC_Energy_Exported_WH: values.Float("M_Exported"),
+		AC_Energy_Imported_WH: values.Float("M_Imported"),
+	}
+
+	timestamp := parsed.Time
+	meterRead.Time = &timestamp
+
+	return meterRead, values.Err()
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	utilities "github.com/stefannilsson/solaredgedc/common"
 	models "github.com/stefannilsson/solaredgedc/datamodels"
@@ -12,47 +15,72 @@ import (
 	modbus "github.com/stefannilsson/solaredgedc/poller"
 )
 
-var errorLog, infoLog, _ = logger.GetLoggers("mapping")
+var errorLog, infoLog, debugLog = logger.GetLoggers("mapping")
 
-/* Read Modbus registers, then cast to proper types and scale values accordingly */
-func ParseValues(registerValues *modbus.ModbusRegisters) map[string]interface{} {
-	scaledValues := map[string]interface{}{}
+/*
+	Values of a single poll: the typed inverter registers, and the scaled values of all registers by name.
+*/
+type ParsedValues struct {
+	// Unix time in milliseconds of the poll
+	Time int64
 
-	// let's timestamp the readings asap
-	scaledValues["Time"] = utilities.TimeNowInUnixMs()
+	// Decoded (unscaled) inverter registers, see ToPVSolarReading
+	Inverter *modbus.InverterRegisters
+
+	// Scaled values by register name, including meters ("M1_...") and batteries ("B1_..."), strings as read.
+	// Possible data types: {float64 (scaled), int16, uint16, uint32, uint64, float32, string}
+	Scaled map[string]interface{}
+
+	// Number of values left out as they (or their scale factor) are SunSpec "not implemented"
+	Suppressed int
+}
+
+/*
+	Read Modbus registers, then cast to proper types and scale values accordingly, timestamped with the time of the poll.
+	Values that can't be scaled (or typed) are left out and reported in the returned error, all other values are still returned.
+*/
+func ParseValues(registerValues *modbus.ModbusRegisters, pollTime time.Time) (*ParsedValues, error) {
+	parsed := &ParsedValues{Time: utilities.TimeInUnixMs(pollTime), Scaled: map[string]interface{}{}}
+	errors := []string{}
 
 	values := *registerValues
 	regexpEndWithSF := regexp.MustCompile("_SF$")
 
+	inverter, err := values.Inverter()
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	parsed.Inverter = inverter
+
 	for key, val := range values {
 		// No need to "scale" the ScaleFactor itself.
 		if regexpEndWithSF.MatchString(key) {
 			continue
 		}
 
+		// "Not implemented" value.
+		if val == nil {
+			parsed.Suppressed++
+			continue
+		}
+
 		// No need to process 'strings' furthers.
 		switch val.(type) {
 		case string:
-			scaledValues[key] = val
+			parsed.Scaled[key] = val
 			continue
 		}
 
 		// Scale Factor key ref
-		var sfKey string
-
-		// Custom Scale Factor fields (not applying the standard form "{REGISTERNAME}_SF" )
-		switch key {
-		case "I_AC_Current", "I_AC_CurrentA", "I_AC_CurrentB", "I_AC_CurrentC":
-			sfKey = "I_AC_Current_SF"
-		case "I_AC_VoltageAB", "I_AC_VoltageBC", "I_AC_VoltageCA", "I_AC_VoltageAN", "I_AC_VoltageBN", "I_AC_VoltageCN":
-			sfKey = "I_AC_Voltage_SF"
-		case "I_Temp_Sink":
-			sfKey = "I_Temp_SF"
-		default:
-			sfKey = fmt.Sprintf("%s_SF", key)
-		}
+		sfKey := ScaleFactorKey(key)
 
 		if sf, found := values[sfKey]; found {
+			// "Not implemented" scale factor, value can't be scaled.
+			if sf == nil {
+				parsed.Suppressed++
+				continue
+			}
+
 			// if we've recieved a field with a corresponding scale factor register, we'll assume a numeric data type.
 			var float64Value float64
 			switch val.(type) {
@@ -62,138 +90,159 @@ func ParseValues(registerValues *modbus.ModbusRegisters) map[string]interface{}
 				float64Value = float64(val.(uint16))
 			case uint32:
 				float64Value = float64(val.(uint32))
+			default:
+				errors = append(errors, fmt.Sprintf("'%s' is %T, can't be scaled", key, val))
+				continue
 			}
 
-			var scaleFactor int16
-			switch sf.(type) {
-			case int16:
-				scaleFactor = sf.(int16)
-			default:
-				panic("Unhandled ScaleFactory data type")
+			scaleFactor, ok := sf.(int16)
+			if !ok {
+				errors = append(errors, fmt.Sprintf("scale factor '%s' is %T, expected int16", sfKey, sf))
+				continue
 			}
 
 			// let's scale read value with it's corresponding scale factor according to SunSpec doc.
-			scaledValue := float64Value * math.Pow10(int(scaleFactor))
-			scaledValues[key] = scaledValue
+			parsed.Scaled[key] = float64Value * math.Pow10(int(scaleFactor))
 		} else {
 			// just store the read value as scaledValue if no corresponding _SF found.
-			scaledValues[key] = val
+			parsed.Scaled[key] = val
 		}
 	}
 
-	return scaledValues
-}
-
-/* Move successfully parsed values into the common PVSolar */
-func SerializeToJson(parsedValues map[string]interface{}) []byte {
-	// Map to our standard PV Solar data model.
-	C_SerialNumber := new(string)
-	I_AC_VoltageAN := new(float64)
-	I_AC_VoltageBN := new(float64)
-	I_AC_VoltageCN := new(float64)
-	I_AC_Power := new(float64)
-	I_AC_Frequency := new(float64)
-	I_AC_VA := new(float64)
-	I_AC_VAR := new(float64)
-	I_AC_PF := new(float64)
-	I_AC_Energy_WH := new(float64)
-	I_DC_Current := new(float64)
-	I_DC_Voltage := new(float64)
-	I_DC_Power := new(float64)
-	I_Temp_Sink := new(float64)
-	I_Status := new(uint16)
-	Time := new(int64)
-
-	// cast successfully scaled values into their right data type and prepare for JSON marshalling.
-	if value, ok := parsedValues["C_SerialNumber"]; ok {
-		*C_SerialNumber = value.(string)
-	}
-
-	if value, ok := parsedValues["I_AC_VoltageAN"]; ok {
-		*I_AC_VoltageAN = value.(float64)
-	}
-
-	if value, ok := parsedValues["I_AC_VoltageBN"]; ok {
-		*I_AC_VoltageBN = value.(float64)
-	}
-
-	if value, ok := parsedValues["I_AC_VoltageCN"]; ok {
-		*I_AC_VoltageCN = value.(float64)
+	if parsed.Suppressed > 0 {
+		debugLog.Debugf("%d \"not implemented\" values suppressed.", parsed.Suppressed)
 	}
 
-	if value, ok := parsedValues["I_AC_Power"]; ok {
-		*I_AC_Power = value.(float64)
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		return parsed, fmt.Errorf("failed to parse values: %s", strings.Join(errors, ", "))
 	}
 
-	if value, ok := parsedValues["I_AC_Frequency"]; ok {
-		*I_AC_Frequency = value.(float64)
-	}
-
-	if value, ok := parsedValues["I_AC_VA"]; ok {
-		*I_AC_VA = value.(float64)
-	}
-
-	if value, ok := parsedValues["I_AC_VAR"]; ok {
-		*I_AC_VAR = value.(float64)
-	}
-
-	if value, ok := parsedValues["I_AC_PF"]; ok {
-		*I_AC_PF = value.(float64)
-	}
-
-	if value, ok := parsedValues["I_AC_Energy_WH"]; ok {
-		*I_AC_Energy_WH = value.(float64)
-	}
+	return parsed, nil
+}
 
-	if value, ok := parsedValues["I_DC_Current"]; ok {
-		*I_DC_Current = value.(float64)
+// Meter register names are prefixed per meter, e.g. "M1_M_AC_Power".
+var regexpMeterPrefix = regexp.MustCompile(`^M\d+_`)
+
+// Battery register names are prefixed per battery, e.g. "B1_B_DC_Power".
+var regexpBatteryPrefix = regexp.MustCompile(`^B\d+_`)
+
+/* Name of the scale factor register belonging to a register. */
+func ScaleFactorKey(key string) string {
+	prefix := regexpMeterPrefix.FindString(key)
+	name := strings.TrimPrefix(key, prefix)
+
+	// Custom Scale Factor fields (not applying the standard form "{REGISTERNAME}_SF" )
+	switch name {
+	case "I_AC_Current", "I_AC_CurrentA", "I_AC_CurrentB", "I_AC_CurrentC":
+		return prefix + "I_AC_Current_SF"
+	case "I_AC_VoltageAB", "I_AC_VoltageBC", "I_AC_VoltageCA", "I_AC_VoltageAN", "I_AC_VoltageBN", "I_AC_VoltageCN":
+		return prefix + "I_AC_Voltage_SF"
+	case "I_Temp_Sink":
+		return prefix + "I_Temp_SF"
+	case "M_Exported", "M_Imported":
+		return prefix + "M_Energy_W_SF"
+	}
+
+	// Meter per-phase/average fields share the scale factor of their quantity, e.g. "M_AC_Power_A" -> "M_AC_Power_SF".
+	for _, quantity := range []string{"M_AC_Current", "M_AC_Voltage", "M_AC_Power", "M_AC_VAR", "M_AC_VA", "M_AC_PF"} {
+		if name == quantity || strings.HasPrefix(name, quantity+"_") {
+			return fmt.Sprintf("%s%s_SF", prefix, quantity)
+		}
 	}
 
-	if value, ok := parsedValues["I_DC_Voltage"]; ok {
-		*I_DC_Voltage = value.(float64)
-	}
+	return fmt.Sprintf("%s_SF", key)
+}
 
-	if value, ok := parsedValues["I_DC_Power"]; ok {
-		*I_DC_Power = value.(float64)
+/*
+	Move successfully parsed values into the common PVSolarReading, scaling the typed inverter registers.
+	Fields that are missing, or whose scale factor is missing, are left nil.
+*/
+func ToPVSolarReading(parsed *ParsedValues) *models.PVSolarReading {
+	inverter := parsed.Inverter
+	if inverter == nil {
+		inverter = &modbus.InverterRegisters{}
 	}
+	timestamp, suppressed := parsed.Time, parsed.Suppressed
 
-	if value, ok := parsedValues["I_Temp_Sink"]; ok {
-		*I_Temp_Sink = value.(float64)
-	}
+	// map to common data model
+	pvRead := &models.PVSolarReading{
+		MeterId:              inverter.C_SerialNumber,
+		Manufacturer:         inverter.C_Manufacturer,
+		Model:                inverter.C_Model,
+		Version:              inverter.C_Version,
+		PhaseConfiguration:   inverter.C_SunSpec_DID,
+		AC_Current:           scaleUint16(inverter.I_AC_Current, inverter.I_AC_Current_SF),
+		AC_Current_L1:        scaleUint16(inverter.I_AC_CurrentA, inverter.I_AC_Current_SF),
+		AC_Current_L2:        scaleUint16(inverter.I_AC_CurrentB, inverter.I_AC_Current_SF),
+		AC_Current_L3:        scaleUint16(inverter.I_AC_CurrentC, inverter.I_AC_Current_SF),
+		AC_Voltage_L1_L2:     scaleUint16(inverter.I_AC_VoltageAB, inverter.I_AC_Voltage_SF),
+		AC_Voltage_L2_L3:     scaleUint16(inverter.I_AC_VoltageBC, inverter.I_AC_Voltage_SF),
+		AC_Voltage_L3_L1:     scaleUint16(inverter.I_AC_VoltageCA, inverter.I_AC_Voltage_SF),
+		AC_Voltage_L1_N:      scaleUint16(inverter.I_AC_VoltageAN, inverter.I_AC_Voltage_SF),
+		AC_Voltage_L2_N:      scaleUint16(inverter.I_AC_VoltageBN, inverter.I_AC_Voltage_SF),
+		AC_Voltage_L3_N:      scaleUint16(inverter.I_AC_VoltageCN, inverter.I_AC_Voltage_SF),
+		AC_Power:             scaleInt16(inverter.I_AC_Power, inverter.I_AC_Power_SF),
+		AC_Frequency:         scaleUint16(inverter.I_AC_Frequency, inverter.I_AC_Frequency_SF),
+		AC_VA:                scaleInt16(inverter.I_AC_VA, inverter.I_AC_VA_SF),
+		AC_VAR:               scaleInt16(inverter.I_AC_VAR, inverter.I_AC_VAR_SF),
+		AC_PF:                scaleInt16(inverter.I_AC_PF, inverter.I_AC_PF_SF),
+		AC_Energy_WH:         scaleUint32(inverter.I_AC_Energy_WH, inverter.I_AC_Energy_WH_SF),
+		DC_Current:           scaleUint16(inverter.I_DC_Current, inverter.I_DC_Current_SF),
+		DC_Voltage:           scaleUint16(inverter.I_DC_Voltage, inverter.I_DC_Voltage_SF),
+		DC_Power:             scaleInt16(inverter.I_DC_Power, inverter.I_DC_Power_SF),
+		Temp_Sink:            scaleInt16(inverter.I_Temp_Sink, inverter.I_Temp_SF),
+		InverterStatus:       inverter.I_Status,
+		InverterStatusVendor: inverter.I_Status_Vendor,
+		Time:                 &timestamp,
+
+		SuppressedValues: &suppressed,
+	}
+
+	// human-readable status & vendor error code
+	if pvRead.InverterStatus != nil {
+		name := models.InverterStatus(*pvRead.InverterStatus).String()
+		pvRead.InverterStatusName = &name
+	}
+	if pvRead.InverterStatusVendor != nil {
+		description := models.VendorStatusDescription(*pvRead.InverterStatusVendor)
+		pvRead.InverterStatusVendorDescription = &description
+	}
+
+	return pvRead
+}
 
-	if value, ok := parsedValues["I_Status"]; ok {
-		*I_Status = value.(uint16)
+// Scale a value according to SunSpec (value * 10^sf), nil if the value or its scale factor is missing.
+func scale(value float64, scaleFactor *int16) *float64 {
+	if scaleFactor == nil {
+		return nil
 	}
+	scaled := value * math.Pow10(int(*scaleFactor))
+	return &scaled
+}
 
-	if value, ok := parsedValues["Time"]; ok {
-		*Time = value.(int64)
+func scaleUint16(value *uint16, scaleFactor *int16) *float64 {
+	if value == nil {
+		return nil
 	}
+	return scale(float64(*value), scaleFactor)
+}
 
-	// map to common data model
-	pvRead := &models.PVSolarReading{
-		MeterId:         C_SerialNumber,
-		AC_Voltage_L1_N: I_AC_VoltageAN,
-		AC_Voltage_L2_N: I_AC_VoltageBN,
-		AC_Voltage_L3_N: I_AC_VoltageCN,
-		AC_Power:        I_AC_Power,
-		AC_Frequency:    I_AC_Frequency,
-		AC_VA:           I_AC_VA,
-		AC_VAR:          I_AC_VAR,
-		AC_PF:           I_AC_PF,
-		AC_Energy_WH:    I_AC_Energy_WH,
-		DC_Current:      I_DC_Current,
-		DC_Voltage:      I_DC_Voltage,
-		DC_Power:        I_DC_Power,
-		Temp_Sink:       I_Temp_Sink,
-		InverterStatus:  I_Status,
-		Time:            Time,
+func scaleInt16(value *int16, scaleFactor *int16) *float64 {
+	if value == nil {
+		return nil
 	}
+	return scale(float64(*value), scaleFactor)
+}
 
-	// serialize to JSON payload
-	json, err := json.Marshal(pvRead)
-	if err != nil {
-		errorLog.Errorln(err.Error())
+func scaleUint32(value *uint32, scaleFactor *int16) *float64 {
+	if value == nil {
+		return nil
 	}
+	return scale(float64(*value), scaleFactor)
+}
 
-	return json
+/* Serialize a reading (PVSolarReading, MeterReading, BatteryReading) to its JSON payload */
+func SerializeToJson(reading interface{}) ([]byte, error) {
+	return json.Marshal(reading)
 }
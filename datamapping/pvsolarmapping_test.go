@@ -0,0 +1,105 @@
+package mapping
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+)
+
+func TestParseValues(t *testing.T) {
+	values := modbus.ModbusRegisters{
+		"C_SerialNumber":    "7E16A12F",
+		"I_AC_Current":      uint16(1234),
+		"I_AC_CurrentA":     nil,
+		"I_AC_Current_SF":   int16(-2),
+		"I_AC_Power":        int16(-50),
+		"I_AC_Power_SF":     int16(1),
+		"I_AC_VA":           int16(10),
+		"I_AC_VA_SF":        nil,
+		"I_Status":          uint16(4),
+		"M1_M_AC_Power":     int16(-1500),
+		"M1_M_AC_Power_SF":  int16(0),
+		"M1_C_SerialNumber": "M123",
+	}
+
+	parsed, err := ParseValues(&values, time.Unix(1601979914, 123456789))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Time != 1601979914123 {
+		t.Errorf("Time = %d, want the poll time in ms", parsed.Time)
+	}
+	if parsed.Suppressed != 2 {
+		t.Errorf("Suppressed = %d, want 2 (I_AC_CurrentA and I_AC_VA)", parsed.Suppressed)
+	}
+
+	scaled := map[string]interface{}{
+		"C_SerialNumber":    "7E16A12F",
+		"I_AC_Current":      12.34,
+		"I_AC_Power":        -500.0,
+		"I_Status":          uint16(4),
+		"M1_M_AC_Power":     -1500.0,
+		"M1_C_SerialNumber": "M123",
+	}
+	if len(parsed.Scaled) != len(scaled) {
+		t.Errorf("Scaled = %v, want %v", parsed.Scaled, scaled)
+	}
+	for key, want := range scaled {
+		if parsed.Scaled[key] != want {
+			t.Errorf("Scaled[%s] = %v (%T), want %v (%T)", key, parsed.Scaled[key], parsed.Scaled[key], want, want)
+		}
+	}
+
+	reading := ToPVSolarReading(parsed)
+	if reading.AC_Current == nil || *reading.AC_Current != 12.34 {
+		t.Errorf("AC_Current = %v, want 12.34", reading.AC_Current)
+	}
+	if reading.AC_Power == nil || *reading.AC_Power != -500 {
+		t.Errorf("AC_Power = %v, want -500", reading.AC_Power)
+	}
+	if reading.AC_Current_L1 != nil || reading.AC_VA != nil || reading.AC_Frequency != nil {
+		t.Errorf("not implemented or missing values set: AC_Current_L1 %v, AC_VA %v, AC_Frequency %v", reading.AC_Current_L1, reading.AC_VA, reading.AC_Frequency)
+	}
+	if reading.InverterStatusName == nil || *reading.InverterStatusName != "MPPT" {
+		t.Errorf("InverterStatusName = %v, want MPPT", reading.InverterStatusName)
+	}
+	if reading.SuppressedValues == nil || *reading.SuppressedValues != 2 || reading.Time == nil || *reading.Time != parsed.Time {
+		t.Errorf("SuppressedValues = %v, Time = %v", reading.SuppressedValues, reading.Time)
+	}
+
+	if meters := MeterIndexes(parsed); len(meters) != 1 || meters[0] != 1 {
+		t.Fatalf("MeterIndexes = %v, want [1]", meters)
+	}
+	meter, err := ToMeterReading(parsed, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meter.AC_Power == nil || *meter.AC_Power != -1500 || meter.MeterId == nil || *meter.MeterId != "M123" {
+		t.Errorf("meter AC_Power = %v, MeterId = %v", meter.AC_Power, meter.MeterId)
+	}
+}
+
+func TestParseValuesTypeErrors(t *testing.T) {
+	values := modbus.ModbusRegisters{
+		"I_AC_Power":     uint16(2354),
+		"I_AC_Power_SF":  int16(0),
+		"I_AC_Frequency": "50",
+		"I_Status":       uint16(4),
+	}
+
+	parsed, err := ParseValues(&values, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "'I_AC_Power' is uint16, expected int16") {
+		t.Errorf("error = %v, want a type mismatch of 'I_AC_Power'", err)
+	}
+
+	// Values of the wrong type are left out, the others are still mapped.
+	reading := ToPVSolarReading(parsed)
+	if reading.AC_Power != nil || reading.AC_Frequency != nil {
+		t.Errorf("AC_Power = %v, AC_Frequency = %v, want nil", reading.AC_Power, reading.AC_Frequency)
+	}
+	if reading.InverterStatus == nil || *reading.InverterStatus != 4 {
+		t.Errorf("InverterStatus = %v, want 4", reading.InverterStatus)
+	}
+}
@@ -0,0 +1,32 @@
+package mapping
+
+import (
+	models "github.com/stefannilsson/solaredgedc/datamodels"
+)
+
+/*
+	Compare the inverter status of two consecutive readings.
+	Returns the status change event, or nil if the status is unchanged or unknown in either reading. The first status
+	read after startup is the baseline, so that a restart of the collector isn't reported as a status change.
+*/
+func ToInverterStatusEvent(previous *models.PVSolarReading, current *models.PVSolarReading) *models.InverterStatusEvent {
+	if current == nil || current.InverterStatus == nil || previous == nil || previous.InverterStatus == nil {
+		return nil
+	}
+	if *previous.InverterStatus == *current.InverterStatus {
+		return nil
+	}
+
+	event := &models.InverterStatusEvent{
+		MeterId:                 current.MeterId,
+		Status:                  current.InverterStatus,
+		StatusName:              current.InverterStatusName,
+		StatusVendor:            current.InverterStatusVendor,
+		StatusVendorDescription: current.InverterStatusVendorDescription,
+		PreviousStatus:          previous.InverterStatus,
+		PreviousStatusName:      previous.InverterStatusName,
+		Time:                    current.Time,
+	}
+
+	return event
+}
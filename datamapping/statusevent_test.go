@@ -0,0 +1,50 @@
+package mapping
+
+import (
+	"testing"
+
+	models "github.com/stefannilsson/solaredgedc/datamodels"
+)
+
+func statusReading(status *uint16) *models.PVSolarReading {
+	reading := &models.PVSolarReading{InverterStatus: status}
+	if status != nil {
+		name := models.InverterStatus(*status).String()
+		reading.InverterStatusName = &name
+	}
+	return reading
+}
+
+func statusCode(value uint16) *uint16 {
+	return &value
+}
+
+func TestToInverterStatusEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous *models.PVSolarReading
+		current  *models.PVSolarReading
+		want     bool
+	}{
+		{"first reading is the baseline", nil, statusReading(statusCode(4)), false},
+		{"previous status unknown", statusReading(nil), statusReading(statusCode(4)), false},
+		{"current status unknown", statusReading(statusCode(4)), statusReading(nil), false},
+		{"unchanged", statusReading(statusCode(4)), statusReading(statusCode(4)), false},
+		{"changed", statusReading(statusCode(4)), statusReading(statusCode(2)), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := ToInverterStatusEvent(test.previous, test.current)
+			if (event != nil) != test.want {
+				t.Fatalf("event = %+v, want event %t", event, test.want)
+			}
+			if event == nil {
+				return
+			}
+			if *event.PreviousStatus != *test.previous.InverterStatus || *event.PreviousStatusName != "MPPT" || *event.StatusName != "SLEEPING" {
+				t.Errorf("event %s -> %s, want MPPT -> SLEEPING", *event.PreviousStatusName, *event.StatusName)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package models
+
+type BatteryReading struct {
+
+	// Identifier of component being measured.
+	BatteryId *string
+
+	// Battery position (1-2 on SolarEdge StorEdge inverters)
+	BatteryIndex int
+
+	// Battery manufacturer, model and firmware version
+	Manufacturer *string
+	Model        *string
+	Version      *string
+
+	// Rated Energy (WattHours)
+	RatedEnergy_WH *float64
+
+	// Max continuous charge power (Watts)
+	MaxChargePower *float64
+
+	// Max continuous discharge power (Watts)
+	MaxDischargePower *float64
+
+	// Instantaneous DC Voltage (Volts)
+	DC_Voltage *float64
+
+	// Instantaneous DC Current (Amps)
+	DC_Current *float64
+
+	// Instantaneous DC Power (Watts). Positive = charging, negative = discharging.
+	DC_Power *float64
+
+	// Lifetime energy exported from / imported into the battery (WattHours)
+	Energy_Exported_WH *uint64
+	Energy_Imported_WH *uint64
+
+	// Currently available energy (WattHours)
+	AvailableEnergy_WH *float64
+
+	// State of Energy (%)
+	StateOfEnergy *float64
+
+	// State of Health (%)
+	StateOfHealth *float64
+
+	// Battery Average Temperature (°C)
+	Temp_Average *float64
+
+	// Battery Status (vendor specific)
+	BatteryStatus *uint32
+
+	// Unix time in milliseconds of Modbus read
+	Time *int64 `json:"time"`
+}
@@ -0,0 +1,91 @@
+package models
+
+import "fmt"
+
+// Inverter Status names, as published in PVSolarReading.InverterStatusName
+var inverterStatusNames = map[InverterStatus]string{
+	IvsSTATUS_OFF:           "OFF",
+	IvsSTATUS_SLEEPING:      "SLEEPING",
+	IvsSTATUS_STARTING:      "STARTING",
+	IvsSTATUS_MPPT:          "MPPT",
+	IvsSTATUS_THROTTLED:     "THROTTLED",
+	IvsSTATUS_SHUTTING_DOWN: "SHUTTING_DOWN",
+	IvsSTATUS_FAULT:         "FAULT",
+	IvsSTATUS_STANDBY:       "STANDBY",
+}
+
+func (status InverterStatus) String() string {
+	if name, found := inverterStatusNames[status]; found {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int(status))
+}
+
+/*
+	SolarEdge vendor status (I_Status_Vendor) error codes.
+	Based on the error codes listed in the SolarEdge Installation Guide, which remains the reference for
+	troubleshooting. Not exhaustive, codes missing here are reported as unknown.
+*/
+var vendorStatusDescriptions = map[uint16]string{
+	0:   "No error",
+	17:  "Temperature too high",
+	25:  "Isolation fault",
+	27:  "Hardware error",
+	31:  "AC voltage too high",
+	32:  "AC voltage too low",
+	33:  "AC voltage too high",
+	34:  "AC frequency too high",
+	35:  "AC frequency too low",
+	41:  "AC voltage too low",
+	44:  "No country selected",
+	64:  "DC injection",
+	65:  "DC injection",
+	66:  "DC injection",
+	67:  "RCD test failed",
+	68:  "RCD test failed",
+	79:  "Grid error",
+	102: "DC voltage too high",
+	104: "Temperature too high",
+	105: "Temperature too high",
+	106: "Temperature too high",
+	107: "Battery communication error",
+	110: "Meter communication error",
+	120: "Ground current (RCD)",
+	121: "Isolation fault",
+	122: "Grid error",
+	123: "Grid error",
+	124: "Grid error",
+	125: "Grid error",
+	126: "Grid error",
+	150: "Arc fault detected",
+	151: "Arc fault detected",
+	153: "Hardware error",
+}
+
+// Description of a SolarEdge vendor status/error code.
+func VendorStatusDescription(code uint16) string {
+	if description, found := vendorStatusDescriptions[code]; found {
+		return description
+	}
+	return fmt.Sprintf("Unknown vendor status %d, refer to the SolarEdge Installation Guide", code)
+}
+
+// Emitted whenever the inverter status changes between two polls.
+type InverterStatusEvent struct {
+
+	// Identifier of component being measured.
+	MeterId *string
+
+	// Status before and after the change
+	PreviousStatus     *uint16
+	PreviousStatusName *string
+	Status             *uint16
+	StatusName         *string
+
+	// Vendor status/error code at the time of the change
+	StatusVendor            *uint16
+	StatusVendorDescription *string
+
+	// Unix time in milliseconds of Modbus read
+	Time *int64 `json:"time"`
+}
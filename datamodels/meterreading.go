@@ -0,0 +1,76 @@
+package models
+
+type MeterReading struct {
+
+	// Identifier of component being measured.
+	MeterId *string
+
+	// Meter position in the SunSpec model chain (1-3 on SolarEdge inverters)
+	MeterIndex int
+
+	// SunSpec meter model (201 = single phase, 202 = split phase, 203 = wye three phase, 204 = delta three phase)
+	MeterType *uint16
+
+	// AC Current (Amps, sum of active phases)
+	AC_Current *float64
+	// AC Current Phase A/L1 (Amps)
+	AC_Current_L1 *float64
+	// AC Current Phase B/L2 (Amps)
+	AC_Current_L2 *float64
+	// AC Current Phase C/L3 (Amps)
+	AC_Current_L3 *float64
+
+	// AC Voltage Line to Neutral (Volts, average of active phases)
+	AC_Voltage_L_N *float64
+	// AC Voltage Phase A/L1 to N value (Volts)
+	AC_Voltage_L1_N *float64
+	// AC Voltage Phase B/L2 to N value (Volts)
+	AC_Voltage_L2_N *float64
+	// AC Voltage Phase C/L3 to N value (Volts)
+	AC_Voltage_L3_N *float64
+
+	// AC Voltage Line to Line (Volts, average of active phases)
+	AC_Voltage_L_L *float64
+	// AC Voltage Phase A/L1 to B/L2 (Volts)
+	AC_Voltage_L1_L2 *float64
+	// AC Voltage Phase B/L2 to C/L3 (Volts)
+	AC_Voltage_L2_L3 *float64
+	// AC Voltage Phase C/L3 to A/L1 (Volts)
+	AC_Voltage_L3_L1 *float64
+
+	// AC Frequency (hz)
+	AC_Frequency *float64
+
+	// AC Real Power (Watts, sum of active phases). Positive = export, negative = import.
+	AC_Power *float64
+	// AC Real Power Phase A/L1 (Watts)
+	AC_Power_L1 *float64
+	// AC Real Power Phase B/L2 (Watts)
+	AC_Power_L2 *float64
+	// AC Real Power Phase C/L3 (Watts)
+	AC_Power_L3 *float64
+
+	// AC Apparent Power (VA)
+	AC_VA *float64
+
+	// AC Reactive Power (VAR)
+	AC_VAR *float64
+
+	// AC Power Factor (%, average of active phases)
+	AC_PF *float64
+	// AC Power Factor Phase A/L1 (%)
+	AC_PF_L1 *float64
+	// AC Power Factor Phase B/L2 (%)
+	AC_PF_L2 *float64
+	// AC Power Factor Phase C/L3 (%)
+	AC_PF_L3 *float64
+
+	// Total Exported Real Energy (WattHours)
+	AC_Energy_Exported_WH *float64
+
+	// Total Imported Real Energy (WattHours)
+	AC_Energy_Imported_WH *float64
+
+	// Unix time in milliseconds of Modbus read
+	Time *int64 `json:"time"`
+}
@@ -5,28 +5,28 @@ type InverterStatus int
 
 const (
 	// Off
-	ivsSTATUS_OFF = 1
+	IvsSTATUS_OFF InverterStatus = 1
 
 	// Sleeping (auto-shutdown) – Night mode
-	ivsSTATUS_SLEEPING = 2
+	IvsSTATUS_SLEEPING InverterStatus = 2
 
 	// Grid Monitoring/wake-up
-	ivsSTATUS_STARTING = 3
+	IvsSTATUS_STARTING InverterStatus = 3
 
 	// Inverter is ON and producing power
-	ivsSTATUS_MPPT = 4
+	IvsSTATUS_MPPT InverterStatus = 4
 
 	// Production (curtailed)
-	ivsSTATUS_THROTTLED = 5
+	IvsSTATUS_THROTTLED InverterStatus = 5
 
 	// Shutting down
-	ivsSTATUS_SHUTTING_DOWN = 6
+	IvsSTATUS_SHUTTING_DOWN InverterStatus = 6
 
 	// Fault
-	ivsSTATUS_FAULT = 7
+	IvsSTATUS_FAULT InverterStatus = 7
 
 	// Maintenance/setup
-	ivsSTATUS_STANDBY = 8
+	IvsSTATUS_STANDBY InverterStatus = 8
 )
 
 type PVSolarReading struct {
@@ -34,6 +34,30 @@ type PVSolarReading struct {
 	// Identifier of component being measured.
 	MeterId *string
 
+	// Inverter manufacturer, model and firmware version (SunSpec common block)
+	Manufacturer *string
+	Model        *string
+	Version      *string
+
+	// SunSpec inverter model: 101 = single phase, 102 = split phase, 103 = three phase
+	PhaseConfiguration *uint16
+
+	// AC Total Current value (Amps)
+	AC_Current *float64
+	// AC Current Phase A/L1 (Amps)
+	AC_Current_L1 *float64
+	// AC Current Phase B/L2 (Amps)
+	AC_Current_L2 *float64
+	// AC Current Phase C/L3 (Amps)
+	AC_Current_L3 *float64
+
+	// AC Voltage Phase A/L1 to B/L2 (Volts)
+	AC_Voltage_L1_L2 *float64
+	// AC Voltage Phase B/L2 to C/L3 (Volts)
+	AC_Voltage_L2_L3 *float64
+	// AC Voltage Phase C/L3 to A/L1 (Volts)
+	AC_Voltage_L3_L1 *float64
+
 	// AC Voltage Phase A/L1 to N value (Volts)
 	AC_Voltage_L1_N *float64
 	// AC Voltage Phase B/L2 to N value (Volts)
@@ -53,7 +77,7 @@ type PVSolarReading struct {
 	// AC Reactive Power (VAR)
 	AC_VAR *float64 // Reactive Power
 
-	// AC Power Factor (pf, 0.0-1.0)
+	// AC Power Factor (%, SunSpec PF)
 	AC_PF *float64 // Power Factor
 
 	// AC Lifetime Energy production
@@ -73,10 +97,22 @@ type PVSolarReading struct {
 
 	/*
 	 Inverter Status:
-	 {ivsSTATUS_OFF,ivsSTATUS_SLEEPING,ivsSTATUS_STARTING,ivsSTATUS_MPPT,ivsSTATUS_THROTTLED,ivsSTATUS_SHUTTING_DOWN,ivsSTATUS_FAULT,ivsSTATUS_STANDBY}
+	 {IvsSTATUS_OFF,IvsSTATUS_SLEEPING,IvsSTATUS_STARTING,IvsSTATUS_MPPT,IvsSTATUS_THROTTLED,IvsSTATUS_SHUTTING_DOWN,IvsSTATUS_FAULT,IvsSTATUS_STANDBY}
 	*/
 	InverterStatus *uint16
 
+	// Inverter Status name, e.g. "MPPT" (see InverterStatus.String())
+	InverterStatusName *string
+
+	// Vendor-defined operating state and error codes (see SolarEdge Installation Guide)
+	InverterStatusVendor *uint16
+
+	// Description of the vendor status/error code, e.g. "AC voltage too high" (see VendorStatusDescription())
+	InverterStatusVendorDescription *string
+
 	// Unix time in milliseconds of Modbus read
 	Time *int64 `json:"time"`
+
+	// Number of values left out (null) in this reading as the inverter reported them as "not implemented"
+	SuppressedValues *int
 }
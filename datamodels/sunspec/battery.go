@@ -0,0 +1,112 @@
+package sunspec
+
+import "fmt"
+
+// SolarEdge StorEdge battery registers (not part of the SunSpec model chain), see the SolarEdge
+// "StorEdge Charge/Discharge Profile Programming" technical note.
+
+const (
+	// Address of the first battery block (0xE100), subsequent batteries follow every 0x100 registers.
+	BATTERY_BASE_ADDRESS = 0xE100
+	BATTERY_BLOCK_STRIDE = 0x100
+
+	// SolarEdge inverters support up to two batteries.
+	MAX_BATTERIES = 2
+)
+
+// Fields of a StorEdge battery block, offsets relative to the start of the block.
+// float32/uint64 values are transmitted least significant word first.
+var BatteryModel = map[string]ModelField{
+	// Battery manufacturer name
+	"B_Manufacturer": {Offset: 0x00, Size: 16, Type: Dt_string},
+
+	// Battery model
+	"B_Model": {Offset: 0x10, Size: 16, Type: Dt_string},
+
+	// Battery firmware version
+	"B_Version": {Offset: 0x20, Size: 16, Type: Dt_string},
+
+	// Battery serial number
+	"B_SerialNumber": {Offset: 0x30, Size: 16, Type: Dt_string},
+
+	// Battery device ID
+	"B_DeviceId": {Offset: 0x40, Type: Dt_uint16},
+
+	// Rated energy (WattHours)
+	"B_RatedEnergy": {Offset: 0x42, Type: Dt_float32, WordSwap: true},
+
+	// Max charge continuous power (Watts)
+	"B_MaxChargePower": {Offset: 0x44, Type: Dt_float32, WordSwap: true},
+
+	// Max discharge continuous power (Watts)
+	"B_MaxDischargePower": {Offset: 0x46, Type: Dt_float32, WordSwap: true},
+
+	// Max charge peak power (Watts)
+	"B_MaxChargePeakPower": {Offset: 0x48, Type: Dt_float32, WordSwap: true},
+
+	// Max discharge peak power (Watts)
+	"B_MaxDischargePeakPower": {Offset: 0x4A, Type: Dt_float32, WordSwap: true},
+
+	// Average temperature (Degrees C)
+	"B_Temp_Average": {Offset: 0x6C, Type: Dt_float32, WordSwap: true},
+
+	// Max temperature (Degrees C)
+	"B_Temp_Max": {Offset: 0x6E, Type: Dt_float32, WordSwap: true},
+
+	// Instantaneous voltage (Volts)
+	"B_DC_Voltage": {Offset: 0x70, Type: Dt_float32, WordSwap: true},
+
+	// Instantaneous current (Amps)
+	"B_DC_Current": {Offset: 0x72, Type: Dt_float32, WordSwap: true},
+
+	// Instantaneous power (Watts). Positive = charging, negative = discharging.
+	"B_DC_Power": {Offset: 0x74, Type: Dt_float32, WordSwap: true},
+
+	// Lifetime export energy counter (WattHours)
+	"B_Export_Energy_WH": {Offset: 0x76, Type: Dt_uint64, WordSwap: true},
+
+	// Lifetime import energy counter (WattHours)
+	"B_Import_Energy_WH": {Offset: 0x7A, Type: Dt_uint64, WordSwap: true},
+
+	// Max energy (WattHours)
+	"B_Energy_Max": {Offset: 0x7E, Type: Dt_float32, WordSwap: true},
+
+	// Available energy (WattHours)
+	"B_Energy_Available": {Offset: 0x80, Type: Dt_float32, WordSwap: true},
+
+	// State of health (%)
+	"B_SOH": {Offset: 0x82, Type: Dt_float32, WordSwap: true},
+
+	// State of energy (%)
+	"B_SOE": {Offset: 0x84, Type: Dt_float32, WordSwap: true},
+
+	// Battery status
+	"B_Status": {Offset: 0x86, Type: Dt_uint32, WordSwap: true},
+
+	// Battery internal status
+	"B_Status_Internal": {Offset: 0x88, Type: Dt_uint32, WordSwap: true},
+}
+
+// Address of the n-th battery block (1-based).
+func BatteryAddress(battery int) uint16 {
+	return uint16(BATTERY_BASE_ADDRESS + (battery-1)*BATTERY_BLOCK_STRIDE)
+}
+
+// Register name prefix of the n-th battery (1-based), e.g. "B1_".
+func BatteryPrefix(battery int) string {
+	return fmt.Sprintf("B%d_", battery)
+}
+
+// Build the absolute register map of the given batteries (1-based indexes).
+func BuildBatteryRegisters(batteries []int) map[string]ModbusAddress {
+	registers := map[string]ModbusAddress{}
+
+	for _, battery := range batteries {
+		base := BatteryAddress(battery)
+		for name, field := range BatteryModel {
+			registers[BatteryPrefix(battery)+name] = ModbusAddress{Address: base + field.Offset, Size: field.Size, Type: field.Type, WordSwap: field.WordSwap}
+		}
+	}
+
+	return registers
+}
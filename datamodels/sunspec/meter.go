@@ -0,0 +1,132 @@
+package sunspec
+
+import "fmt"
+
+// SolarEdge meter register addresses (meter 1-3 common blocks at 40121, 40295 and 40469):
+// https://www.solaredge.com/sites/default/files/sunspec-implementation-technical-note.pdf
+
+// SunSpec meter model IDs
+const (
+	Model_METER_SINGLE_PHASE = 201
+	Model_METER_SPLIT_PHASE  = 202
+	Model_METER_WYE          = 203
+	Model_METER_DELTA        = 204
+)
+
+// Fields of the SunSpec meter models (201 = single phase, 202 = split phase, 203 = wye three phase, 204 = delta three phase)
+var MeterModel = map[string]ModelField{
+	// 201 = single phase, 202 = split phase, 203 = wye-connect three phase, 204 = delta-connect three phase
+	"C_SunSpec_DID": {Offset: 0, Type: Dt_uint16},
+
+	// 105 = Length of model block
+	"C_SunSpec_Length": {Offset: 1, Type: Dt_uint16},
+
+	// AC Current (sum of active phases)
+	"M_AC_Current": {Offset: 2, Type: Dt_int16},
+
+	// Phase A AC Current
+	"M_AC_Current_A": {Offset: 3, Type: Dt_int16},
+
+	// Phase B AC Current
+	"M_AC_Current_B": {Offset: 4, Type: Dt_int16},
+
+	// Phase C AC Current
+	"M_AC_Current_C": {Offset: 5, Type: Dt_int16},
+
+	// AC Current Scale Factor
+	"M_AC_Current_SF": {Offset: 6, Type: Dt_int16},
+
+	// Line to Neutral AC Voltage (average of active phases)
+	"M_AC_Voltage_LN": {Offset: 7, Type: Dt_int16},
+
+	// Phase A to Neutral AC Voltage
+	"M_AC_Voltage_AN": {Offset: 8, Type: Dt_int16},
+
+	// Phase B to Neutral AC Voltage
+	"M_AC_Voltage_BN": {Offset: 9, Type: Dt_int16},
+
+	// Phase C to Neutral AC Voltage
+	"M_AC_Voltage_CN": {Offset: 10, Type: Dt_int16},
+
+	// Line to Line AC Voltage (average of active phases)
+	"M_AC_Voltage_LL": {Offset: 11, Type: Dt_int16},
+
+	// Phase A to Phase B AC Voltage
+	"M_AC_Voltage_AB": {Offset: 12, Type: Dt_int16},
+
+	// Phase B to Phase C AC Voltage
+	"M_AC_Voltage_BC": {Offset: 13, Type: Dt_int16},
+
+	// Phase C to Phase A AC Voltage
+	"M_AC_Voltage_CA": {Offset: 14, Type: Dt_int16},
+
+	// AC Voltage Scale Factor
+	"M_AC_Voltage_SF": {Offset: 15, Type: Dt_int16},
+
+	// AC Frequency
+	"M_AC_Freq": {Offset: 16, Type: Dt_int16},
+
+	// Scale factor
+	"M_AC_Freq_SF": {Offset: 17, Type: Dt_int16},
+
+	// Total Real Power (sum of active phases)
+	"M_AC_Power": {Offset: 18, Type: Dt_int16},
+
+	// Phase A AC Real Power
+	"M_AC_Power_A": {Offset: 19, Type: Dt_int16},
+
+	// Phase B AC Real Power
+	"M_AC_Power_B": {Offset: 20, Type: Dt_int16},
+
+	// Phase C AC Real Power
+	"M_AC_Power_C": {Offset: 21, Type: Dt_int16},
+
+	// AC Real Power Scale Factor
+	"M_AC_Power_SF": {Offset: 22, Type: Dt_int16},
+
+	// Total AC Apparent Power (sum of active phases)
+	"M_AC_VA": {Offset: 23, Type: Dt_int16},
+
+	// AC Apparent Power Scale Factor
+	"M_AC_VA_SF": {Offset: 27, Type: Dt_int16},
+
+	// Total AC Reactive Power (sum of active phases)
+	"M_AC_VAR": {Offset: 28, Type: Dt_int16},
+
+	// AC Reactive Power Scale Factor
+	"M_AC_VAR_SF": {Offset: 32, Type: Dt_int16},
+
+	// Average Power Factor (average of active phases)
+	"M_AC_PF": {Offset: 33, Type: Dt_int16},
+
+	// Phase A Power Factor
+	"M_AC_PF_A": {Offset: 34, Type: Dt_int16},
+
+	// Phase B Power Factor
+	"M_AC_PF_B": {Offset: 35, Type: Dt_int16},
+
+	// Phase C Power Factor
+	"M_AC_PF_C": {Offset: 36, Type: Dt_int16},
+
+	// AC Power Factor Scale Factor
+	"M_AC_PF_SF": {Offset: 37, Type: Dt_int16},
+
+	// Total Exported Real Energy (WattHours)
+	"M_Exported": {Offset: 38, Type: Dt_acc32},
+
+	// Total Imported Real Energy (WattHours)
+	"M_Imported": {Offset: 46, Type: Dt_acc32},
+
+	// Real Energy Scale Factor
+	"M_Energy_W_SF": {Offset: 54, Type: Dt_int16},
+}
+
+// Whether the model ID is one of the SunSpec meter models (201-204).
+func IsMeterModel(id uint16) bool {
+	return id >= Model_METER_SINGLE_PHASE && id <= Model_METER_DELTA
+}
+
+// Register name prefix of the n-th meter (1-based), e.g. "M1_".
+func MeterPrefix(meter int) string {
+	return fmt.Sprintf("M%d_", meter)
+}
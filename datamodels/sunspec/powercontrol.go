@@ -0,0 +1,43 @@
+package sunspec
+
+// SolarEdge Advanced Power Control registers (not part of the SunSpec model chain), see the SolarEdge
+// "Power Control Open Protocol for SolarEdge Inverters" technical note.
+// int32 values are transmitted least significant word first.
+
+const (
+	// Write 1 to apply the settings requiring a commit, reads back 0 once committed (otherwise an error code).
+	PC_COMMIT_ADDRESS = 0xF100
+
+	// Write 1 to restore the power control default settings (followed by a commit).
+	PC_RESTORE_DEFAULTS_ADDRESS = 0xF101
+
+	// Active power limit bounds (% of the inverter's nominal active power)
+	PC_ACTIVE_POWER_LIMIT_MIN = 0
+	PC_ACTIVE_POWER_LIMIT_MAX = 100
+)
+
+// Reactive power modes (PC_ReactivePowerConfig)
+const (
+	PC_REACTIVE_FIXED_COSPHI   = 0
+	PC_REACTIVE_FIXED_Q        = 1
+	PC_REACTIVE_COSPHI_P       = 2
+	PC_REACTIVE_Q_U_Q_P        = 3
+	PC_REACTIVE_RRCR           = 4
+	PC_REACTIVE_CONFIG_MAXIMUM = PC_REACTIVE_RRCR
+)
+
+var PowerControlRegisters = map[string]ModbusAddress{
+	// Active power limit (%, 0-100), applied immediately
+	"PC_ActivePowerLimit": {Address: 0xF001, Type: Dt_uint16},
+
+	// Reactive power mode, see PC_REACTIVE_* (requires a commit)
+	"PC_ReactivePowerConfig": {Address: 0xF102, Type: Dt_uint32, WordSwap: true},
+
+	// Enable (1) or disable (0) advanced (dynamic) power control (requires a commit)
+	"PC_AdvancedPowerControlEn": {Address: 0xF142, Type: Dt_uint32, WordSwap: true},
+}
+
+// Whether a write to a power control register only takes effect once committed.
+func PowerControlRequiresCommit(key string) bool {
+	return key != "PC_ActivePowerLimit"
+}
@@ -9,6 +9,8 @@ const (
 	Dt_int16
 	Dt_string
 	Dt_acc32
+	Dt_float32
+	Dt_uint64
 )
 
 type ModbusAddress struct {
@@ -24,12 +26,38 @@ type ModbusAddress struct {
 	* <b>Dt_int16</b>
 	* <b>Dt_string</b>
 	* <b>Dt_acc32</b>
+	* <b>Dt_float32</b>
+	* <b>Dt_uint64</b>
 	 */
 	Type int
 
+	// Multi-register value transmitted least significant word first (e.g. SolarEdge battery registers)
+	WordSwap bool
+
 	Value interface{}
 }
 
+// Name of a data type as in the SunSpec documentation, e.g. "uint16".
+func TypeName(dataType int) string {
+	switch dataType {
+	case Dt_uint16:
+		return "uint16"
+	case Dt_uint32:
+		return "uint32"
+	case Dt_int16:
+		return "int16"
+	case Dt_string:
+		return "string"
+	case Dt_acc32:
+		return "acc32"
+	case Dt_float32:
+		return "float32"
+	case Dt_uint64:
+		return "uint64"
+	}
+	return "unknown"
+}
+
 // Inverter Statuses
 const (
 	Ivs_I_STATUS_OFF           = 1
@@ -42,150 +70,304 @@ const (
 	Ivs_I_STATUS_STANDBY       = 8
 )
 
-/*func GetModbusRegisters() map[string]ModbusAddress {
-	return Registers
-}*/
+const (
+	// Value = "SunS" (0x53756e53). Uniquely identifies this as a SunSpec MODBUS Map
+	SUNSPEC_ID = 0x53756e53
+
+	// Model ID marking the end of the SunSpec model chain.
+	SUNSPEC_END_MODEL_ID = 0xFFFF
+
+	// Well-known base addresses of the SunSpec map (SolarEdge uses 40000).
+	DEFAULT_BASE_ADDRESS = 40000
+)
+
+// SunSpec model IDs
+const (
+	Model_COMMON                = 1
+	Model_INVERTER_SINGLE_PHASE = 101
+	Model_INVERTER_SPLIT_PHASE  = 102
+	Model_INVERTER_THREE_PHASE  = 103
+)
+
+// A single field of a SunSpec model.
+type ModelField struct {
+	// Offset from the model's ID register (i.e. the ID is at offset 0 and the Length at offset 1).
+	Offset uint16
+
+	// Only needed for 'Type: string'
+	Size uint16
+
+	Type int
 
-// const registers map[string]ModbusAddress =
-var Registers = map[string]ModbusAddress{
-	/** [SUNSPEC : COMMON BLOCK] **/
-	/*
-		// Value = "SunS" (0x53756e53). Uniquely identifies this as a SunSpec MODBUS Map
-		"C_SunSpec_ID": {Address: 40000, Type: Dt_uint32},
+	// Multi-register value transmitted least significant word first
+	WordSwap bool
+}
 
-		// Value = 0x0001. Uniquely identifies this as a SunSpec Common Model Block
-		"C_SunSpec_DID": {Address: 40002, Type: Dt_uint16},
+// A model found while walking the SunSpec model chain.
+type DiscoveredModel struct {
+	// SunSpec model ID, e.g. 103
+	Id uint16
 
-		// 65 = Length of block in 16-bit registers
-		"C_SunSpec_Length": {Address: 40003, Type: Dt_uint16},
+	// Address of the model's ID register.
+	Address uint16
 
-		// Value Registered with SunSpec = "SolarEdge"
-		"C_Manufacturer": {Address: 40004, Size: 32, Type: Dt_string},
+	// Length of the model block in 16-bit registers (excluding ID and Length).
+	Length uint16
+}
 
-		// SolarEdge Specific Value
-		"C_Model": {Address: 40020, Size: 32, Type: Dt_string},
+// Fields of the SunSpec common block (model 1)
+var CommonModel = map[string]ModelField{
+	// Value Registered with SunSpec = "SolarEdge"
+	"C_Manufacturer": {Offset: 2, Size: 16, Type: Dt_string},
 
-		// SolarEdge Specific Value
-		"C_Version": {Address: 40044, Size: 16, Type: Dt_string},
+	// SolarEdge Specific Value
+	"C_Model": {Offset: 18, Size: 16, Type: Dt_string},
 
-		// SolarEdge Unique Value
-		"C_SerialNumber": {Address: 40052, Size: 32, Type: Dt_string},
+	// SolarEdge Specific Value
+	"C_Version": {Offset: 42, Size: 8, Type: Dt_string},
 
-		// MODBUS Unit ID
-		"C_DeviceAddress": {Address: 40068, Type: Dt_uint16},
-		/*
-		/** END of [SUNSPEC : COMMON BLOCK] **/
+	// SolarEdge Unique Value
+	"C_SerialNumber": {Offset: 50, Size: 16, Type: Dt_string},
 
-	"C_SerialNumber": {Address: 40052, Size: 4, Type: Dt_string}, // Default: Size: 32
+	// MODBUS Unit ID
+	"C_DeviceAddress": {Offset: 66, Type: Dt_uint16},
+}
 
-	/** [SolarEdge Specific Registers] **/
+// Fields of the SunSpec inverter models (101 = single phase, 102 = split phase, 103 = three phase)
+var InverterModel = map[string]ModelField{
 	// 101 = single phase, 102 = split phase, 103 = three phase
-	"C_SunSpec_DID": {Address: 40069, Type: Dt_uint16},
+	"C_SunSpec_DID": {Offset: 0, Type: Dt_uint16},
 
 	// 50 = Length of model block
-	"C_SunSpec_Length": {Address: 40070, Type: Dt_uint16},
+	"C_SunSpec_Length": {Offset: 1, Type: Dt_uint16},
 
 	// AC Total Current value
-	"I_AC_Current": {Address: 40071, Type: Dt_uint16},
+	"I_AC_Current": {Offset: 2, Type: Dt_uint16},
 
 	// AC Phase A Current value
-	"I_AC_CurrentA": {Address: 40072, Type: Dt_uint16},
+	"I_AC_CurrentA": {Offset: 3, Type: Dt_uint16},
 
 	// AC Phase B Current value
-	"I_AC_CurrentB": {Address: 40073, Type: Dt_uint16},
+	"I_AC_CurrentB": {Offset: 4, Type: Dt_uint16},
 
 	// AC Phase C Current value
-	"I_AC_CurrentC": {Address: 40074, Type: Dt_uint16},
+	"I_AC_CurrentC": {Offset: 5, Type: Dt_uint16},
 
 	// AC Current scale factor
-	"I_AC_Current_SF": {Address: 40075, Type: Dt_int16},
+	"I_AC_Current_SF": {Offset: 6, Type: Dt_int16},
 
 	// AC Voltage Phase AB value
-	"I_AC_VoltageAB": {Address: 40076, Type: Dt_uint16},
+	"I_AC_VoltageAB": {Offset: 7, Type: Dt_uint16},
 
 	// AC Voltage Phase BC value
-	"I_AC_VoltageBC": {Address: 40077, Type: Dt_uint16},
+	"I_AC_VoltageBC": {Offset: 8, Type: Dt_uint16},
 
 	// AC Voltage Phase CA value
-	"I_AC_VoltageCA": {Address: 40078, Type: Dt_uint16},
+	"I_AC_VoltageCA": {Offset: 9, Type: Dt_uint16},
 
 	// AC Voltage Phase A to N value
-	"I_AC_VoltageAN": {Address: 40079, Type: Dt_uint16},
+	"I_AC_VoltageAN": {Offset: 10, Type: Dt_uint16},
 
 	// AC Voltage Phase B to N value
-	"I_AC_VoltageBN": {Address: 40080, Type: Dt_uint16},
+	"I_AC_VoltageBN": {Offset: 11, Type: Dt_uint16},
 
 	// AC Voltage Phase C to N value
-	"I_AC_VoltageCN": {Address: 40081, Type: Dt_uint16},
+	"I_AC_VoltageCN": {Offset: 12, Type: Dt_uint16},
 
 	// AC Voltage scale factor
-	"I_AC_Voltage_SF": {Address: 40082, Type: Dt_int16},
+	"I_AC_Voltage_SF": {Offset: 13, Type: Dt_int16},
 
 	// AC Power value
-	"I_AC_Power": {Address: 40083, Type: Dt_int16},
+	"I_AC_Power": {Offset: 14, Type: Dt_int16},
 
 	// AC Power scale factor
-	"I_AC_Power_SF": {Address: 40084, Type: Dt_int16},
+	"I_AC_Power_SF": {Offset: 15, Type: Dt_int16},
 
 	// AC Frequency value
-	"I_AC_Frequency": {Address: 40085, Type: Dt_uint16},
+	"I_AC_Frequency": {Offset: 16, Type: Dt_uint16},
 
 	// Scale factor
-	"I_AC_Frequency_SF": {Address: 40086, Type: Dt_int16},
+	"I_AC_Frequency_SF": {Offset: 17, Type: Dt_int16},
 
 	// Apparent Power
-	"I_AC_VA": {Address: 40087, Type: Dt_int16},
+	"I_AC_VA": {Offset: 18, Type: Dt_int16},
 
 	// Scale factor
-	"I_AC_VA_SF": {Address: 40088, Type: Dt_int16},
+	"I_AC_VA_SF": {Offset: 19, Type: Dt_int16},
 
 	// Reactive Power
-	"I_AC_VAR": {Address: 40089, Type: Dt_int16},
+	"I_AC_VAR": {Offset: 20, Type: Dt_int16},
 
 	// Scale factor
-	"I_AC_VAR_SF": {Address: 40090, Type: Dt_int16},
+	"I_AC_VAR_SF": {Offset: 21, Type: Dt_int16},
 
 	// Power Factor (%)
-	"I_AC_PF": {Address: 40091, Type: Dt_int16},
+	"I_AC_PF": {Offset: 22, Type: Dt_int16},
 
 	// Scale factor
-	"I_AC_PF_SF": {Address: 40092, Type: Dt_int16},
+	"I_AC_PF_SF": {Offset: 23, Type: Dt_int16},
 
 	// AC Lifetime Energy production (WattHours)
-	"I_AC_Energy_WH": {Address: 40093, Type: Dt_acc32},
+	"I_AC_Energy_WH": {Offset: 24, Type: Dt_acc32},
 
 	// Scale factor
-	"I_AC_Energy_WH_SF": {Address: 40095, Type: Dt_int16}, // Data type typo 'uint16' where it _should_ be 'int16'
+	"I_AC_Energy_WH_SF": {Offset: 26, Type: Dt_int16}, // Data type typo 'uint16' where it _should_ be 'int16'
 
 	// DC Current value (Amps)
-	"I_DC_Current": {Address: 40096, Type: Dt_uint16},
+	"I_DC_Current": {Offset: 27, Type: Dt_uint16},
 
 	// Scale factor
-	"I_DC_Current_SF": {Address: 40097, Type: Dt_int16},
+	"I_DC_Current_SF": {Offset: 28, Type: Dt_int16},
 
 	// DC Voltage value (Volts)
-	"I_DC_Voltage": {Address: 40098, Type: Dt_uint16},
+	"I_DC_Voltage": {Offset: 29, Type: Dt_uint16},
 
 	// Scale factor
-	"I_DC_Voltage_SF": {Address: 40099, Type: Dt_int16},
+	"I_DC_Voltage_SF": {Offset: 30, Type: Dt_int16},
 
 	// DC Power value (Watts)
-	"I_DC_Power": {Address: 40100, Type: Dt_int16},
+	"I_DC_Power": {Offset: 31, Type: Dt_int16},
 
 	// Scale factor
-	"I_DC_Power_SF": {Address: 40101, Type: Dt_int16},
+	"I_DC_Power_SF": {Offset: 32, Type: Dt_int16},
 
 	// Heat Sink Temperature (Degrees C)
-	"I_Temp_Sink": {Address: 40103, Type: Dt_int16},
+	"I_Temp_Sink": {Offset: 34, Type: Dt_int16},
 
 	// Scale factor
-	"I_Temp_SF": {Address: 40106, Type: Dt_int16},
+	"I_Temp_SF": {Offset: 37, Type: Dt_int16},
 
 	// Operating State
-	"I_Status": {Address: 40107, Type: Dt_uint16},
+	"I_Status": {Offset: 38, Type: Dt_uint16},
 
 	// Vendor-defined operating state and error codes. For error description, meaning and troubleshooting, refer to the SolarEdge Installation Guide.
-	"I_Status_Vendor": {Address: 40108, Type: Dt_uint16},
+	"I_Status_Vendor": {Offset: 39, Type: Dt_uint16},
+}
+
+// Known model definitions, by SunSpec model ID.
+var Models = map[uint16]map[string]ModelField{
+	Model_COMMON:                CommonModel,
+	Model_INVERTER_SINGLE_PHASE: InverterModel,
+	Model_INVERTER_SPLIT_PHASE:  InverterModel,
+	Model_INVERTER_THREE_PHASE:  InverterModel,
+	Model_METER_SINGLE_PHASE:    MeterModel,
+	Model_METER_SPLIT_PHASE:     MeterModel,
+	Model_METER_WYE:             MeterModel,
+	Model_METER_DELTA:           MeterModel,
+}
+
+// Default SolarEdge layout: common block at 40002 directly followed by the inverter model at 40069.
+var DefaultModels = []DiscoveredModel{
+	{Id: Model_COMMON, Address: 40002, Length: 65},
+	{Id: Model_INVERTER_THREE_PHASE, Address: 40069, Length: 50},
+}
+
+// Registers of the default SolarEdge layout, used when model discovery is unavailable.
+var Registers = BuildRegisters(DefaultModels)
+
+/*
+	Build the absolute register map (register name -> address) of all known models found in the model chain.
+	Models without a definition are skipped.
+	Meters get their register names prefixed (see MeterPrefix), together with their own common block.
+*/
+func BuildRegisters(models []DiscoveredModel) map[string]ModbusAddress {
+	registers := map[string]ModbusAddress{}
+	prefixes := modelPrefixes(models)
+
+	for i, model := range models {
+		fields, known := Models[model.Id]
+		if !known {
+			continue
+		}
+
+		for name, field := range fields {
+			// Ignore fields beyond the length reported by the device.
+			if field.Offset >= model.Length+2 {
+				continue
+			}
+			registers[prefixes[i]+name] = ModbusAddress{Address: model.Address + field.Offset, Size: field.Size, Type: field.Type, WordSwap: field.WordSwap}
+		}
+	}
+
+	return registers
+}
+
+/*
+	Register name prefix per model in the chain.
+	Each common block (model 1) starts a new device; a device holding a meter model gets the next meter prefix.
+	A meter sharing its device with an inverter (i.e. without a common block of its own) only prefixes the meter model.
+*/
+func modelPrefixes(models []DiscoveredModel) []string {
+	devices := make([]int, len(models))
+	hasInverter := map[int]bool{}
+	device := 0
+	for i, model := range models {
+		if model.Id == Model_COMMON {
+			device++
+		}
+		devices[i] = device
+		if model.Id >= Model_INVERTER_SINGLE_PHASE && model.Id <= Model_INVERTER_THREE_PHASE {
+			hasInverter[device] = true
+		}
+	}
+
+	meters := 0
+	devicePrefix := map[int]string{}
+	prefixes := make([]string, len(models))
+	for i, model := range models {
+		if !IsMeterModel(model.Id) {
+			continue
+		}
+		if hasInverter[devices[i]] {
+			meters++
+			prefixes[i] = MeterPrefix(meters)
+		} else if _, found := devicePrefix[devices[i]]; !found {
+			meters++
+			devicePrefix[devices[i]] = MeterPrefix(meters)
+		}
+	}
+
+	for i := range models {
+		if prefix, found := devicePrefix[devices[i]]; found {
+			prefixes[i] = prefix
+		}
+	}
+
+	return prefixes
+}
+
+// SunSpec "not implemented/unavailable" values per data type (scale factors are int16, i.e. 0x8000)
+const (
+	NOT_IMPLEMENTED_INT16  = -0x8000
+	NOT_IMPLEMENTED_UINT16 = 0xFFFF
+	NOT_IMPLEMENTED_UINT32 = 0xFFFFFFFF
+	NOT_IMPLEMENTED_ACC32  = 0x00000000
+	NOT_IMPLEMENTED_UINT64 = 0xFFFFFFFFFFFFFFFF
+)
 
-	/** End of [SolarEdge Specific Registers] **/
+// Whether a decoded value is the SunSpec "not implemented" sentinel of its data type.
+func IsNotImplemented(dataType int, value interface{}) bool {
+	switch dataType {
+	case Dt_int16:
+		v, ok := value.(int16)
+		return ok && v == NOT_IMPLEMENTED_INT16
+	case Dt_uint16:
+		v, ok := value.(uint16)
+		return ok && v == NOT_IMPLEMENTED_UINT16
+	case Dt_uint32:
+		v, ok := value.(uint32)
+		return ok && v == NOT_IMPLEMENTED_UINT32
+	case Dt_acc32:
+		v, ok := value.(uint32)
+		return ok && v == NOT_IMPLEMENTED_ACC32
+	case Dt_uint64:
+		v, ok := value.(uint64)
+		return ok && v == NOT_IMPLEMENTED_UINT64
+	case Dt_float32:
+		// NaN
+		v, ok := value.(float32)
+		return ok && v != v
+	default:
+		return false
+	}
 }
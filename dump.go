@@ -0,0 +1,317 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	mapping "github.com/stefannilsson/solaredgedc/datamapping"
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+	logger "github.com/stefannilsson/solaredgedc/logger"
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+)
+
+const CONNECT_TIMEOUT = 5 * time.Second // of subcommands, the poller itself retries connecting forever
+
+/*
+	'dump' subcommand: connect to a device with the regular Modbus settings (flags, ENV, config file), read all
+	registers of its SunSpec models (or the given address range) once, and print raw, decoded & scaled values
+	side-by-side, e.g. 'solaredgedc dump -modbus_hostname 10.0.0.5 -address 40071 -count 10'.
+*/
+func RunDump(args []string) int {
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: solaredgedc dump [flags]")
+		flag.PrintDefaults()
+	}
+	flagAddress := flag.String("address", "", "First register to read, decimal or hex (ex: 40071, 0x9C87). Default: all registers of the discovered SunSpec models")
+	flagCount := flag.Int("count", 0, "Number of registers to read from -address (default: the size of the register at -address, or 1)")
+	flagDevice := flag.String("device", "", "Alias of the device to read, if several are configured (default: the first)")
+
+	logConfig, modbusConfig, _, _, err := parseArgumentsConfig(args, false)
+	errs := ConfigErrors{}
+	if err != nil {
+		errs = err.(ConfigErrors)
+	}
+
+	var address uint64
+	if *flagAddress != "" {
+		address, err = strconv.ParseUint(*flagAddress, 0, 16)
+		if err != nil {
+			errs.Add("invalid register address '%s', expected 0-65535", *flagAddress)
+		}
+		if *flagCount < 0 || address+uint64(*flagCount) > 0x10000 {
+			errs.Add("invalid register count %d from address %d", *flagCount, address)
+		}
+	} else if *flagCount != 0 {
+		errs.Add("a register count requires a register address (-address)")
+	}
+
+	device := selectDevice(modbusConfig, *flagDevice, &errs)
+
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, errs)
+		return 2
+	}
+	logger.Configure(LoggerConfig(logConfig))
+
+	client, err := connectDevice(modbusConfig, device)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer modbus.CloseAll()
+
+	models := []string{}
+	for _, model := range client.Models {
+		models = append(models, fmt.Sprintf("%d at %d (%d registers)", model.Id, model.Address, model.Length))
+	}
+	fmt.Fprintf(os.Stderr, "SunSpec models: %s\n", strings.Join(models, ", "))
+	if len(client.Batteries) > 0 {
+		fmt.Fprintf(os.Stderr, "Batteries: %v\n", client.Batteries)
+	}
+
+	dump := &registerDump{client: client, values: modbus.ModbusRegisters{}, raw: map[string][]byte{}}
+	if *flagAddress != "" {
+		err = dump.readRange(uint16(address), *flagCount)
+	} else {
+		err = dump.readModels()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dump.print()
+	return 0
+}
+
+// Device to talk to by alias, the first if no alias is given (subcommands reading or writing a single device).
+func selectDevice(modbusConfig *ModbusFlags, alias string, errs *ConfigErrors) *ModbusDeviceFlags {
+	aliases := []string{}
+	for i := range modbusConfig.devices {
+		if modbusConfig.devices[i].alias != "" {
+			aliases = append(aliases, modbusConfig.devices[i].alias)
+		}
+		if alias == "" || modbusConfig.devices[i].alias == alias {
+			return &modbusConfig.devices[i]
+		}
+	}
+	if len(aliases) > 0 {
+		errs.Add("unknown device '%s', expected one of %s", alias, strings.Join(aliases, ", "))
+	} else {
+		errs.Add("unknown device '%s', no device aliases configured (MODBUS_DEVICES / -modbus_devices / modbus.devices)", alias)
+	}
+	return nil
+}
+
+// Connect to a device and discover its models, failing fast if it can't be reached (the poller retries forever).
+func connectDevice(modbusConfig *ModbusFlags, device *ModbusDeviceFlags) (*modbus.ModbusClient, error) {
+	config := &modbus.ModbusConfiguration{
+		Mode:       modbusConfig.mode,
+		Hostname:   device.hostname,
+		Port:       device.port,
+		SlaveId:    device.slaveId,
+		Alias:      device.alias,
+		ReplayFile: modbusConfig.replayFile,
+	}
+	switch modbusConfig.mode {
+	case modbus.MODE_TCP:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(device.hostname, strconv.Itoa(device.port)), CONNECT_TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		conn.Close()
+	case modbus.MODE_RTU:
+		if _, err := os.Stat(device.hostname); err != nil {
+			return nil, err
+		}
+		config.SerialDevice = device.hostname
+		config.BaudRate = modbusConfig.serial.baudRate
+		config.DataBits = modbusConfig.serial.dataBits
+		config.Parity = modbusConfig.serial.parity
+		config.StopBits = modbusConfig.serial.stopBits
+	}
+	return modbus.NewPoller(config), nil
+}
+
+// Registers read by 'dump': raw bytes & decoded values by register name, and unmapped registers in range mode.
+type registerDump struct {
+	client *modbus.ModbusClient
+	raw    map[string][]byte
+	values modbus.ModbusRegisters
+	rows   []dumpRow
+}
+
+type dumpRow struct {
+	address uint16
+	name    string // empty for registers outside the register map
+	raw     []byte
+}
+
+// Read all registers of the register map, block by block as when polling.
+func (dump *registerDump) readModels() error {
+	failed := 0
+	for _, block := range dump.client.Blocks {
+		bytes, err := modbus.ReadRange(dump.client, block.Address, block.Quantity)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+			continue
+		}
+		for _, key := range block.Keys {
+			element := dump.client.Registers[key]
+			offset := int(element.Address-block.Address) * 2
+			dump.add(key, bytes[offset:offset+int(modbus.RegisterCount(element))*2])
+		}
+	}
+	if failed == len(dump.client.Blocks) {
+		return fmt.Errorf("no registers read")
+	}
+	return nil
+}
+
+// Read a register range, decoding the known registers it contains & reading their scale factors if outside the range.
+func (dump *registerDump) readRange(address uint16, count int) error {
+	starts := map[uint16]string{}
+	for key, element := range dump.client.Registers {
+		if other, found := starts[element.Address]; !found || key < other {
+			starts[element.Address] = key
+		}
+	}
+	if count == 0 {
+		count = 1
+		if key, found := starts[address]; found {
+			count = int(modbus.RegisterCount(dump.client.Registers[key]))
+		}
+	}
+
+	bytes, err := modbus.ReadRange(dump.client, address, uint16(count))
+	if err != nil {
+		return err
+	}
+
+	end := uint32(address) + uint32(count)
+	for current := uint32(address); current < end; {
+		offset := int(current-uint32(address)) * 2
+		key, found := starts[uint16(current)]
+		if found {
+			size := uint32(modbus.RegisterCount(dump.client.Registers[key]))
+			if current+size <= end {
+				dump.add(key, bytes[offset:offset+int(size)*2])
+				current += size
+				continue
+			}
+		}
+		dump.rows = append(dump.rows, dumpRow{address: uint16(current), raw: bytes[offset : offset+2]})
+		current++
+	}
+
+	// Scale factors of the values read, outside of the range.
+	for key := range dump.raw {
+		sfKey := mapping.ScaleFactorKey(key)
+		sf, found := dump.client.Registers[sfKey]
+		if _, read := dump.values[sfKey]; !found || read {
+			continue
+		}
+		bytes, err := modbus.ReadRange(dump.client, sf.Address, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Scale factor '%s': %v\n", sfKey, err)
+			continue
+		}
+		value, _ := modbus.DecodeRegister(sf, bytes)
+		if sunspec.IsNotImplemented(sf.Type, value) {
+			value = nil
+		}
+		dump.values[sfKey] = value
+	}
+	return nil
+}
+
+// Add a register of the register map, decoded as when polling.
+func (dump *registerDump) add(key string, bytes []byte) {
+	element := dump.client.Registers[key]
+	dump.raw[key] = bytes
+	dump.rows = append(dump.rows, dumpRow{address: element.Address, name: key, raw: bytes})
+
+	value, ok := modbus.DecodeRegister(element, bytes)
+	if ok && sunspec.IsNotImplemented(element.Type, value) {
+		value = nil
+	}
+	dump.values[key] = value
+}
+
+func (dump *registerDump) print() {
+	parsed, err := mapping.ParseValues(&dump.values, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	sort.SliceStable(dump.rows, func(i, j int) bool {
+		return dump.rows[i].address < dump.rows[j].address
+	})
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ADDRESS\tREGISTER\tTYPE\tRAW\tDECODED\tSF\tSCALED")
+	for _, row := range dump.rows {
+		words := []string{}
+		for i := 0; i+1 < len(row.raw); i += 2 {
+			words = append(words, fmt.Sprintf("%02X%02X", row.raw[i], row.raw[i+1]))
+		}
+		if row.name == "" {
+			fmt.Fprintf(table, "%d\t\t\t%s\t\t\t\n", row.address, strings.Join(words, " "))
+			continue
+		}
+
+		element := dump.client.Registers[row.name]
+		decoded, _ := modbus.DecodeRegister(element, row.raw)
+		scaleFactor, scaledValue := dump.scaled(row.name, parsed.Scaled)
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", row.address, row.name, sunspec.TypeName(element.Type), strings.Join(words, " "), formatDecoded(decoded), scaleFactor, scaledValue)
+	}
+	table.Flush()
+}
+
+// Scale factor and scaled value of a register, as printed.
+func (dump *registerDump) scaled(key string, scaled map[string]interface{}) (string, string) {
+	if strings.HasSuffix(key, "_SF") {
+		return "", ""
+	}
+	if dump.values[key] == nil {
+		return "", "not implemented"
+	}
+
+	sfKey := mapping.ScaleFactorKey(key)
+	if _, mapped := dump.client.Registers[sfKey]; !mapped {
+		return "", formatDecoded(scaled[key])
+	}
+	sf, read := dump.values[sfKey]
+	switch {
+	case !read:
+		return "?", ""
+	case sf == nil:
+		return "n/a", "not implemented"
+	}
+	scaleFactor, _ := sf.(int16)
+	value, ok := scaled[key].(float64)
+	if !ok {
+		return strconv.Itoa(int(scaleFactor)), ""
+	}
+	return strconv.Itoa(int(scaleFactor)), strconv.FormatFloat(value, 'f', int(math.Max(0, float64(-scaleFactor))), 64)
+}
+
+func formatDecoded(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return strconv.Quote(value)
+	case float32:
+		return strconv.FormatFloat(float64(value), 'g', -1, 32)
+	}
+	return fmt.Sprint(value)
+}
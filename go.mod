@@ -3,9 +3,9 @@ module github.com/stefannilsson/solaredgedc
 go 1.16
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/eclipse/paho.mqtt.golang v1.3.4 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.3.4
 	github.com/goburrow/modbus v0.1.0
 	github.com/goburrow/serial v0.1.0 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-)
\ No newline at end of file
+	github.com/sirupsen/logrus v1.8.1
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -1,31 +1,90 @@
 package logger
 
 import (
+	"sync"
+
 	"github.com/sirupsen/logrus"
 )
 
-//TODO: Allow custom outputs to be provided as well as log level.
+// Log output formats
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+const TIMESTAMP_FORMAT = "2006-01-02T15:04:05.000-0700"
+
+type Config struct {
+	// Log level of all components, unless overridden per component.
+	Level logrus.Level
+
+	// Per-component log level overrides, e.g. {"modbus": logrus.ErrorLevel}
+	ComponentLevels map[string]logrus.Level
+
+	// FORMAT_TEXT (default) or FORMAT_JSON
+	Format string
+}
+
+// One logger per component, so that levels can be set per component.
+var loggers = map[string]*logrus.Logger{}
+var loggersLock sync.Mutex
+
+// Applies to loggers retrieved before Configure(...) is called (i.e. during package initialization).
+var config = Config{Level: logrus.InfoLevel, Format: FORMAT_TEXT}
+
+/*
+	Apply the log level(s) and format to all component loggers, both those already handed out and future ones.
+*/
+func Configure(newConfig Config) {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+
+	config = newConfig
+	for component, logger := range loggers {
+		apply(component, logger)
+	}
+}
+
 func GetLoggers(component string) (errorLogger *logrus.Entry, infoLogger *logrus.Entry, debugLogger *logrus.Entry) {
-	// TODO: Remove timestamp in case of standard logger and app is running with a TTY attached (i.e. not as a service)
-	logrus.SetFormatter(&logrus.TextFormatter{TimestampFormat: "2006-01-02T15:04:05.000-0700", FullTimestamp: true})
+	loggersLock.Lock()
+	logger, found := loggers[component]
+	if !found {
+		logger = logrus.New()
+		apply(component, logger)
+		loggers[component] = logger
+	}
+	loggersLock.Unlock()
 
-	err := logrus.WithFields(logrus.Fields{
+	err := logger.WithFields(logrus.Fields{
 		"component": component,
 		"loglevel":  "error",
 	})
-	err.Logger.SetLevel(logrus.ErrorLevel)
 
-	info := logrus.WithFields(logrus.Fields{
+	info := logger.WithFields(logrus.Fields{
 		"component": component,
 		"loglevel":  "info",
 	})
-	info.Logger.SetLevel(logrus.InfoLevel)
 
-	debug := logrus.WithFields(logrus.Fields{
+	debug := logger.WithFields(logrus.Fields{
 		"component": component,
 		"loglevel":  "debug",
 	})
-	debug.Logger.SetLevel(logrus.DebugLevel)
 
 	return err, info, debug
 }
+
+func apply(component string, logger *logrus.Logger) {
+	// TODO: Remove timestamp in case of standard logger and app is running with a TTY attached (i.e. not as a service)
+	switch config.Format {
+	case FORMAT_JSON:
+		logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: TIMESTAMP_FORMAT})
+	default:
+		logger.SetFormatter(&logrus.TextFormatter{TimestampFormat: TIMESTAMP_FORMAT, FullTimestamp: true})
+	}
+
+	if level, found := config.ComponentLevels[component]; found {
+		logger.SetLevel(level)
+	} else {
+		logger.SetLevel(config.Level)
+	}
+}
@@ -2,33 +2,59 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	MQTTClient "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sirupsen/logrus"
 	utilities "github.com/stefannilsson/solaredgedc/common"
 	mapping "github.com/stefannilsson/solaredgedc/datamapping"
+	models "github.com/stefannilsson/solaredgedc/datamodels"
 	logger "github.com/stefannilsson/solaredgedc/logger"
+	metrics "github.com/stefannilsson/solaredgedc/metrics"
 	modbus "github.com/stefannilsson/solaredgedc/poller"
 	mqtt "github.com/stefannilsson/solaredgedc/publisher"
 )
 
 const (
-	GRACEFUL_SHUTDOWN_TIMEOUT_MS = 2000 // ms to let modbus poller / mqtt publisher to gracefully disconnect.
-	DELAY_UNSUCCESSFUL_POLLS_MS  = 1000 // ms to be delayed between attempts if no successful modbus reads finished
+	GRACEFUL_SHUTDOWN_TIMEOUT_MS    = 2000  // ms to let modbus poller / mqtt publisher to gracefully disconnect.
+	DELAY_UNSUCCESSFUL_POLLS_MS     = 1000  // ms to be delayed between attempts if no successful modbus reads finished
+	MAX_DELAY_UNSUCCESSFUL_POLLS_MS = 60000 // upper bound of the (doubling) delay for devices failing repeatedly
 )
 
 var errorLog *logrus.Entry
 var infoLog *logrus.Entry
 
+// Subcommands, e.g. 'solaredgedc scan 192.168.0.0/24', running instead of the collector.
+var commands = map[string]func(args []string) int{
+	"control": RunControl,
+	"dump":    RunDump,
+	"scan":    RunScan,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	// Allow application to be profiled via app argument '-trace'
 	traceMode := flag.Bool("trace", false, "Trace application and write trace info to trace-*.out")
 	// Must be run before any Loggers get instansiated.
-	_, modbusConfig, mqttConfig := ParseArgumentsConfig()
-	//TODO: Make log level configurable via flags/env.
+	logConfig, modbusConfig, mqttConfig, outputConfig, err := ParseArgumentsConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Apply log level(s) & format to all components' loggers.
+	logger.Configure(LoggerConfig(logConfig))
 
 	// Enable tracing to file if we recieved the '-flag' argument.
 	if *traceMode {
@@ -39,70 +65,260 @@ func main() {
 	errorLog, infoLog, _ = logger.GetLoggers("main")
 	infoLog.Println("SolarEdge Data Collector started.")
 
-	// Initialize and try connect Modbus poller
-	modbusClient := modbus.NewPoller(&modbus.ModbusConfiguration{
-		Hostname: modbusConfig.hostname,
-		Port:     modbusConfig.port,
-		SlaveId:  modbusConfig.slaveId,
-	})
-
 	// Initialize and try connect MQTT publisher
-	mqttClient := mqtt.NewTelemetryMqtt(&mqtt.MqttConfig{
+	publisherConfig := &mqtt.MqttConfig{
 		URI:      mqttConfig.uri,
 		ClientId: mqttConfig.clientId,
 		Username: mqttConfig.username,
 		Password: mqttConfig.password,
 		Qos:      mqttConfig.qos,
 		Topic:    mqttConfig.topic,
-	})
+		TLS: mqtt.TLSConfig{
+			CAFile:             mqttConfig.tls.caFile,
+			CertFile:           mqttConfig.tls.certFile,
+			KeyFile:            mqttConfig.tls.keyFile,
+			ServerName:         mqttConfig.tls.serverName,
+			MinVersion:         mqttConfig.tls.minVersion,
+			InsecureSkipVerify: mqttConfig.tls.insecureSkipVerify,
+		},
+		AvailabilityTopic: mqttConfig.availabilityTopic,
+		StoreDirectory:    mqttConfig.store.directory,
+		StoreMaxMessages:  mqttConfig.store.maxMessages,
+		StoreMaxAge:       mqttConfig.store.maxAge,
+	}
+
+	// Every reading is fanned out to all configured outputs (sinks).
+	publishers := mqtt.NewRegistry()
+
+	// MQTT is optional when replaying a recording, readings are written to stdout instead.
+	var mqttClient MQTTClient.Client
+	if mqttConfig.uri != "" {
+		mqttClient = mqtt.NewTelemetryMqtt(publisherConfig)
+		publishers.Add("mqtt", mqtt.NewMqttPublisher(mqttClient, publisherConfig))
+	} else {
+		publishers.Add("stdout", mqtt.NewWriterPublisher(os.Stdout, mqttConfig.topic))
+	}
+
+	// Optional InfluxDB line protocol output
+	if outputConfig.influx.url != "" {
+		influxWriter, err := mqtt.NewInfluxWriter(&mqtt.InfluxConfig{
+			URL:    outputConfig.influx.url,
+			Org:    outputConfig.influx.org,
+			Bucket: outputConfig.influx.bucket,
+			Token:  outputConfig.influx.token,
+		})
+		if err != nil {
+			errorLog.Errorln(err.Error())
+			os.Exit(1)
+		}
+		publishers.Add("influx", influxWriter)
+	}
+
+	// Record all raw block reads, or replay a recording instead of polling devices.
+	if modbusConfig.recordFile != "" {
+		if err := modbus.StartRecording(modbusConfig.recordFile); err != nil {
+			errorLog.Errorln(err.Error())
+			os.Exit(1)
+		}
+	}
+	if modbusConfig.mode == modbus.MODE_REPLAY {
+		if _, err := modbus.LoadRecording(modbusConfig.replayFile); err != nil {
+			errorLog.Errorln(err.Error())
+			os.Exit(1)
+		}
+
+		// replayed as fast as possible, without dropping readings.
+		publishers.SetBlocking(true)
+	}
 
 	//
-	HandleSigInt(modbusClient, mqttClient)
+	HandleSigInt(publishers)
+
+	// Optional Prometheus endpoint
+	if outputConfig.metricsListen != "" {
+		metrics.Serve(outputConfig.metricsListen)
+	}
+
+	// Poll every device independently, so that one unreachable device does not stall the others.
+	var wg sync.WaitGroup
+	for _, device := range modbusConfig.devices {
+		wg.Add(1)
+		go func(device ModbusDeviceFlags) {
+			defer wg.Done()
+			PollDevice(device, modbusConfig, mqttConfig, outputConfig, mqttClient, publishers)
+		}(device)
+	}
+	wg.Wait()
+
+	// Only reached once a replayed recording has ended.
+	infoLog.Println("Recording replayed.")
+	modbus.CloseAll()
+	publishers.Close()
+}
+
+func PollDevice(device ModbusDeviceFlags, modbusConfig *ModbusFlags, mqttConfig *MqttFlags, outputConfig *OutputFlags, mqttClient MQTTClient.Client, publishers *mqtt.Registry) {
+	// Initialize and try connect Modbus poller
+	config := &modbus.ModbusConfiguration{
+		Mode:       modbusConfig.mode,
+		Hostname:   device.hostname,
+		Port:       device.port,
+		SlaveId:    device.slaveId,
+		Alias:      device.alias,
+		ReplayFile: modbusConfig.replayFile,
+	}
+
+	topic := mqtt.DeviceTopic(mqttConfig.topic, device.alias)
+
+	// Retained Modbus connectivity of the device, next to the collector's own availability.
+	modbusStatusTopic := fmt.Sprintf("%s/modbus", topic)
+	if mqttClient != nil {
+		config.OnStateChange = func(state modbus.ConnectionState) {
+			mqttClient.Publish(modbusStatusTopic, byte(mqttConfig.qos), true, state.String())
+		}
+		config.OnStateChange(modbus.STATE_DISCONNECTED)
+	}
+
+	if modbusConfig.mode == modbus.MODE_RTU {
+		config.SerialDevice = device.hostname
+		config.BaudRate = modbusConfig.serial.baudRate
+		config.DataBits = modbusConfig.serial.dataBits
+		config.Parity = modbusConfig.serial.parity
+		config.StopBits = modbusConfig.serial.stopBits
+	}
+	modbusClient := modbus.NewPoller(config)
+
+	// Accept power control commands on '{topic}/control/set'.
+	if modbusConfig.control.enabled && mqttClient != nil {
+		HandleControlCommands(modbusClient, topic, modbusConfig, mqttConfig, mqttClient)
+	}
+
+	// Number of polls in a row without any successfully read register, used to back off from dead devices.
+	failedPolls := 0
+
+	// Last published inverter reading, to detect status changes.
+	var previousRead *models.PVSolarReading
+
+	// Metrics exported for the latest reading, to remove those no longer present.
+	var exportedMetrics map[string]bool
+
+	// Serial number of the inverter the Home Assistant discovery configs were published for.
+	var discoveredSerial string
+	homeAssistantTopics := &mqtt.HomeAssistantTopics{
+		Prefix:            strings.TrimRight(mqttConfig.homeAssistantPrefix, "/"),
+		StateTopic:        topic,
+		AvailabilityTopic: mqttConfig.availabilityTopic,
+		ModbusStatusTopic: modbusStatusTopic,
+	}
 
 	// Let's keep on polling all Modbus registers - for ever and ever.
 	// MQTT Publisher maintains its own internal buffer if MQTT connection is temporarily down.
 	for {
+		pollStart := time.Now()
 		registerValues := modbus.PollRegisters(modbusClient)
+		metrics.Default.Observe("solaredgedc_poll_duration_seconds", "Duration of polling all registers of a device", metrics.Labels{"device": device.alias}, time.Since(pollStart).Seconds())
 		// TODO: Implement check and indicator from PollRegister(...) if total read time was more than X amount of ms. Could be an issue if some registers took a very long time to read.
 
-		// if no successfully register values read, let's sleep for a second and try again.
+		// a replayed recording ends with its last recorded poll.
+		if modbusClient.ReplayFinished() {
+			return
+		}
+
+		// if no successfully register values read, let's back off (1s, 2s, 4s, ...) and try again.
 		if len(*registerValues) == 0 {
-			time.Sleep(DELAY_UNSUCCESSFUL_POLLS_MS * time.Millisecond)
+			delay := DELAY_UNSUCCESSFUL_POLLS_MS << failedPolls
+			if delay >= MAX_DELAY_UNSUCCESSFUL_POLLS_MS {
+				delay = MAX_DELAY_UNSUCCESSFUL_POLLS_MS
+			} else {
+				failedPolls++
+			}
+			if modbusConfig.mode != modbus.MODE_REPLAY {
+				time.Sleep(time.Duration(delay) * time.Millisecond)
+			}
 			continue
 		}
+		failedPolls = 0
+
+		// typed inverter registers, and scaled values of all registers by name (see mapping.ParsedValues)
+		parsedValues, err := mapping.ParseValues(registerValues, modbusClient.PollTime)
+		if err != nil {
+			errorLog.WithField("device", device.alias).Errorln(err.Error())
+		}
 
-		// key/value map
-		// key : Modbus/SunSpec Register name
-		// value : Scaled (in case of a numeric data type). Possible data types: {int16, uint16, uint32, string}
-		// scaledValues := modbuspoller.ModbusRegistries{}
-		parsedValues := mapping.ParseValues(registerValues)
+		// Map successfully read registers to standard model.
+		pvRead := mapping.ToPVSolarReading(parsedValues)
 
-		// Populate JSON with successfully read registers mapped to standard model.
-		json := mapping.SerializeToJson(parsedValues)
+		// export the latest values for Prometheus to scrape.
+		if outputConfig.metricsListen != "" {
+			serial := ""
+			if pvRead.MeterId != nil {
+				serial = *pvRead.MeterId
+			}
+			exportedMetrics = metrics.Default.SetReadings(serial, device.alias, parsedValues.Scaled, exportedMetrics)
+		}
 
-		// publish JSON to MQTT broker...
+		// publish to all outputs, e.g. JSON to the MQTT broker...
 		// (if MQTT broker is currently down, we'll use Paho MQTT library's internal buffer to send messages once online again.)
-		mqttClient.Publish(mqttConfig.topic, byte(mqttConfig.qos), false, json)
+		publishers.Publish(mqtt.Reading{Kind: mqtt.KIND_INVERTER, Device: device.alias, Value: pvRead})
+
+		// publish Home Assistant discovery configs once the inverter's serial number is known (or has changed).
+		if mqttConfig.homeAssistant && mqttClient != nil && pvRead.MeterId != nil && *pvRead.MeterId != discoveredSerial {
+			if err := mqtt.PublishHomeAssistantDiscovery(mqttClient, byte(mqttConfig.qos), homeAssistantTopics, pvRead); err != nil {
+				errorLog.WithField("device", device.alias).Errorln(err.Error())
+			} else {
+				discoveredSerial = *pvRead.MeterId
+			}
+		}
+
+		// publish an event to '{topic}/event' whenever the inverter status changes.
+		if event := mapping.ToInverterStatusEvent(previousRead, pvRead); event != nil {
+			infoLog.WithField("device", device.alias).Printf("Inverter status changed to %s.", *event.StatusName)
+			publishers.Publish(mqtt.Reading{Kind: mqtt.KIND_EVENT, Device: device.alias, Value: event})
+		}
+		if pvRead.InverterStatus != nil {
+			previousRead = pvRead
+		}
+
+		// publish readings of any SunSpec meters connected to the inverter to '{topic}/meter/{n}'.
+		for _, meter := range mapping.MeterIndexes(parsedValues) {
+			meterRead, err := mapping.ToMeterReading(parsedValues, meter)
+			if err != nil {
+				errorLog.WithField("device", device.alias).Errorln(err.Error())
+			}
+			publishers.Publish(mqtt.Reading{Kind: mqtt.KIND_METER, Device: device.alias, Index: meter, Value: meterRead})
+		}
 
-		// and wait for some time before polling registers again.
-		time.Sleep(time.Duration(modbusConfig.pollInterval) * time.Millisecond)
+		// publish readings of any StorEdge batteries to '{topic}/battery/{n}'.
+		for _, battery := range mapping.BatteryIndexes(parsedValues) {
+			batteryRead, err := mapping.ToBatteryReading(parsedValues, battery)
+			if err != nil {
+				errorLog.WithField("device", device.alias).Errorln(err.Error())
+			}
+			publishers.Publish(mqtt.Reading{Kind: mqtt.KIND_BATTERY, Device: device.alias, Index: battery, Value: batteryRead})
+		}
+
+		// and wait for some time before polling registers again (a recording is replayed as fast as possible).
+		if modbusConfig.mode != modbus.MODE_REPLAY {
+			time.Sleep(time.Duration(modbusConfig.pollInterval) * time.Millisecond)
+		}
 	}
 }
 
-func HandleSigInt(modbusClient *modbus.ModbusClient, mqttClient MQTTClient.Client) {
-	// give modbus & mqtt client some time to gracefully disconnect in case of CTRL+C
+func HandleSigInt(publishers *mqtt.Registry) {
+	// give modbus & mqtt client some time to gracefully disconnect in case of CTRL+C or SIGTERM (e.g. docker stop)
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		// sig is a ^C, handle it
+		// sig is a ^C or SIGTERM, handle it
 		errorLog.Errorf("Shutting down... Exiting in %v ms.", GRACEFUL_SHUTDOWN_TIMEOUT_MS)
 
-		// Disconnect Modbus
-		modbusClient.TCPClientHandler.Close()
+		// Revert pending power control changes, disconnect Modbus, and complete any recording
+		modbus.RevertAll()
+		modbus.CloseAll()
+		modbus.StopRecording()
 
-		// Disconnect MQTT
-		mqttClient.Disconnect(500)
+		// Flush & close all outputs (disconnecting MQTT)
+		publishers.Close()
 
 		// Let's give clients some time to
 		time.Sleep(GRACEFUL_SHUTDOWN_TIMEOUT_MS * time.Millisecond)
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const NAMESPACE = "solaredge"
+
+// Registers of the SunSpec common block, exported as labels of the 'solaredge_info' metric.
+var infoRegisters = map[string]string{
+	"C_Manufacturer": "manufacturer",
+	"C_Model":        "model",
+	"C_Version":      "version",
+}
+
+// Exported as counter 'solaredge_ac_energy_wh_total', besides its gauge.
+const ENERGY_REGISTER = "I_AC_Energy_WH"
+
+var regexpInvalidName = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// Metric name of a register, e.g. 'I_AC_Power' => 'solaredge_i_ac_power', 'M1_M_AC_Power' => 'solaredge_m1_m_ac_power'.
+func RegisterMetricName(register string) string {
+	return fmt.Sprintf("%s_%s", NAMESPACE, strings.ToLower(regexpInvalidName.ReplaceAllString(register, "_")))
+}
+
+/*
+	Export the latest (scaled) values of a device, as produced by mapping.ParseValues(...).Scaled, labelled by
+	inverter serial and device alias. Numeric values become gauges, values no longer present (e.g. suppressed as
+	"not implemented") are removed so that stale values aren't scraped.
+*/
+func (registry *Registry) SetReadings(serial string, device string, values map[string]interface{}, previous map[string]bool) map[string]bool {
+	labels := Labels{"serial": serial, "device": device}
+	exported := map[string]bool{}
+
+	info := Labels{"serial": serial, "device": device}
+	for key, value := range values {
+		if label, found := infoRegisters[key]; found {
+			if s, ok := value.(string); ok {
+				info[label] = s
+			}
+			continue
+		}
+
+		number, ok := toFloat64(value)
+		if !ok {
+			continue
+		}
+
+		name := RegisterMetricName(key)
+		registry.SetGauge(name, fmt.Sprintf("SunSpec register %s (scaled)", key), labels, number)
+		exported[name] = true
+
+		if key == ENERGY_REGISTER {
+			registry.SetCounter(fmt.Sprintf("%s_ac_energy_wh_total", NAMESPACE), "Inverter lifetime AC energy production (Wh)", labels, number)
+		}
+	}
+	registry.SetGauge(fmt.Sprintf("%s_info", NAMESPACE), "Inverter identity (SunSpec common block)", info, 1)
+
+	for name := range previous {
+		if !exported[name] {
+			registry.Delete(name, labels)
+		}
+	}
+	return exported
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
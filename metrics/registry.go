@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prometheus metric types
+const (
+	TYPE_GAUGE   = "gauge"
+	TYPE_COUNTER = "counter"
+	TYPE_SUMMARY = "summary"
+)
+
+type Labels map[string]string
+
+type sample struct {
+	labels Labels
+	value  float64
+	count  uint64 // summaries only, 'value' holds the sum
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]*sample // keyed by serialized labels
+}
+
+/*
+	Minimal registry of metrics, rendered in the Prometheus text exposition format (version 0.0.4).
+	Metrics are created on first use, collectors are run before every scrape to refresh on-demand values.
+*/
+type Registry struct {
+	lock       sync.Mutex
+	families   map[string]*family
+	collectors []func(registry *Registry)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Registry of the collector, served by Serve(...)
+var Default = NewRegistry()
+
+func (registry *Registry) sample(name string, help string, kind string, labels Labels) *sample {
+	f, found := registry.families[name]
+	if !found {
+		f = &family{name: name, help: help, kind: kind, samples: map[string]*sample{}}
+		registry.families[name] = f
+	}
+
+	key := formatLabels(labels)
+	s, found := f.samples[key]
+	if !found {
+		s = &sample{labels: labels}
+		f.samples[key] = s
+	}
+	return s
+}
+
+func (registry *Registry) SetGauge(name string, help string, labels Labels, value float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.sample(name, help, TYPE_GAUGE, labels).value = value
+}
+
+func (registry *Registry) AddCounter(name string, help string, labels Labels, delta float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.sample(name, help, TYPE_COUNTER, labels).value += delta
+}
+
+// Set a counter maintained elsewhere, e.g. the inverter's lifetime energy.
+func (registry *Registry) SetCounter(name string, help string, labels Labels, value float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.sample(name, help, TYPE_COUNTER, labels).value = value
+}
+
+// Record an observation of a summary (sum & count only, no quantiles).
+func (registry *Registry) Observe(name string, help string, labels Labels, value float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	s := registry.sample(name, help, TYPE_SUMMARY, labels)
+	s.value += value
+	s.count++
+}
+
+// Remove all samples of a metric with the given labels, e.g. of a no longer present value.
+func (registry *Registry) Delete(name string, labels Labels) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if f, found := registry.families[name]; found {
+		delete(f.samples, formatLabels(labels))
+	}
+}
+
+// Run the collector before every scrape.
+func (registry *Registry) Collect(collector func(registry *Registry)) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.collectors = append(registry.collectors, collector)
+}
+
+// Render all metrics in the Prometheus text exposition format.
+func (registry *Registry) Write(w io.Writer) error {
+	registry.lock.Lock()
+	collectors := append([]func(registry *Registry){}, registry.collectors...)
+	registry.lock.Unlock()
+	for _, collector := range collectors {
+		collector(registry)
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	names := make([]string, 0, len(registry.families))
+	for name := range registry.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		f := registry.families[name]
+		if len(f.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(&out, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.samples))
+		for key := range f.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.samples[key]
+			switch f.kind {
+			case TYPE_SUMMARY:
+				fmt.Fprintf(&out, "%s_sum%s %s\n", f.name, key, formatValue(s.value))
+				fmt.Fprintf(&out, "%s_count%s %d\n", f.name, key, s.count)
+			default:
+				fmt.Fprintf(&out, "%s%s %s\n", f.name, key, formatValue(s.value))
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// '{name="value",...}' sorted by name, or "" without labels.
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
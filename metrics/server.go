@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/stefannilsson/solaredgedc/logger"
+)
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	if err := registry.Write(w); err != nil {
+		errorLog, _, _ := logger.GetLoggers("metrics")
+		errorLog.Errorf("Failed to write metrics: %v", err)
+	}
+}
+
+/*
+	Serve the default registry on 'http://{address}/metrics' in the background, e.g. address ':9100'.
+	The collector keeps running if the listener fails.
+*/
+func Serve(address string) {
+	errorLog, infoLog, _ := logger.GetLoggers("metrics")
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+
+	go func() {
+		infoLog.Printf("Serving Prometheus metrics on %s/metrics", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			errorLog.Errorf("Metrics listener on %s failed: %v", address, err)
+		}
+	}()
+}
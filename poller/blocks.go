@@ -0,0 +1,76 @@
+package modbus
+
+import (
+	"sort"
+
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+const (
+	MAX_REGISTERS_PER_READ = 125 // Modbus limit of holding registers per 'Read Holding Registers' request.
+	MAX_GAP_BETWEEN_FIELDS = 16  // Max number of unused registers to read past rather than issuing a separate request.
+)
+
+// A contiguous range of holding registers read in a single Modbus transaction.
+type RegisterBlock struct {
+	Address  uint16
+	Quantity uint16
+
+	// Register names (keys of the register map) decoded from this block.
+	Keys []string
+}
+
+// Number of 16-bit registers occupied by a field of the given data type.
+func RegisterCount(element sunspec.ModbusAddress) uint16 {
+	switch element.Type {
+	case sunspec.Dt_uint32, sunspec.Dt_acc32, sunspec.Dt_float32:
+		return 2
+	case sunspec.Dt_uint64:
+		return 4
+	case sunspec.Dt_string:
+		return element.Size
+	default:
+		return 1
+	}
+}
+
+/*
+	Coalesce the register map into as few block reads as possible.
+	Fields are sorted by address and merged into the current block as long as the gap to the
+	previous field is small and the block stays within the Modbus limit of 125 registers.
+*/
+func PlanBlocks(registers map[string]sunspec.ModbusAddress) []RegisterBlock {
+	keys := make([]string, 0, len(registers))
+	for key := range registers {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if registers[keys[i]].Address == registers[keys[j]].Address {
+			return keys[i] < keys[j]
+		}
+		return registers[keys[i]].Address < registers[keys[j]].Address
+	})
+
+	blocks := []RegisterBlock{}
+	for _, key := range keys {
+		element := registers[key]
+		start := uint32(element.Address)
+		end := start + uint32(RegisterCount(element)) // exclusive
+
+		if len(blocks) > 0 {
+			current := &blocks[len(blocks)-1]
+			currentEnd := uint32(current.Address) + uint32(current.Quantity)
+			if start <= currentEnd+MAX_GAP_BETWEEN_FIELDS && end-uint32(current.Address) <= MAX_REGISTERS_PER_READ {
+				if end > currentEnd {
+					current.Quantity = uint16(end - uint32(current.Address))
+				}
+				current.Keys = append(current.Keys, key)
+				continue
+			}
+		}
+
+		blocks = append(blocks, RegisterBlock{Address: element.Address, Quantity: uint16(end - start), Keys: []string{key}})
+	}
+
+	return blocks
+}
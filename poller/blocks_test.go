@@ -0,0 +1,133 @@
+package modbus
+
+import (
+	"reflect"
+	"testing"
+
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+func TestRegisterCount(t *testing.T) {
+	tests := []struct {
+		element sunspec.ModbusAddress
+		want    uint16
+	}{
+		{sunspec.ModbusAddress{Type: sunspec.Dt_uint16}, 1},
+		{sunspec.ModbusAddress{Type: sunspec.Dt_int16}, 1},
+		{sunspec.ModbusAddress{Type: sunspec.Dt_uint32}, 2},
+		{sunspec.ModbusAddress{Type: sunspec.Dt_acc32}, 2},
+		{sunspec.ModbusAddress{Type: sunspec.Dt_float32}, 2},
+		{sunspec.ModbusAddress{Type: sunspec.Dt_uint64}, 4},
+		{sunspec.ModbusAddress{Type: sunspec.Dt_string, Size: 16}, 16},
+	}
+	for _, test := range tests {
+		if got := RegisterCount(test.element); got != test.want {
+			t.Errorf("RegisterCount(%s) = %d, want %d", sunspec.TypeName(test.element.Type), got, test.want)
+		}
+	}
+}
+
+func TestPlanBlocks(t *testing.T) {
+	uint16At := func(address uint16) sunspec.ModbusAddress {
+		return sunspec.ModbusAddress{Address: address, Type: sunspec.Dt_uint16}
+	}
+	uint32At := func(address uint16) sunspec.ModbusAddress {
+		return sunspec.ModbusAddress{Address: address, Type: sunspec.Dt_uint32}
+	}
+
+	tests := []struct {
+		name      string
+		registers map[string]sunspec.ModbusAddress
+		want      []RegisterBlock
+	}{
+		{
+			name:      "empty",
+			registers: map[string]sunspec.ModbusAddress{},
+			want:      []RegisterBlock{},
+		},
+		{
+			name:      "contiguous fields in one block, sorted by address",
+			registers: map[string]sunspec.ModbusAddress{"c": uint16At(102), "a": uint16At(100), "b": uint32At(101)},
+			want:      []RegisterBlock{{Address: 100, Quantity: 3, Keys: []string{"a", "b", "c"}}},
+		},
+		{
+			name:      "fields at the same address sorted by name",
+			registers: map[string]sunspec.ModbusAddress{"b": uint16At(100), "a": uint32At(100)},
+			want:      []RegisterBlock{{Address: 100, Quantity: 2, Keys: []string{"a", "b"}}},
+		},
+		{
+			name:      "gap of MAX_GAP_BETWEEN_FIELDS read past",
+			registers: map[string]sunspec.ModbusAddress{"a": uint16At(100), "b": uint16At(101 + MAX_GAP_BETWEEN_FIELDS)},
+			want:      []RegisterBlock{{Address: 100, Quantity: 2 + MAX_GAP_BETWEEN_FIELDS, Keys: []string{"a", "b"}}},
+		},
+		{
+			name:      "larger gap split",
+			registers: map[string]sunspec.ModbusAddress{"a": uint16At(100), "b": uint16At(102 + MAX_GAP_BETWEEN_FIELDS)},
+			want: []RegisterBlock{
+				{Address: 100, Quantity: 1, Keys: []string{"a"}},
+				{Address: 102 + MAX_GAP_BETWEEN_FIELDS, Quantity: 1, Keys: []string{"b"}},
+			},
+		},
+		{
+			name: "block of exactly MAX_REGISTERS_PER_READ",
+			registers: map[string]sunspec.ModbusAddress{
+				"a": {Address: 100, Type: sunspec.Dt_string, Size: 110},
+				"b": uint16At(210),
+				"c": uint16At(224),
+			},
+			want: []RegisterBlock{{Address: 100, Quantity: MAX_REGISTERS_PER_READ, Keys: []string{"a", "b", "c"}}},
+		},
+		{
+			name: "multi-register field crossing MAX_REGISTERS_PER_READ starts a new block",
+			registers: map[string]sunspec.ModbusAddress{
+				"a": {Address: 100, Type: sunspec.Dt_string, Size: 110},
+				"b": uint32At(224),
+			},
+			want: []RegisterBlock{
+				{Address: 100, Quantity: 110, Keys: []string{"a"}},
+				{Address: 224, Quantity: 2, Keys: []string{"b"}},
+			},
+		},
+		{
+			name: "field within the current block doesn't shrink it",
+			registers: map[string]sunspec.ModbusAddress{
+				"a": {Address: 100, Type: sunspec.Dt_uint64},
+				"b": uint16At(101),
+			},
+			want: []RegisterBlock{{Address: 100, Quantity: 4, Keys: []string{"a", "b"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := PlanBlocks(test.registers)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("PlanBlocks() = %+v, want %+v", got, test.want)
+			}
+			for _, block := range got {
+				if block.Quantity > MAX_REGISTERS_PER_READ {
+					t.Errorf("block at %d reads %d registers, more than %d", block.Address, block.Quantity, MAX_REGISTERS_PER_READ)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanBlocksDefaultLayout(t *testing.T) {
+	registers := sunspec.BuildRegisters(sunspec.DefaultModels)
+	blocks := PlanBlocks(registers)
+
+	planned := map[string]bool{}
+	for _, block := range blocks {
+		for _, key := range block.Keys {
+			element := registers[key]
+			if element.Address < block.Address || element.Address+RegisterCount(element) > block.Address+block.Quantity {
+				t.Errorf("'%s' (%d) not within block %d+%d", key, element.Address, block.Address, block.Quantity)
+			}
+			planned[key] = true
+		}
+	}
+	if len(planned) != len(registers) {
+		t.Errorf("%d of %d registers planned", len(planned), len(registers))
+	}
+}
@@ -0,0 +1,142 @@
+package modbus
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	MODBUS "github.com/goburrow/modbus"
+)
+
+/*
+	A Modbus connection shared by all units (slave ids) behind the same host:port or serial device, e.g.
+	leader/follower inverters daisy-chained over RS485 behind one TCP gateway. SolarEdge only accepts a
+	single session, so requests of the different units are serialized over the one connection.
+*/
+type connection struct {
+	sync.Mutex
+	address string
+	handler transport
+	client  MODBUS.Client
+
+	// Address the unit (slave id) of the next requests.
+	setSlaveId func(slaveId byte)
+	unitId     byte // unit (slave id) currently addressed
+
+	// Connection state, number of failed (re)connects in a row and when to attempt the next reconnect.
+	state       ConnectionState
+	failures    int
+	nextAttempt time.Time
+	listeners   []func(state ConnectionState)
+
+	// Whether the connection was ever established, to count reconnects.
+	connected bool
+
+	// Time of the last block read, as recorded when replaying a recording.
+	readTime time.Time
+}
+
+// Common interface of the TCP and RTU client handlers.
+type transport interface {
+	Connect() error
+	Close() error
+}
+
+var connections = map[string]*connection{}
+var connectionsLock sync.Mutex
+
+// Get (or create & connect) the shared connection to host:port or the serial device.
+func getConnection(config *ModbusConfiguration) *connection {
+	var address string
+	mode := config.Mode
+	switch mode {
+	case MODE_RTU:
+		address = config.SerialDevice
+	case MODE_REPLAY:
+		address = fmt.Sprintf("%s:%d", config.Hostname, config.Port)
+	default:
+		mode = MODE_TCP
+		address = fmt.Sprintf("%s:%d", config.Hostname, config.Port)
+	}
+
+	connectionsLock.Lock()
+	conn, found := connections[address]
+	if !found {
+		conn = newConnection(address, config)
+		connections[address] = conn
+	}
+	connectionsLock.Unlock()
+
+	if found {
+		return conn
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+	for conn.connect() != nil {
+		errorLog.Errorf("Modbus %s connection to %s could not be established. Please check Modbus configuration.", strings.ToUpper(mode), address)
+		time.Sleep(time.Until(conn.nextAttempt))
+	}
+
+	return conn
+}
+
+func newConnection(address string, config *ModbusConfiguration) *connection {
+	conn := newTransport(address, config)
+
+	// Every block read is recorded while a recording is running (see StartRecording).
+	conn.client = &recordingClient{Client: conn.client, conn: conn}
+	return conn
+}
+
+func newTransport(address string, config *ModbusConfiguration) *connection {
+	switch config.Mode {
+	case MODE_REPLAY:
+		r, err := newReplay(config.ReplayFile, address)
+		if err != nil {
+			errorLog.Errorf("Failed to load recording: %v", err)
+			r = &replay{finished: true}
+		}
+		conn := &connection{
+			address:    address,
+			handler:    r,
+			client:     r,
+			setSlaveId: func(slaveId byte) {},
+		}
+		r.conn = conn
+		return conn
+	case MODE_RTU:
+		handler := MODBUS.NewRTUClientHandler(address)
+		handler.BaudRate = config.BaudRate
+		handler.DataBits = config.DataBits
+		handler.Parity = config.Parity
+		handler.StopBits = config.StopBits
+		handler.Timeout = SECONDS_BETWEEN_RECONNECTS * time.Second
+		return &connection{
+			address:    address,
+			handler:    handler,
+			client:     MODBUS.NewClient(handler),
+			setSlaveId: func(slaveId byte) { handler.SlaveId = slaveId },
+		}
+	default:
+		handler := MODBUS.NewTCPClientHandler(address)
+		handler.Timeout = SECONDS_BETWEEN_RECONNECTS * time.Second
+		return &connection{
+			address:    address,
+			handler:    handler,
+			client:     MODBUS.NewClient(handler),
+			setSlaveId: func(slaveId byte) { handler.SlaveId = slaveId },
+		}
+	}
+}
+
+// Close all Modbus connections.
+func CloseAll() {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+
+	for _, conn := range connections {
+		conn.handler.Close()
+	}
+}
@@ -0,0 +1,431 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	utilities "github.com/stefannilsson/solaredgedc/common"
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+const (
+	REVERT_RETRY_INTERVAL = 30 * time.Second // after a failed revert
+)
+
+// Advanced power control settings of an inverter, see sunspec.PowerControlRegisters.
+type PowerControlSettings struct {
+	AdvancedPowerControl bool
+	ActivePowerLimit     int // % of nominal active power
+	ReactivePowerConfig  int // sunspec.PC_REACTIVE_*
+}
+
+// Requested settings, nil fields are left unchanged.
+type PowerControlChange struct {
+	AdvancedPowerControl *bool
+	ActivePowerLimit     *int
+	ReactivePowerConfig  *int
+}
+
+// Current settings, and when they'll be reverted (zero if no revert is pending).
+type PowerControlState struct {
+	Settings PowerControlSettings
+	RevertAt time.Time
+}
+
+/*
+	Writes the SolarEdge advanced power control registers of a device, e.g. to limit the active power for zero-export
+	or negative prices. Every write is bounds checked and verified by reading it back.
+	The settings found before the first change are restored once the revert timeout of the latest change passes
+	(retried until successful), so a limit doesn't outlive whatever keeps refreshing it. A change without revert
+	timeout is kept as is.
+*/
+type PowerController struct {
+	client *ModbusClient
+
+	lock     sync.Mutex
+	original *PowerControlSettings // before the first change, nil if no revert is pending
+	timer    *time.Timer
+	revertAt time.Time
+
+	// Called after a timed revert or RevertAll (also for failed attempts), e.g. from the timer's goroutine.
+	OnRevert func(state *PowerControlState, err error)
+
+	// Wait before retrying a failed timed revert, REVERT_RETRY_INTERVAL by default.
+	RetryInterval time.Duration
+}
+
+// Controllers of all devices, reverted on shutdown.
+var controllers []*PowerController
+var controllersLock sync.Mutex
+
+func NewPowerController(client *ModbusClient) *PowerController {
+	controller := &PowerController{client: client, RetryInterval: REVERT_RETRY_INTERVAL}
+
+	controllersLock.Lock()
+	defer controllersLock.Unlock()
+	controllers = append(controllers, controller)
+	return controller
+}
+
+// Revert the pending changes of all controllers, e.g. on shutdown.
+func RevertAll() {
+	controllersLock.Lock()
+	defer controllersLock.Unlock()
+
+	for _, controller := range controllers {
+		controller.lock.Lock()
+		if controller.original == nil {
+			controller.lock.Unlock()
+			continue
+		}
+		state, err := controller.revert()
+		if err != nil {
+			controller.client.errorLog().Errorf("Failed to revert power control settings: %v", err)
+		}
+		onRevert := controller.OnRevert
+		controller.lock.Unlock()
+
+		if onRevert != nil {
+			onRevert(state, err)
+		}
+	}
+}
+
+// Check a change against the register bounds.
+func (change *PowerControlChange) Validate() error {
+	if change.ActivePowerLimit != nil && (*change.ActivePowerLimit < sunspec.PC_ACTIVE_POWER_LIMIT_MIN || *change.ActivePowerLimit > sunspec.PC_ACTIVE_POWER_LIMIT_MAX) {
+		return fmt.Errorf("invalid active power limit %d%%, expected %d-%d", *change.ActivePowerLimit, sunspec.PC_ACTIVE_POWER_LIMIT_MIN, sunspec.PC_ACTIVE_POWER_LIMIT_MAX)
+	}
+	if change.ReactivePowerConfig != nil && (*change.ReactivePowerConfig < 0 || *change.ReactivePowerConfig > sunspec.PC_REACTIVE_CONFIG_MAXIMUM) {
+		return fmt.Errorf("invalid reactive power config %d, expected 0-%d", *change.ReactivePowerConfig, sunspec.PC_REACTIVE_CONFIG_MAXIMUM)
+	}
+	if change.AdvancedPowerControl == nil && change.ActivePowerLimit == nil && change.ReactivePowerConfig == nil {
+		return fmt.Errorf("no power control settings to change")
+	}
+	return nil
+}
+
+// Read the current settings.
+func (controller *PowerController) Read() (*PowerControlState, error) {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+
+	settings, err := controller.transaction(func() (*PowerControlSettings, error) {
+		return controller.read()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return controller.state(settings), nil
+}
+
+/*
+	Apply a change, to be reverted after the given timeout (0 keeps the settings, dropping any pending revert once
+	applied). Settings already set aren't written again, only the revert timeout is rearmed.
+*/
+func (controller *PowerController) Apply(change PowerControlChange, revertAfter time.Duration) (*PowerControlState, error) {
+	if err := change.Validate(); err != nil {
+		return nil, err
+	}
+
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+
+	settings, err := controller.transaction(func() (*PowerControlSettings, error) {
+		current, err := controller.read()
+		if err != nil {
+			return nil, err
+		}
+		if controller.original == nil && revertAfter > 0 {
+			original := *current
+			controller.original = &original
+		}
+
+		target := *current
+		if change.AdvancedPowerControl != nil {
+			target.AdvancedPowerControl = *change.AdvancedPowerControl
+		}
+		if change.ActivePowerLimit != nil {
+			target.ActivePowerLimit = *change.ActivePowerLimit
+		}
+		if change.ReactivePowerConfig != nil {
+			target.ReactivePowerConfig = *change.ReactivePowerConfig
+		}
+		return controller.write(current, &target)
+	})
+
+	// Arm the revert even after a failed write, as some registers may have been written already. Likewise, a change
+	// to be kept only drops the pending revert once written successfully.
+	if revertAfter > 0 && controller.original != nil {
+		controller.schedule(revertAfter)
+	} else if revertAfter == 0 && err == nil {
+		controller.original = nil
+		controller.cancel()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := controller.state(settings)
+	controller.client.infoLog().Printf("Power control settings applied: %s.", state)
+	return state, nil
+}
+
+// Restore the settings found before the first change now, if a revert is pending.
+func (controller *PowerController) Revert() (*PowerControlState, error) {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	return controller.revert()
+}
+
+/*
+	Restore the inverter's power control default settings (dropping any pending revert), e.g. after a controller
+	elsewhere left the inverter limited.
+*/
+func (controller *PowerController) RestoreDefaults() (*PowerControlState, error) {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+
+	settings, err := controller.transaction(func() (*PowerControlSettings, error) {
+		if err := controller.writeUint16(sunspec.PC_RESTORE_DEFAULTS_ADDRESS, 1); err != nil {
+			return nil, fmt.Errorf("restore defaults: %w", err)
+		}
+		if err := controller.commit(); err != nil {
+			return nil, err
+		}
+		return controller.read()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	controller.original = nil
+	controller.cancel()
+	state := controller.state(settings)
+	controller.client.infoLog().Printf("Power control default settings restored: %s.", state)
+	return state, nil
+}
+
+func (controller *PowerController) revert() (*PowerControlState, error) {
+	if controller.original == nil {
+		settings, err := controller.transaction(func() (*PowerControlSettings, error) {
+			return controller.read()
+		})
+		if err != nil {
+			return nil, err
+		}
+		return controller.state(settings), nil
+	}
+
+	original := controller.original
+	settings, err := controller.transaction(func() (*PowerControlSettings, error) {
+		current, err := controller.read()
+		if err != nil {
+			return nil, err
+		}
+		return controller.write(current, original)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	controller.original = nil
+	controller.cancel()
+	state := controller.state(settings)
+	controller.client.infoLog().Printf("Power control settings reverted: %s.", state)
+	return state, nil
+}
+
+// (Re)arm the revert timer.
+func (controller *PowerController) schedule(after time.Duration) {
+	controller.cancel()
+	controller.revertAt = time.Now().Add(after)
+	controller.timer = time.AfterFunc(after, controller.onTimeout)
+}
+
+func (controller *PowerController) cancel() {
+	if controller.timer != nil {
+		controller.timer.Stop()
+		controller.timer = nil
+	}
+	controller.revertAt = time.Time{}
+}
+
+func (controller *PowerController) onTimeout() {
+	controller.lock.Lock()
+	state, err := controller.revert()
+	if err != nil {
+		controller.client.errorLog().Errorf("Failed to revert power control settings, retrying in %v: %v", controller.RetryInterval, err)
+		controller.schedule(controller.RetryInterval)
+	}
+	onRevert := controller.OnRevert
+	controller.lock.Unlock()
+
+	if onRevert != nil {
+		onRevert(state, err)
+	}
+}
+
+// Current state (with the given settings, if read).
+func (controller *PowerController) state(settings *PowerControlSettings) *PowerControlState {
+	state := &PowerControlState{RevertAt: controller.revertAt}
+	if settings != nil {
+		state.Settings = *settings
+	}
+	return state
+}
+
+func (state *PowerControlState) String() string {
+	description := fmt.Sprintf("advanced power control %t, active power limit %d%%, reactive power config %d", state.Settings.AdvancedPowerControl, state.Settings.ActivePowerLimit, state.Settings.ReactivePowerConfig)
+	if !state.RevertAt.IsZero() {
+		description += fmt.Sprintf(", reverting at %s", state.RevertAt.Format(time.RFC3339))
+	}
+	return description
+}
+
+// A write answered by the device but not taking effect (read back differing, commit failing), i.e. no transport error.
+type verifyError struct {
+	message string
+}
+
+func (err *verifyError) Error() string {
+	return err.message
+}
+
+// Run Modbus transactions with exclusive use of the (connected) connection.
+func (controller *PowerController) transaction(run func() (*PowerControlSettings, error)) (*PowerControlSettings, error) {
+	client := controller.client
+	client.lock()
+	defer client.unlock()
+
+	if !client.conn.ensureConnected() {
+		return nil, errConnectionDown
+	}
+	settings, err := run()
+	var verifyErr *verifyError
+	if isTransportError(err) && !errors.As(err, &verifyErr) {
+		client.conn.disconnect(err)
+	}
+	return settings, err
+}
+
+// Read the settings, caller must hold the connection lock.
+func (controller *PowerController) read() (*PowerControlSettings, error) {
+	values := map[string]uint32{}
+	for key, element := range sunspec.PowerControlRegisters {
+		value, err := controller.readRegister(element)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", key, err)
+		}
+		values[key] = value
+	}
+
+	return &PowerControlSettings{
+		AdvancedPowerControl: values["PC_AdvancedPowerControlEn"] == 1,
+		ActivePowerLimit:     int(values["PC_ActivePowerLimit"]),
+		ReactivePowerConfig:  int(values["PC_ReactivePowerConfig"]),
+	}, nil
+}
+
+// Write the settings differing from the current ones (committing them if needed), caller must hold the connection lock.
+func (controller *PowerController) write(current *PowerControlSettings, target *PowerControlSettings) (*PowerControlSettings, error) {
+	changes := map[string]uint32{}
+	if target.AdvancedPowerControl != current.AdvancedPowerControl {
+		changes["PC_AdvancedPowerControlEn"] = 0
+		if target.AdvancedPowerControl {
+			changes["PC_AdvancedPowerControlEn"] = 1
+		}
+	}
+	if target.ActivePowerLimit != current.ActivePowerLimit {
+		changes["PC_ActivePowerLimit"] = uint32(target.ActivePowerLimit)
+	}
+	if target.ReactivePowerConfig != current.ReactivePowerConfig {
+		changes["PC_ReactivePowerConfig"] = uint32(target.ReactivePowerConfig)
+	}
+
+	// Enable advanced power control first, as the active power limit depends on it.
+	commit := false
+	for _, key := range []string{"PC_AdvancedPowerControlEn", "PC_ReactivePowerConfig", "PC_ActivePowerLimit"} {
+		value, changed := changes[key]
+		if !changed {
+			continue
+		}
+		if err := controller.writeRegister(sunspec.PowerControlRegisters[key], value); err != nil {
+			return nil, fmt.Errorf("write %s: %w", key, err)
+		}
+		controller.client.debugLog().Debugf("Power control register %s set to %d.", key, value)
+		commit = commit || sunspec.PowerControlRequiresCommit(key)
+	}
+	if commit {
+		if err := controller.commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	settings := *target
+	return &settings, nil
+}
+
+// Commit the written settings, the commit register reads back 0 once committed.
+func (controller *PowerController) commit() error {
+	if err := controller.writeUint16(sunspec.PC_COMMIT_ADDRESS, 1); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	result, err := controller.client.Handler.ReadHoldingRegisters(sunspec.PC_COMMIT_ADDRESS, 1)
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	if code := utilities.BytesToUInt16(result); code != 0 {
+		return &verifyError{fmt.Sprintf("commit failed with error code %d", code)}
+	}
+	return nil
+}
+
+// Write a register and verify it by reading it back.
+func (controller *PowerController) writeRegister(element sunspec.ModbusAddress, value uint32) error {
+	count := RegisterCount(element)
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, value)
+	bytes = bytes[4-count*2:]
+	if element.WordSwap {
+		bytes = utilities.SwapWords(bytes)
+	}
+
+	if _, err := controller.client.Handler.WriteMultipleRegisters(element.Address, count, bytes); err != nil {
+		return err
+	}
+	readBack, err := controller.readRegister(element)
+	if err != nil {
+		return fmt.Errorf("read back: %w", err)
+	}
+	if readBack != value {
+		return &verifyError{fmt.Sprintf("read back %d, expected %d", readBack, value)}
+	}
+	return nil
+}
+
+func (controller *PowerController) writeUint16(address uint16, value uint16) error {
+	_, err := controller.client.Handler.WriteSingleRegister(address, value)
+	return err
+}
+
+func (controller *PowerController) readRegister(element sunspec.ModbusAddress) (uint32, error) {
+	result, err := controller.client.Handler.ReadHoldingRegisters(element.Address, RegisterCount(element))
+	if err != nil {
+		return 0, err
+	}
+	if len(result) != int(RegisterCount(element))*2 {
+		return 0, fmt.Errorf("short read (%d bytes)", len(result))
+	}
+	value, _ := DecodeRegister(element, result)
+	switch value := value.(type) {
+	case uint16:
+		return uint32(value), nil
+	case uint32:
+		return value, nil
+	}
+	return 0, fmt.Errorf("unsupported register type %s", sunspec.TypeName(element.Type))
+}
@@ -0,0 +1,267 @@
+package modbus_test
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	MODBUS "github.com/goburrow/modbus"
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+	"github.com/stefannilsson/solaredgedc/simulator"
+)
+
+// Power control defaults of the simulator, see simulator.powerControlDefaults.
+var defaultSettings = modbus.PowerControlSettings{AdvancedPowerControl: false, ActivePowerLimit: 100, ReactivePowerConfig: sunspec.PC_REACTIVE_FIXED_COSPHI}
+
+func startController(t *testing.T, config simulator.Config) (*simulator.Simulator, *modbus.PowerController, *modbus.ModbusClient) {
+	t.Helper()
+	config.Listen = "127.0.0.1:0"
+	sim, err := simulator.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Close() })
+
+	host, port, _ := net.SplitHostPort(sim.Addr())
+	portNumber, _ := strconv.Atoi(port)
+	client := modbus.NewPoller(&modbus.ModbusConfiguration{Mode: modbus.MODE_TCP, Hostname: host, Port: portNumber, SlaveId: simulator.DEFAULT_UNIT_ID, Alias: t.Name()})
+	return sim, modbus.NewPowerController(client), client
+}
+
+// Settings as read from the simulator.
+func readSettings(t *testing.T, controller *modbus.PowerController) modbus.PowerControlSettings {
+	t.Helper()
+	state, err := controller.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.Settings
+}
+
+func intValue(value int) *int {
+	return &value
+}
+
+func boolValue(value bool) *bool {
+	return &value
+}
+
+func TestPowerControlBounds(t *testing.T) {
+	_, controller, _ := startController(t, simulator.Config{})
+
+	tests := []struct {
+		name   string
+		change modbus.PowerControlChange
+		err    string
+	}{
+		{"limit above 100%", modbus.PowerControlChange{ActivePowerLimit: intValue(101)}, "invalid active power limit 101%"},
+		{"negative limit", modbus.PowerControlChange{ActivePowerLimit: intValue(-1)}, "invalid active power limit -1%"},
+		{"unknown reactive power config", modbus.PowerControlChange{ReactivePowerConfig: intValue(sunspec.PC_REACTIVE_CONFIG_MAXIMUM + 1)}, "invalid reactive power config 5"},
+		{"valid and invalid", modbus.PowerControlChange{AdvancedPowerControl: boolValue(true), ActivePowerLimit: intValue(150)}, "invalid active power limit 150%"},
+		{"nothing to change", modbus.PowerControlChange{}, "no power control settings to change"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state, err := controller.Apply(test.change, time.Hour)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Apply() = %v, %v, want error %q", state, err, test.err)
+			}
+		})
+	}
+
+	// Rejected before writing anything, and without arming a revert.
+	state, err := controller.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Settings != defaultSettings || !state.RevertAt.IsZero() {
+		t.Errorf("state %s after rejected changes, want the defaults without revert", state)
+	}
+}
+
+func TestPowerControlApplyAndRevert(t *testing.T) {
+	_, controller, _ := startController(t, simulator.Config{})
+	reverted := make(chan error, 1)
+	controller.OnRevert = func(state *modbus.PowerControlState, err error) {
+		if err == nil && (state.Settings != defaultSettings || !state.RevertAt.IsZero()) {
+			err = errors.New("reverted to " + state.String())
+		}
+		reverted <- err
+	}
+
+	change := modbus.PowerControlChange{AdvancedPowerControl: boolValue(true), ActivePowerLimit: intValue(40), ReactivePowerConfig: intValue(sunspec.PC_REACTIVE_FIXED_Q)}
+	state, err := controller.Apply(change, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := modbus.PowerControlSettings{AdvancedPowerControl: true, ActivePowerLimit: 40, ReactivePowerConfig: sunspec.PC_REACTIVE_FIXED_Q}
+	if state.Settings != want || state.RevertAt.IsZero() {
+		t.Errorf("applied %s, want %+v with a revert pending", state, want)
+	}
+	if settings := readSettings(t, controller); settings != want {
+		t.Errorf("read %+v, want %+v", settings, want)
+	}
+
+	select {
+	case err := <-reverted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reverted")
+	}
+	if settings := readSettings(t, controller); settings != defaultSettings {
+		t.Errorf("read %+v after the revert, want %+v", settings, defaultSettings)
+	}
+}
+
+func TestPowerControlReadBackMismatch(t *testing.T) {
+	sim, controller, client := startController(t, simulator.Config{IgnoreWrites: true})
+
+	_, err := controller.Apply(modbus.PowerControlChange{ActivePowerLimit: intValue(40)}, 0)
+	if err == nil || !strings.Contains(err.Error(), "write PC_ActivePowerLimit: read back 100, expected 40") {
+		t.Errorf("error %v, want a read back mismatch", err)
+	}
+	if client.State() != modbus.STATE_CONNECTED {
+		t.Errorf("connection %s after a read back mismatch, want connected", client.State())
+	}
+
+	sim.SetPowerControlFaults(false, 0)
+	if _, err := controller.Apply(modbus.PowerControlChange{ActivePowerLimit: intValue(40)}, 0); err != nil {
+		t.Errorf("error %v once writes are applied again", err)
+	}
+}
+
+func TestPowerControlCommitFailure(t *testing.T) {
+	_, controller, client := startController(t, simulator.Config{CommitError: 3})
+
+	// The active power limit is applied right away, the reactive power config requires a commit.
+	if _, err := controller.Apply(modbus.PowerControlChange{ActivePowerLimit: intValue(40)}, 0); err != nil {
+		t.Errorf("error %v without commit", err)
+	}
+	_, err := controller.Apply(modbus.PowerControlChange{ReactivePowerConfig: intValue(sunspec.PC_REACTIVE_FIXED_Q)}, 0)
+	if err == nil || err.Error() != "commit failed with error code 3" {
+		t.Errorf("error %v, want commit error code 3", err)
+	}
+	if _, err := controller.RestoreDefaults(); err == nil || err.Error() != "commit failed with error code 3" {
+		t.Errorf("restore defaults error %v, want commit error code 3", err)
+	}
+	if client.State() != modbus.STATE_CONNECTED {
+		t.Errorf("connection %s after failed commits, want connected", client.State())
+	}
+}
+
+func TestPowerControlRevertRetry(t *testing.T) {
+	sim, controller, _ := startController(t, simulator.Config{})
+	controller.RetryInterval = 100 * time.Millisecond
+	type revert struct {
+		state *modbus.PowerControlState
+		err   error
+	}
+	reverts := make(chan revert, 10)
+	controller.OnRevert = func(state *modbus.PowerControlState, err error) {
+		reverts <- revert{state, err}
+	}
+
+	if _, err := controller.Apply(modbus.PowerControlChange{ActivePowerLimit: intValue(40)}, 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	sim.SetPowerControlFaults(true, 0)
+
+	// Retried after failing, with the revert still pending in the meantime.
+	failed := <-reverts
+	if failed.err == nil || !strings.Contains(failed.err.Error(), "read back") {
+		t.Fatalf("revert error %v, want a read back mismatch", failed.err)
+	}
+	state, err := controller.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Settings.ActivePowerLimit != 40 || state.RevertAt.IsZero() {
+		t.Errorf("state %s after a failed revert, want the limit with a revert pending", state)
+	}
+
+	sim.SetPowerControlFaults(false, 0)
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case result := <-reverts:
+			if result.err != nil {
+				continue
+			}
+			if result.state.Settings != defaultSettings || !result.state.RevertAt.IsZero() {
+				t.Errorf("reverted to %s, want %+v", result.state, defaultSettings)
+			}
+			return
+		case <-deadline:
+			t.Fatal("revert not retried")
+		}
+	}
+}
+
+func TestPowerControlKeepAfterFailure(t *testing.T) {
+	sim, controller, _ := startController(t, simulator.Config{})
+
+	if _, err := controller.Apply(modbus.PowerControlChange{ActivePowerLimit: intValue(40)}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change to be kept failing leaves the pending revert of the earlier change in place.
+	sim.SetPowerControlFaults(true, 0)
+	if _, err := controller.Apply(modbus.PowerControlChange{ActivePowerLimit: intValue(20)}, 0); err == nil {
+		t.Fatal("no error with writes ignored")
+	}
+	sim.SetPowerControlFaults(false, 0)
+	state, err := controller.Revert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Settings != defaultSettings || !state.RevertAt.IsZero() {
+		t.Errorf("reverted to %s, want %+v", state, defaultSettings)
+	}
+
+	// Once kept, there's nothing to revert.
+	if _, err := controller.Apply(modbus.PowerControlChange{ActivePowerLimit: intValue(40)}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := controller.Apply(modbus.PowerControlChange{ActivePowerLimit: intValue(20)}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := controller.Revert(); err != nil || state.Settings.ActivePowerLimit != 20 || !state.RevertAt.IsZero() {
+		t.Errorf("revert of a kept change %v, %v, want the limit kept", state, err)
+	}
+}
+
+// The simulator rejects values beyond the register bounds, in case they're written without validation.
+func TestPowerControlSimulatorBounds(t *testing.T) {
+	sim, err := simulator.New(simulator.Config{Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	handler := MODBUS.NewTCPClientHandler(sim.Addr())
+	handler.SlaveId = simulator.DEFAULT_UNIT_ID
+	defer handler.Close()
+	client := MODBUS.NewClient(handler)
+
+	var modbusError *MODBUS.ModbusError
+	_, err = client.WriteSingleRegister(sunspec.PowerControlRegisters["PC_ActivePowerLimit"].Address, 101)
+	if !errors.As(err, &modbusError) || modbusError.ExceptionCode != MODBUS.ExceptionCodeIllegalDataValue {
+		t.Errorf("error %v, want an illegal data value exception", err)
+	}
+	_, err = client.WriteSingleRegister(40000, 1)
+	if !errors.As(err, &modbusError) || modbusError.ExceptionCode != MODBUS.ExceptionCodeIllegalDataAddress {
+		t.Errorf("error %v writing a read-only register, want an illegal data address exception", err)
+	}
+}
@@ -0,0 +1,102 @@
+package modbus
+
+import (
+	"fmt"
+	"strings"
+
+	utilities "github.com/stefannilsson/solaredgedc/common"
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+const (
+	MAX_SUNSPEC_MODELS = 64 // Upper bound of models to walk, guards against a corrupt model chain.
+)
+
+// Base addresses probed for the "SunS" marker, in order.
+var SunSpecBaseAddresses = []uint16{sunspec.DEFAULT_BASE_ADDRESS, 0, 50000}
+
+/*
+	Locate the SunSpec map and walk its model chain (ID + Length) until the end marker (0xFFFF).
+	Returns all models found, including models we have no definition for.
+*/
+func DiscoverModels(client *ModbusClient) ([]sunspec.DiscoveredModel, error) {
+	base, err := findBaseAddress(client)
+	if err != nil {
+		return nil, err
+	}
+
+	models := []sunspec.DiscoveredModel{}
+	address := uint32(base) + 2
+
+	for i := 0; i < MAX_SUNSPEC_MODELS; i++ {
+		if address+2 > 0xFFFF {
+			return models, fmt.Errorf("SunSpec model chain exceeds address space at %d", address)
+		}
+
+		header, err := client.Handler.ReadHoldingRegisters(uint16(address), 2)
+		if err != nil {
+			return models, fmt.Errorf("failed to read SunSpec model header at %d: %w", address, err)
+		}
+
+		id := utilities.BytesToUInt16(header[0:2])
+		if id == sunspec.SUNSPEC_END_MODEL_ID {
+			return models, nil
+		}
+		length := utilities.BytesToUInt16(header[2:4])
+
+		models = append(models, sunspec.DiscoveredModel{Id: id, Address: uint16(address), Length: length})
+		if _, known := sunspec.Models[id]; known {
+			client.infoLog().Printf("Found SunSpec model %d at %d (length %d).", id, address, length)
+		} else {
+			client.debugLog().Debugf("Skipping unknown SunSpec model %d at %d (length %d).", id, address, length)
+		}
+
+		address += 2 + uint32(length)
+	}
+
+	return models, fmt.Errorf("SunSpec model chain longer than %d models", MAX_SUNSPEC_MODELS)
+}
+
+// Probe the known base addresses for the "SunS" marker.
+func findBaseAddress(client *ModbusClient) (uint16, error) {
+	for _, base := range SunSpecBaseAddresses {
+		result, err := client.Handler.ReadHoldingRegisters(base, 2)
+		if err != nil {
+			continue
+		}
+		if utilities.BytesToUint32(result) == sunspec.SUNSPEC_ID {
+			client.infoLog().Printf("SunSpec map found at base address %d.", base)
+			return base, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no SunSpec marker found at any of %v", SunSpecBaseAddresses)
+}
+
+/*
+	Probe the StorEdge battery blocks (0xE100, 0xE200).
+	A battery is considered connected if its manufacturer name can be read and is set.
+*/
+func DetectBatteries(client *ModbusClient) []int {
+	batteries := []int{}
+
+	for battery := 1; battery <= sunspec.MAX_BATTERIES; battery++ {
+		element := sunspec.BatteryModel["B_Manufacturer"]
+		result, err := client.Handler.ReadHoldingRegisters(sunspec.BatteryAddress(battery)+element.Offset, element.Size)
+		if err != nil {
+			client.debugLog().Debugf("No StorEdge battery %d found: %v", battery, err)
+			continue
+		}
+
+		// Unused blocks read as all NUL or all 0xFF.
+		manufacturer := strings.TrimRight(string(result), "\x00 ")
+		if manufacturer == "" || utilities.BytesToUInt16(result) == 0xFFFF {
+			continue
+		}
+
+		client.infoLog().Printf("Found StorEdge battery %d (%s).", battery, manufacturer)
+		batteries = append(batteries, battery)
+	}
+
+	return batteries
+}
@@ -0,0 +1,40 @@
+package modbus
+
+import (
+	"fmt"
+)
+
+/*
+	Read an arbitrary range of holding registers once, in reads of at most MAX_REGISTERS_PER_READ registers, e.g.
+	to dump registers outside of the register map. Unlike PollRegisters, the first failing read fails the whole range.
+*/
+func ReadRange(client *ModbusClient, address uint16, quantity uint16) ([]byte, error) {
+	client.lock()
+	defer client.unlock()
+
+	if !client.conn.ensureConnected() {
+		return nil, errConnectionDown
+	}
+
+	result := make([]byte, 0, int(quantity)*2)
+	for read := uint32(0); read < uint32(quantity); read += MAX_REGISTERS_PER_READ {
+		start := uint32(address) + read
+		count := uint32(quantity) - read
+		if count > MAX_REGISTERS_PER_READ {
+			count = MAX_REGISTERS_PER_READ
+		}
+
+		bytes, err := client.Handler.ReadHoldingRegisters(uint16(start), uint16(count))
+		if isTransportError(err) {
+			client.conn.disconnect(err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("registers %d-%d: %w", start, start+count-1, err)
+		}
+		if len(bytes) != int(count)*2 {
+			return nil, fmt.Errorf("registers %d-%d: short read (%d bytes)", start, start+count-1, len(bytes))
+		}
+		result = append(result, bytes...)
+	}
+	return result, nil
+}
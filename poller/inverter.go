@@ -0,0 +1,98 @@
+package modbus
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+	Decoded (unscaled) registers of the inverter's common block and inverter model, typed as their SunSpec definition
+	(see sunspec.CommonModel & sunspec.InverterModel). Registers not read, or "not implemented", are nil.
+	Field names are the register names.
+*/
+type InverterRegisters struct {
+	C_Manufacturer  *string
+	C_Model         *string
+	C_Version       *string
+	C_SerialNumber  *string
+	C_DeviceAddress *uint16
+
+	C_SunSpec_DID    *uint16
+	C_SunSpec_Length *uint16
+
+	I_AC_Current    *uint16
+	I_AC_CurrentA   *uint16
+	I_AC_CurrentB   *uint16
+	I_AC_CurrentC   *uint16
+	I_AC_Current_SF *int16
+
+	I_AC_VoltageAB  *uint16
+	I_AC_VoltageBC  *uint16
+	I_AC_VoltageCA  *uint16
+	I_AC_VoltageAN  *uint16
+	I_AC_VoltageBN  *uint16
+	I_AC_VoltageCN  *uint16
+	I_AC_Voltage_SF *int16
+
+	I_AC_Power        *int16
+	I_AC_Power_SF     *int16
+	I_AC_Frequency    *uint16
+	I_AC_Frequency_SF *int16
+	I_AC_VA           *int16
+	I_AC_VA_SF        *int16
+	I_AC_VAR          *int16
+	I_AC_VAR_SF       *int16
+	I_AC_PF           *int16
+	I_AC_PF_SF        *int16
+	I_AC_Energy_WH    *uint32
+	I_AC_Energy_WH_SF *int16
+
+	I_DC_Current    *uint16
+	I_DC_Current_SF *int16
+	I_DC_Voltage    *uint16
+	I_DC_Voltage_SF *int16
+	I_DC_Power      *int16
+	I_DC_Power_SF   *int16
+
+	I_Temp_Sink *int16
+	I_Temp_SF   *int16
+
+	I_Status        *uint16
+	I_Status_Vendor *uint16
+}
+
+/*
+	Typed inverter registers of a poll.
+	Values of another type than their field are left nil and reported in the returned error.
+	Registers of other models (meters, batteries) remain accessible by name only, as their names are prefixed per device.
+*/
+func (values ModbusRegisters) Inverter() (*InverterRegisters, error) {
+	inverter := &InverterRegisters{}
+	errors := []string{}
+
+	fields := reflect.ValueOf(inverter).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		value := values[field.Name]
+		if value == nil {
+			continue
+		}
+
+		decoded := reflect.ValueOf(value)
+		if decoded.Type() != field.Type.Elem() {
+			errors = append(errors, fmt.Sprintf("'%s' is %T, expected %s", field.Name, value, field.Type.Elem()))
+			continue
+		}
+		pointer := reflect.New(decoded.Type())
+		pointer.Elem().Set(decoded)
+		fields.Field(i).Set(pointer)
+	}
+
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		return inverter, fmt.Errorf("unexpected value types: %s", strings.Join(errors, ", "))
+	}
+	return inverter, nil
+}
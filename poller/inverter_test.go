@@ -0,0 +1,86 @@
+package modbus
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+// Every register of the common block & inverter model has a field of its decoded type, and vice versa.
+func TestInverterRegistersMatchModels(t *testing.T) {
+	definitions := map[string]sunspec.ModelField{}
+	for name, field := range sunspec.CommonModel {
+		definitions[name] = field
+	}
+	for name, field := range sunspec.InverterModel {
+		definitions[name] = field
+	}
+
+	fields := reflect.TypeOf(InverterRegisters{})
+	for i := 0; i < fields.NumField(); i++ {
+		if _, found := definitions[fields.Field(i).Name]; !found {
+			t.Errorf("field '%s' is no register of the common block or inverter model", fields.Field(i).Name)
+		}
+	}
+
+	for name, definition := range definitions {
+		field, found := fields.FieldByName(name)
+		if !found {
+			t.Errorf("register '%s' has no field", name)
+			continue
+		}
+		element := sunspec.ModbusAddress{Size: definition.Size, Type: definition.Type, WordSwap: definition.WordSwap}
+		decoded, _ := DecodeRegister(element, make([]byte, RegisterCount(element)*2))
+		if reflect.TypeOf(decoded) != field.Type.Elem() {
+			t.Errorf("field '%s' is %s, register decodes to %T", name, field.Type.Elem(), decoded)
+		}
+	}
+}
+
+func TestInverter(t *testing.T) {
+	values := ModbusRegisters{
+		"C_SerialNumber":   "7E16A12F",
+		"I_AC_Power":       int16(2354),
+		"I_AC_Power_SF":    int16(-1),
+		"I_AC_Energy_WH":   uint32(2467612),
+		"I_Status":         nil,
+		"M1_C_SunSpec_DID": uint16(203),
+	}
+
+	inverter, err := values.Inverter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inverter.C_SerialNumber == nil || *inverter.C_SerialNumber != "7E16A12F" {
+		t.Errorf("C_SerialNumber = %v", inverter.C_SerialNumber)
+	}
+	if inverter.I_AC_Power == nil || *inverter.I_AC_Power != 2354 || inverter.I_AC_Power_SF == nil || *inverter.I_AC_Power_SF != -1 {
+		t.Errorf("I_AC_Power = %v * 10^%v", inverter.I_AC_Power, inverter.I_AC_Power_SF)
+	}
+	if inverter.I_AC_Energy_WH == nil || *inverter.I_AC_Energy_WH != 2467612 {
+		t.Errorf("I_AC_Energy_WH = %v", inverter.I_AC_Energy_WH)
+	}
+	if inverter.I_Status != nil || inverter.C_SunSpec_DID != nil {
+		t.Errorf("not implemented or meter registers set: I_Status %v, C_SunSpec_DID %v", inverter.I_Status, inverter.C_SunSpec_DID)
+	}
+}
+
+func TestInverterTypeMismatch(t *testing.T) {
+	values := ModbusRegisters{
+		"I_AC_Power": uint16(2354),
+		"I_Status":   uint16(4),
+	}
+
+	inverter, err := values.Inverter()
+	if err == nil || !strings.Contains(err.Error(), "'I_AC_Power' is uint16, expected int16") {
+		t.Errorf("error = %v, want a type mismatch of 'I_AC_Power'", err)
+	}
+	if inverter.I_AC_Power != nil {
+		t.Errorf("I_AC_Power = %d, want nil", *inverter.I_AC_Power)
+	}
+	if inverter.I_Status == nil || *inverter.I_Status != 4 {
+		t.Errorf("I_Status = %v, want 4", inverter.I_Status)
+	}
+}
@@ -1,7 +1,7 @@
 package modbus
 
 import (
-	"fmt"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -10,107 +10,253 @@ import (
 	utilities "github.com/stefannilsson/solaredgedc/common"
 	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
 	"github.com/stefannilsson/solaredgedc/logger"
+	"github.com/stefannilsson/solaredgedc/metrics"
 )
 
 type ModbusConfiguration struct {
+	// Transport, MODE_TCP (default), MODE_RTU or MODE_REPLAY
+	Mode string
+
+	// Modbus TCP
 	Hostname          string
 	Port              int
 	SlaveId           int
 	ConnectionTimeout int
+
+	// Recording replayed in MODE_REPLAY (see StartRecording)
+	ReplayFile string
+
+	// Modbus RTU (serial), e.g. '/dev/ttyUSB0', 115200 baud, 8 data bits, parity "N" (none), 1 stop bit.
+	SerialDevice string
+	BaudRate     int
+	DataBits     int
+	Parity       string
+	StopBits     int
+
+	// Name of the device, e.g. 'leader' or 'follower1'
+	Alias string
+
+	// Called on every connection state transition (with the connection lock held, must not block).
+	OnStateChange func(state ConnectionState)
 }
 
 type ModbusClient struct {
-	Handler          MODBUS.Client
-	TCPClientHandler *MODBUS.TCPClientHandler
+	Handler MODBUS.Client
+
+	// Name and unit id of the device, the connection may be shared with other units behind the same host:port.
+	Alias   string
+	SlaveId byte
+	conn    *connection
+
+	// SunSpec models and StorEdge batteries found on the device, and the register map & block reads derived from them.
+	Models    []sunspec.DiscoveredModel
+	Batteries []int
+	Registers map[string]sunspec.ModbusAddress
+	Blocks    []RegisterBlock
+
+	// Time of the last poll's reads, as recorded when replaying a recording (see PollRegisters).
+	PollTime time.Time
 }
 
+/*
+	Read register values by register name, 'nil' for SunSpec "not implemented" values.
+	Keyed by name as the registers read depend on the models found on the device (e.g. "M1_" prefixed registers for
+	each meter), see Inverter() for typed access to the inverter's registers.
+*/
 type ModbusRegisters map[string]interface{}
 
 const (
 	SECONDS_BETWEEN_RECONNECTS = 10
 )
 
-var errorLog *logrus.Entry
-var infoLog *logrus.Entry
-var debugLog *logrus.Entry
+// Transports
+const (
+	MODE_TCP    = "tcp"
+	MODE_RTU    = "rtu"
+	MODE_REPLAY = "replay" // serve reads from a recording, see StartRecording
+)
+
+var errorLog, infoLog, debugLog = logger.GetLoggers("modbus")
 
 func NewPoller(config *ModbusConfiguration) *ModbusClient {
-	// Only log the warning severity or above.
-	errorLog, infoLog, debugLog = logger.GetLoggers("modbus")
+	conn := getConnection(config)
 
-	handler := MODBUS.NewTCPClientHandler(fmt.Sprintf("%s:%d", config.Hostname, config.Port))
-	handler.Timeout = SECONDS_BETWEEN_RECONNECTS * time.Second
-	handler.SlaveId = byte(config.SlaveId)
+	// Create an return our _own_ Modbus client and its state.
+	modbusClient := &ModbusClient{
+		Handler: conn.client,
+		Alias:   config.Alias,
+		SlaveId: byte(config.SlaveId),
+		conn:    conn,
+	}
 
-	for {
-		err := handler.Connect()
-		if err != nil {
-			errorLog.Println("TCP connection could not be established. Please check Modbus configuration.")
-			time.Sleep(5 * time.Second)
-		} else {
-			break
-		}
+	modbusClient.lock()
+	defer modbusClient.unlock()
+
+	if config.OnStateChange != nil {
+		conn.listeners = append(conn.listeners, config.OnStateChange)
+		config.OnStateChange(conn.state)
 	}
 
-	client := MODBUS.NewClient(handler)
+	// Walk the SunSpec model chain to build the register map, fall back to the default SolarEdge layout.
+	models, err := DiscoverModels(modbusClient)
+	if err != nil {
+		modbusClient.errorLog().Errorf("SunSpec model discovery incomplete: %v", err)
+	}
+	if len(sunspec.BuildRegisters(models)) == 0 {
+		modbusClient.errorLog().Errorln("No known SunSpec models discovered, falling back to default SolarEdge register layout.")
+		models = sunspec.DefaultModels
+	}
+	modbusClient.SetModels(models)
 
-	// Create an return our _own_ Modbus client and its state.
-	modbusClient := &ModbusClient{Handler: client, TCPClientHandler: handler}
+	// Poll StorEdge batteries only if any are connected.
+	modbusClient.SetBatteries(DetectBatteries(modbusClient))
 
-	infoLog.Println("Modbus TCP connection successfully established.")
 	return modbusClient
 }
 
+// Take exclusive use of the (shared) connection and address this client's unit id.
+func (client *ModbusClient) lock() {
+	client.conn.Lock()
+	client.conn.unitId = client.SlaveId
+	client.conn.setSlaveId(client.SlaveId)
+}
+
+func (client *ModbusClient) unlock() {
+	client.conn.Unlock()
+}
+
+// Current state of the (shared) connection.
+func (client *ModbusClient) State() ConnectionState {
+	client.conn.Lock()
+	defer client.conn.Unlock()
+	return client.conn.state
+}
+
+// Loggers tagged with the device alias.
+func (client *ModbusClient) errorLog() *logrus.Entry {
+	return errorLog.WithField("device", client.Alias)
+}
+
+func (client *ModbusClient) infoLog() *logrus.Entry {
+	return infoLog.WithField("device", client.Alias)
+}
+
+func (client *ModbusClient) debugLog() *logrus.Entry {
+	return debugLog.WithField("device", client.Alias)
+}
+
+// Set the discovered models and (re)build the register map and block reads.
+func (client *ModbusClient) SetModels(models []sunspec.DiscoveredModel) {
+	client.Models = models
+	client.buildRegisters()
+}
+
+// Set the detected batteries and (re)build the register map and block reads.
+func (client *ModbusClient) SetBatteries(batteries []int) {
+	client.Batteries = batteries
+	client.buildRegisters()
+}
+
+func (client *ModbusClient) buildRegisters() {
+	client.Registers = sunspec.BuildRegisters(client.Models)
+	for key, element := range sunspec.BuildBatteryRegisters(client.Batteries) {
+		client.Registers[key] = element
+	}
+	client.Blocks = PlanBlocks(client.Registers)
+}
+
+// Count failed reads per register, exported as 'solaredgedc_register_read_failures_total'.
+func (client *ModbusClient) countFailures(keys ...string) {
+	for _, key := range keys {
+		metrics.Default.AddCounter("solaredgedc_register_read_failures_total", "Failed Modbus register reads", metrics.Labels{"device": client.Alias, "register": key}, 1)
+	}
+}
+
 func PollRegisters(client *ModbusClient) *ModbusRegisters {
 
 	// Successfully read Modbus registers (to be scaled later with each registers *_SF field)
 	var readValues ModbusRegisters = ModbusRegisters{}
 
-	for key, element := range sunspec.Registers {
-		switch element.Type {
-		case sunspec.Dt_uint16:
-			result, err := client.Handler.ReadHoldingRegisters(element.Address, 1)
-			if err != nil {
-				errorLog.Printf("Failed to retrieve Modbus register '%s'", key)
-				continue
-			}
-			readValues[key] = utilities.BytesToUInt16(result)
-		case sunspec.Dt_int16:
-			result, err := client.Handler.ReadHoldingRegisters(element.Address, 1)
-			if err != nil {
-				errorLog.Printf("Failed to retrieve Modbus register '%s'", key)
-				continue
-			}
-			readValues[key] = utilities.BytesToInt16(result)
-		case sunspec.Dt_uint32:
-			result, err := client.Handler.ReadHoldingRegisters(element.Address, 2)
-			if err != nil {
-				errorLog.Printf("Failed to retrieve Modbus register '%s'", key)
+	client.lock()
+	defer client.unlock()
+
+	// Transparently reconnect after the connection was lost, or skip this poll while backing off.
+	if !client.conn.ensureConnected() {
+		client.debugLog().Debugln("Modbus connection down, skipping poll.")
+		return &readValues
+	}
+
+	// Read coalesced register blocks, so that each value and its scale factor come from the same snapshot.
+	for _, block := range client.Blocks {
+		result, err := client.Handler.ReadHoldingRegisters(block.Address, block.Quantity)
+		if isTransportError(err) {
+			// No point in trying the remaining blocks, drop the connection and reconnect on the next poll.
+			client.countFailures(block.Keys...)
+			client.conn.disconnect(err)
+			break
+		}
+		if err != nil {
+			client.errorLog().Errorf("Failed to retrieve Modbus registers %d-%d (%d fields)", block.Address, block.Address+block.Quantity-1, len(block.Keys))
+			client.countFailures(block.Keys...)
+			continue
+		}
+
+		for _, key := range block.Keys {
+			element := client.Registers[key]
+			offset := int(element.Address-block.Address) * 2
+			size := int(RegisterCount(element)) * 2
+			if offset+size > len(result) {
+				client.errorLog().Errorf("Short read for Modbus register '%s'", key)
+				client.countFailures(key)
 				continue
 			}
-			readValues[key] = utilities.BytesToUint32(result)
-		case sunspec.Dt_acc32:
-			result, err := client.Handler.ReadHoldingRegisters(element.Address, 2)
-			if err != nil {
-				errorLog.Printf("Failed to retrieve Modbus register '%s'", key)
+
+			value, ok := DecodeRegister(element, result[offset:offset+size])
+			if !ok {
+				client.errorLog().Errorf("UNKNOWN datatype: int(%d)", element.Type)
+				client.countFailures(key)
 				continue
 			}
-			readValues[key] = utilities.BytesToUint32(result)
-		case sunspec.Dt_string:
-			result, err := client.Handler.ReadHoldingRegisters(element.Address, element.Size)
-			if err != nil {
-				errorLog.Printf("Failed to retrieve Modbus register '%s'", key)
-				continue
+
+			// Keep "not implemented" values as 'nil', so they (and values scaled by them) are left out when mapping.
+			if sunspec.IsNotImplemented(element.Type, value) {
+				value = nil
 			}
-			readValues[key] = string(result)
-		default:
-			errorLog.Println(fmt.Sprintf("UNKNOWN datatype: int(%d)", element.Type))
+			readValues[key] = value
 		}
 	}
 
 	if len(readValues) == 0 {
-		errorLog.Println("No values successfully read from registers.")
+		client.errorLog().Errorln("No values successfully read from registers.")
 	}
 
+	// timestamp of the readings: the time of the last block read.
+	client.PollTime = client.conn.readTime
+
 	return &readValues
 }
+
+// Decode a single field from its raw register bytes.
+func DecodeRegister(element sunspec.ModbusAddress, bytes []byte) (interface{}, bool) {
+	if element.WordSwap {
+		bytes = utilities.SwapWords(bytes)
+	}
+
+	switch element.Type {
+	case sunspec.Dt_uint16:
+		return utilities.BytesToUInt16(bytes), true
+	case sunspec.Dt_int16:
+		return utilities.BytesToInt16(bytes), true
+	case sunspec.Dt_uint32, sunspec.Dt_acc32:
+		return utilities.BytesToUint32(bytes), true
+	case sunspec.Dt_float32:
+		return utilities.BytesToFloat32(bytes), true
+	case sunspec.Dt_uint64:
+		return utilities.BytesToUint64(bytes), true
+	case sunspec.Dt_string:
+		// strings are padded with NUL characters
+		return strings.TrimRight(string(bytes), "\x00 "), true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,121 @@
+package modbus
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	MODBUS "github.com/goburrow/modbus"
+	"github.com/stefannilsson/solaredgedc/metrics"
+)
+
+const (
+	RECONNECT_BACKOFF_MIN = 1 * time.Second // delay before the first reconnect attempt, doubled for every failed attempt.
+	RECONNECT_BACKOFF_MAX = 5 * time.Minute // upper bound of the reconnect delay.
+)
+
+// Modbus connection state
+type ConnectionState int
+
+const (
+	STATE_DISCONNECTED ConnectionState = iota
+	STATE_CONNECTED
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case STATE_CONNECTED:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+/*
+	Whether a request failed due to the transport (connection lost, timeout, garbled response), rather than
+	the device answering with a Modbus exception (e.g. illegal data address) over a healthy connection.
+*/
+func isTransportError(err error) bool {
+	var modbusError *MODBUS.ModbusError
+	return err != nil && !errors.As(err, &modbusError)
+}
+
+// Exponential backoff with jitter: a random delay in [50%, 100%] of min(MIN * 2^(attempt-1), MAX).
+func reconnectBackoff(attempt int) time.Duration {
+	backoff := RECONNECT_BACKOFF_MAX
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt <= 32 {
+		if exponential := RECONNECT_BACKOFF_MIN << (attempt - 1); exponential > 0 && exponential < RECONNECT_BACKOFF_MAX {
+			backoff = exponential
+		}
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// (Re)connect the transport. Caller must hold the connection lock.
+func (conn *connection) connect() error {
+	err := conn.handler.Connect()
+	if err != nil {
+		conn.failures++
+		conn.nextAttempt = time.Now().Add(reconnectBackoff(conn.failures))
+		conn.setState(STATE_DISCONNECTED, err)
+		return err
+	}
+
+	if conn.connected {
+		metrics.Default.AddCounter("solaredgedc_modbus_reconnects_total", "Modbus reconnects after a lost connection", metrics.Labels{"address": conn.address}, 1)
+	}
+	conn.connected = true
+	conn.failures = 0
+	conn.setState(STATE_CONNECTED, nil)
+	return nil
+}
+
+// Drop the transport after a failure, a reconnect is attempted on the next poll. Caller must hold the connection lock.
+func (conn *connection) disconnect(err error) {
+	conn.handler.Close()
+	conn.nextAttempt = time.Now()
+	conn.setState(STATE_DISCONNECTED, err)
+}
+
+// Returned by requests made while ensureConnected reports the connection as down.
+var errConnectionDown = errors.New("Modbus connection down")
+
+/*
+	Make sure the transport is connected, reconnecting if the backoff delay has passed.
+	Returns false if (still) disconnected. Caller must hold the connection lock.
+*/
+func (conn *connection) ensureConnected() bool {
+	if conn.state == STATE_CONNECTED {
+		return true
+	}
+	if time.Now().Before(conn.nextAttempt) {
+		return false
+	}
+	return conn.connect() == nil
+}
+
+// Record (and report) a state transition.
+func (conn *connection) setState(state ConnectionState, err error) {
+	if state == conn.state {
+		if err != nil {
+			debugLog.Debugf("Reconnect to %s failed (attempt %d): %v", conn.address, conn.failures, err)
+		}
+		return
+	}
+	conn.state = state
+
+	switch state {
+	case STATE_CONNECTED:
+		infoLog.Printf("Modbus connection to %s established.", conn.address)
+	default:
+		errorLog.Errorf("Modbus connection to %s lost: %v", conn.address, err)
+	}
+
+	for _, listener := range conn.listeners {
+		listener(state)
+	}
+}
@@ -0,0 +1,291 @@
+package modbus
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	MODBUS "github.com/goburrow/modbus"
+)
+
+// Header of a recording, followed by the gzip compressed records.
+const RECORDING_MAGIC = "SEDCREC1"
+
+// Outcome of a recorded read
+const (
+	RESULT_OK        = 0 // followed by the register bytes
+	RESULT_EXCEPTION = 1 // followed by the exception code
+	RESULT_ERROR     = 2 // transport error, followed by the error message
+)
+
+/*
+	A raw 'Read Holding Registers' transaction: the connection (host:port or serial device) and unit it was
+	addressed to, the requested registers and the response.
+*/
+type Record struct {
+	Time       time.Time
+	Connection string
+	UnitId     byte
+	Address    uint16
+	Quantity   uint16
+
+	Result    byte
+	Data      []byte // RESULT_OK
+	Exception byte   // RESULT_EXCEPTION
+	Error     string // RESULT_ERROR
+}
+
+// Response of the recorded transaction, as returned by the Modbus client.
+func (record *Record) Response() ([]byte, error) {
+	switch record.Result {
+	case RESULT_OK:
+		return append([]byte{}, record.Data...), nil
+	case RESULT_EXCEPTION:
+		return nil, &MODBUS.ModbusError{FunctionCode: 0x83, ExceptionCode: record.Exception}
+	default:
+		return nil, errors.New(record.Error)
+	}
+}
+
+/*
+	Records every block read of all connections to a file, e.g. to reproduce odd values reported by a user.
+	Recordings are gzip compressed and flushed after every read, so that they survive the collector being killed.
+*/
+type Recorder struct {
+	lock   sync.Mutex
+	file   *os.File
+	gzip   *gzip.Writer
+	buffer []byte
+}
+
+var recorder *Recorder
+
+// Record all block reads of all connections to the given file (truncated).
+func StartRecording(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("recording: %w", err)
+	}
+	if _, err := file.WriteString(RECORDING_MAGIC); err != nil {
+		file.Close()
+		return fmt.Errorf("recording: %w", err)
+	}
+
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	recorder = &Recorder{file: file, gzip: gzip.NewWriter(file)}
+	infoLog.Printf("Recording Modbus reads to %s.", path)
+	return nil
+}
+
+// Flush and close the recording, if any.
+func StopRecording() {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	if recorder == nil {
+		return
+	}
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.gzip.Close()
+	recorder.file.Close()
+	recorder = nil
+}
+
+func (r *Recorder) write(record *Record) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.buffer = appendRecord(r.buffer[:0], record)
+	if _, err := r.gzip.Write(r.buffer); err != nil {
+		errorLog.Errorf("Failed to record Modbus read: %v", err)
+		return
+	}
+	if err := r.gzip.Flush(); err != nil {
+		errorLog.Errorf("Failed to record Modbus read: %v", err)
+	}
+}
+
+/*
+	Record layout (big endian): time (unix ns, int64), connection (uint8 length + bytes), unit id (uint8),
+	address (uint16), quantity (uint16), result (uint8), and depending on the result the register bytes
+	(uint16 length + bytes), the exception code (uint8) or the error message (uint16 length + bytes).
+*/
+func appendRecord(buffer []byte, record *Record) []byte {
+	buffer = appendUint64(buffer, uint64(record.Time.UnixNano()))
+	connection := record.Connection
+	if len(connection) > 0xFF {
+		connection = connection[:0xFF]
+	}
+	buffer = append(buffer, byte(len(connection)))
+	buffer = append(buffer, connection...)
+	buffer = append(buffer, record.UnitId)
+	buffer = appendUint16(buffer, record.Address)
+	buffer = appendUint16(buffer, record.Quantity)
+	buffer = append(buffer, record.Result)
+
+	switch record.Result {
+	case RESULT_OK:
+		buffer = appendUint16(buffer, uint16(len(record.Data)))
+		buffer = append(buffer, record.Data...)
+	case RESULT_EXCEPTION:
+		buffer = append(buffer, record.Exception)
+	default:
+		message := record.Error
+		if len(message) > 0xFFFF {
+			message = message[:0xFFFF]
+		}
+		buffer = appendUint16(buffer, uint16(len(message)))
+		buffer = append(buffer, message...)
+	}
+	return buffer
+}
+
+func appendUint16(buffer []byte, value uint16) []byte {
+	return append(buffer, byte(value>>8), byte(value))
+}
+
+func appendUint64(buffer []byte, value uint64) []byte {
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, value)
+	return append(buffer, bytes...)
+}
+
+// Read all records of a recording. A recording cut short (e.g. the collector was killed) ends at its last complete record.
+func ReadRecording(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("recording: %w", err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(RECORDING_MAGIC))
+	if _, err := io.ReadFull(file, magic); err != nil || string(magic) != RECORDING_MAGIC {
+		return nil, fmt.Errorf("recording: %s is not a Modbus recording", path)
+	}
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("recording: %w", err)
+	}
+	reader := bufio.NewReader(compressed)
+
+	records := []Record{}
+	for {
+		record, err := readRecord(reader)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			if len(records) == 0 {
+				return nil, fmt.Errorf("recording: %w", err)
+			}
+			errorLog.Errorf("Recording %s truncated after %d reads: %v", path, len(records), err)
+			return records, nil
+		}
+		records = append(records, *record)
+	}
+}
+
+func readRecord(reader *bufio.Reader) (*Record, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		// EOF before a new record is the regular end of a recording.
+		return nil, err
+	}
+	record := &Record{Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8])))}
+
+	connection := make([]byte, header[8])
+	fields := make([]byte, 6)
+	if err := readAll(reader, connection, fields); err != nil {
+		return nil, err
+	}
+	record.Connection = string(connection)
+	record.UnitId = fields[0]
+	record.Address = binary.BigEndian.Uint16(fields[1:3])
+	record.Quantity = binary.BigEndian.Uint16(fields[3:5])
+	record.Result = fields[5]
+
+	switch record.Result {
+	case RESULT_OK, RESULT_ERROR:
+		length := make([]byte, 2)
+		if err := readAll(reader, length); err != nil {
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint16(length))
+		if err := readAll(reader, data); err != nil {
+			return nil, err
+		}
+		if record.Result == RESULT_OK {
+			record.Data = data
+		} else {
+			record.Error = string(data)
+		}
+	case RESULT_EXCEPTION:
+		code := make([]byte, 1)
+		if err := readAll(reader, code); err != nil {
+			return nil, err
+		}
+		record.Exception = code[0]
+	default:
+		return nil, fmt.Errorf("unknown result %d", record.Result)
+	}
+
+	return record, nil
+}
+
+// Read into all buffers, a record ending early is reported as io.ErrUnexpectedEOF.
+func readAll(reader io.Reader, buffers ...[]byte) error {
+	for _, buffer := range buffers {
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Client recording the block reads of a connection.
+type recordingClient struct {
+	MODBUS.Client
+	conn *connection
+}
+
+func (client *recordingClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	results, err := client.Client.ReadHoldingRegisters(address, quantity)
+
+	// a replayed read keeps its recorded time (see replay.ReadHoldingRegisters).
+	if _, replaying := client.conn.handler.(*replay); !replaying {
+		client.conn.readTime = time.Now()
+	}
+	record := &Record{Time: client.conn.readTime, Connection: client.conn.address, UnitId: client.conn.unitId, Address: address, Quantity: quantity}
+	var modbusError *MODBUS.ModbusError
+	switch {
+	case err == nil:
+		record.Result = RESULT_OK
+		record.Data = results
+	case errors.As(err, &modbusError):
+		record.Result = RESULT_EXCEPTION
+		record.Exception = modbusError.ExceptionCode
+	default:
+		record.Result = RESULT_ERROR
+		record.Error = err.Error()
+	}
+
+	connectionsLock.Lock()
+	r := recorder
+	connectionsLock.Unlock()
+	if r != nil {
+		r.write(record)
+	}
+
+	return results, err
+}
@@ -0,0 +1,108 @@
+package modbus
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	MODBUS "github.com/goburrow/modbus"
+)
+
+var recordedTime = time.Unix(1780315200, 123456789)
+
+var testRecords = []Record{
+	{Time: recordedTime, Connection: "192.168.0.100:1502", UnitId: 1, Address: 40069, Quantity: 4, Result: RESULT_OK, Data: []byte{0, 103, 0, 50, 1, 2, 3, 4}},
+	{Time: recordedTime.Add(time.Millisecond), Connection: "192.168.0.100:1502", UnitId: 2, Address: 40069, Quantity: 2, Result: RESULT_EXCEPTION, Exception: 0x02},
+	{Time: recordedTime.Add(time.Second), Connection: "/dev/ttyUSB0", UnitId: 1, Address: 40000, Quantity: 125, Result: RESULT_ERROR, Error: "read tcp: connection reset by peer"},
+}
+
+func writeRecording(t *testing.T, records []Record) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.rec")
+	if err := StartRecording(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		recorder.write(&records[i])
+	}
+	StopRecording()
+	return path
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	path := writeRecording(t, testRecords)
+
+	records, err := ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(testRecords) {
+		t.Fatalf("read %d records, want %d", len(records), len(testRecords))
+	}
+	for i, record := range records {
+		want := testRecords[i]
+		if !record.Time.Equal(want.Time) {
+			t.Errorf("record %d: time %v, want %v", i, record.Time, want.Time)
+		}
+		record.Time = want.Time
+		if !reflect.DeepEqual(record, want) {
+			t.Errorf("record %d: %+v, want %+v", i, record, want)
+		}
+	}
+
+	// Responses as returned by the Modbus client.
+	if data, err := records[0].Response(); err != nil || !reflect.DeepEqual(data, testRecords[0].Data) {
+		t.Errorf("response %v, %v, want %v", data, err, testRecords[0].Data)
+	}
+	var modbusError *MODBUS.ModbusError
+	if _, err := records[1].Response(); !errors.As(err, &modbusError) || modbusError.ExceptionCode != 0x02 || isTransportError(err) {
+		t.Errorf("response error %v, want Modbus exception 2", err)
+	}
+	if _, err := records[2].Response(); err == nil || err.Error() != testRecords[2].Error || !isTransportError(err) {
+		t.Errorf("response error %v, want transport error %q", err, testRecords[2].Error)
+	}
+}
+
+func TestRecordingTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "killed.rec")
+	if err := StartRecording(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		recorder.write(&testRecords[i])
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.write(&testRecords[2])
+	StopRecording()
+
+	// A recording of a killed collector ends with its last complete (flushed) record.
+	if err := os.Truncate(path, info.Size()+4); err != nil {
+		t.Fatal(err)
+	}
+	records, err := ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Errorf("read %d records of a truncated recording, want 2", len(records))
+	}
+}
+
+func TestRecordingInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid.rec")
+	if err := os.WriteFile(path, []byte("not a recording"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRecording(path); err == nil {
+		t.Error("no error reading an invalid recording")
+	}
+	if _, err := ReadRecording(filepath.Join(t.TempDir(), "missing.rec")); err == nil {
+		t.Error("no error reading a missing recording")
+	}
+}
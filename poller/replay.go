@@ -0,0 +1,166 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Returned by reads of a replayed connection once the recording has been replayed completely.
+var ErrReplayFinished = errors.New("end of recording")
+
+var errReplayUnsupported = errors.New("not supported when replaying a recording")
+
+// Recordings by path, loaded once and shared by all replayed connections.
+var recordings = map[string][]Record{}
+var recordingsLock sync.Mutex
+
+// Load a recording to be replayed (once, on first use).
+func LoadRecording(path string) ([]Record, error) {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+
+	if records, found := recordings[path]; found {
+		return records, nil
+	}
+	records, err := ReadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	infoLog.Printf("Replaying %d Modbus reads from %s.", len(records), path)
+	recordings[path] = records
+	return records, nil
+}
+
+/*
+	Transport serving block reads from a recording instead of a device: every read returns the next recorded
+	response of the same unit, address and quantity, in recorded order (including exceptions & transport errors).
+	Reads are matched against the records of the same connection (host:port or serial device) if the recording
+	holds any, otherwise against the records of all connections. Likewise, a recording of a single unit is replayed
+	for any unit id. So a recording can be replayed without knowing the user's addresses.
+*/
+type replay struct {
+	lock     sync.Mutex
+	records  map[replayKey][]*Record
+	units    map[byte]bool
+	finished bool
+	conn     *connection
+}
+
+type replayKey struct {
+	unitId   byte
+	address  uint16
+	quantity uint16
+}
+
+func newReplay(path string, address string) (*replay, error) {
+	records, err := LoadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+
+	matchConnection := false
+	for i := range records {
+		if records[i].Connection == address {
+			matchConnection = true
+			break
+		}
+	}
+
+	r := &replay{records: map[replayKey][]*Record{}, units: map[byte]bool{}}
+	for i := range records {
+		record := &records[i]
+		if matchConnection && record.Connection != address {
+			continue
+		}
+		key := replayKey{unitId: record.UnitId, address: record.Address, quantity: record.Quantity}
+		r.records[key] = append(r.records[key], record)
+		r.units[record.UnitId] = true
+	}
+	return r, nil
+}
+
+// Whether a read found the recording exhausted.
+func (r *replay) Finished() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.finished
+}
+
+func (r *replay) Connect() error {
+	if r.Finished() {
+		return ErrReplayFinished
+	}
+	return nil
+}
+
+func (r *replay) Close() error {
+	return nil
+}
+
+func (r *replay) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := replayKey{unitId: r.conn.unitId, address: address, quantity: quantity}
+	if !r.units[key.unitId] && len(r.units) == 1 {
+		for unitId := range r.units {
+			key.unitId = unitId
+		}
+	}
+	queue := r.records[key]
+	if len(queue) == 0 {
+		r.finished = true
+		return nil, fmt.Errorf("no recorded read of unit %d, registers %d-%d: %w", key.unitId, address, address+quantity-1, ErrReplayFinished)
+	}
+	r.records[key] = queue[1:]
+	r.conn.readTime = queue[0].Time
+	return queue[0].Response()
+}
+
+// Only block reads are recorded.
+func (r *replay) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+func (r *replay) ReadFIFOQueue(address uint16) ([]byte, error) {
+	return nil, errReplayUnsupported
+}
+
+// Whether the client replays a recording that has been replayed completely.
+func (client *ModbusClient) ReplayFinished() bool {
+	r, replaying := client.conn.handler.(*replay)
+	return replaying && r.Finished()
+}
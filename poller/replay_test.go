@@ -0,0 +1,76 @@
+package modbus_test
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	mapping "github.com/stefannilsson/solaredgedc/datamapping"
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+	"github.com/stefannilsson/solaredgedc/simulator"
+)
+
+// Poll, parse & serialize a reading, as published.
+func pollJson(t *testing.T, client *modbus.ModbusClient) string {
+	t.Helper()
+	values := modbus.PollRegisters(client)
+	if len(*values) == 0 {
+		t.Fatal("no registers read")
+	}
+	parsed, err := mapping.ParseValues(values, client.PollTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := mapping.SerializeToJson(mapping.ToPVSolarReading(parsed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(payload)
+}
+
+// A replayed recording reproduces the readings of the recorded polls exactly, including their time.
+func TestRecordAndReplay(t *testing.T) {
+	sim, err := simulator.New(simulator.Config{Listen: "127.0.0.1:0", Speed: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	host, port, _ := net.SplitHostPort(sim.Addr())
+	portNumber, _ := strconv.Atoi(port)
+
+	path := filepath.Join(t.TempDir(), "replay.rec")
+	if err := modbus.StartRecording(path); err != nil {
+		t.Fatal(err)
+	}
+	live := modbus.NewPoller(&modbus.ModbusConfiguration{Mode: modbus.MODE_TCP, Hostname: host, Port: portNumber, SlaveId: 1, Alias: "live"})
+	recorded := []string{}
+	for i := 0; i < 3; i++ {
+		recorded = append(recorded, pollJson(t, live))
+		time.Sleep(10 * time.Millisecond)
+	}
+	modbus.StopRecording()
+
+	// Replayed under another address (unique per run, as connections are shared per address) and unit id, a
+	// recording of a single unit replays regardless.
+	replayed := modbus.NewPoller(&modbus.ModbusConfiguration{Mode: modbus.MODE_REPLAY, ReplayFile: path, Hostname: "replay", Port: portNumber, SlaveId: 2, Alias: "replay"})
+	for i, want := range recorded {
+		if got := pollJson(t, replayed); got != want {
+			t.Errorf("replayed poll %d:\n%s\nrecorded:\n%s", i, got, want)
+		}
+	}
+	if recorded[0] == recorded[1] {
+		t.Error("recorded polls identical, simulated values or time didn't change")
+	}
+
+	if replayed.ReplayFinished() {
+		t.Error("replay finished before reading past the recording")
+	}
+	if values := modbus.PollRegisters(replayed); len(*values) != 0 || !replayed.ReplayFinished() {
+		t.Errorf("%d registers read past the end of the recording, finished %t", len(*values), replayed.ReplayFinished())
+	}
+}
@@ -0,0 +1,293 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	MODBUS "github.com/goburrow/modbus"
+	utilities "github.com/stefannilsson/solaredgedc/common"
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+const (
+	DEFAULT_SCAN_CONNECT_TIMEOUT = 500 * time.Millisecond
+	DEFAULT_SCAN_TIMEOUT         = 1 * time.Second // per request, i.e. per unit id not answering
+	DEFAULT_SCAN_CONCURRENCY     = 64              // hosts probed at the same time
+	MAX_SCAN_HOSTS               = 65536           // i.e. a /16
+	MIN_UNIT_ID                  = 1
+	MAX_UNIT_ID                  = 247
+)
+
+// Ports probed by default: Modbus TCP, and SolarEdge's default Modbus TCP port.
+var DefaultScanPorts = []int{502, 1502}
+
+type ScanConfig struct {
+	Ports   []int
+	UnitIds []byte
+
+	ConnectTimeout time.Duration // TCP connect, i.e. how long to wait for hosts without a listener
+	Timeout        time.Duration // Modbus request
+	Concurrency    int
+
+	// Called with every device found, e.g. to report progress (may be called concurrently).
+	OnFound func(device ScannedDevice)
+}
+
+// A SunSpec device found by Scan, with its common block.
+type ScannedDevice struct {
+	Host         string
+	Port         int
+	UnitId       byte
+	BaseAddress  uint16
+	Manufacturer string
+	Model        string
+	Version      string
+	Serial       string
+}
+
+/*
+	Probe every host of the CIDR ranges (or single addresses) for a Modbus TCP listener on each port, and every
+	listener for SunSpec devices on each unit id, reading their common block (model 1).
+	Unit ids are probed one at a time, as SolarEdge inverters only accept a single Modbus TCP session. Devices
+	answering for any unit id are reported once per serial number, with the first unit id they answered.
+*/
+func Scan(targets []string, config ScanConfig) ([]ScannedDevice, error) {
+	if len(config.Ports) == 0 {
+		config.Ports = DefaultScanPorts
+	}
+	if len(config.UnitIds) == 0 {
+		for unitId := MIN_UNIT_ID; unitId <= MAX_UNIT_ID; unitId++ {
+			config.UnitIds = append(config.UnitIds, byte(unitId))
+		}
+	}
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = DEFAULT_SCAN_CONNECT_TIMEOUT
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DEFAULT_SCAN_TIMEOUT
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = DEFAULT_SCAN_CONCURRENCY
+	}
+
+	hosts := []string{}
+	for _, target := range targets {
+		targetHosts, err := ScanHosts(target)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, targetHosts...)
+	}
+	if len(hosts) > MAX_SCAN_HOSTS {
+		return nil, fmt.Errorf("too many hosts to scan (%d), at most %d (a /16)", len(hosts), MAX_SCAN_HOSTS)
+	}
+
+	type listener struct {
+		host string
+		port int
+	}
+	listeners := make(chan listener)
+	go func() {
+		defer close(listeners)
+		for _, host := range hosts {
+			for _, port := range config.Ports {
+				listeners <- listener{host: host, port: port}
+			}
+		}
+	}()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	devices := []ScannedDevice{}
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range listeners {
+				found := scanListener(l.host, l.port, &config)
+				lock.Lock()
+				devices = append(devices, found...)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i], devices[j]
+		if a.Host != b.Host {
+			return compareIPs(a.Host, b.Host) < 0
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.UnitId < b.UnitId
+	})
+	return devices, nil
+}
+
+// Addresses of a CIDR range (without network & broadcast address, unless /31 or /32) or single address.
+func ScanHosts(target string) ([]string, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		return []string{ip.String()}, nil
+	}
+
+	ip, network, err := net.ParseCIDR(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address or CIDR range '%s'", target)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("only IPv4 ranges can be scanned, got '%s'", target)
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("range '%s' too large, at most a /16 can be scanned", target)
+	}
+
+	hosts := []string{}
+	first := ipToUint32(network.IP.To4())
+	last := first | (1<<uint(bits-ones) - 1)
+	if bits-ones >= 2 {
+		first, last = first+1, last-1
+	}
+	for address := first; address <= last && address >= first; address++ {
+		hosts = append(hosts, uint32ToIP(address).String())
+	}
+	return hosts, nil
+}
+
+// Probe all unit ids of a single host:port, nil if nothing's listening.
+func scanListener(host string, port int, config *ScanConfig) []ScannedDevice {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	// Cheap check for a listener first, most hosts of a range won't have one.
+	conn, err := net.DialTimeout("tcp", address, config.ConnectTimeout)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	debugLog.Debugf("Scanning Modbus TCP listener %s.", address)
+
+	handler := MODBUS.NewTCPClientHandler(address)
+	handler.Timeout = config.Timeout
+	defer handler.Close()
+	client := &ModbusClient{Handler: MODBUS.NewClient(handler), Alias: address}
+
+	devices := []ScannedDevice{}
+	serials := map[string]bool{}
+	for _, unitId := range config.UnitIds {
+		handler.SlaveId = unitId
+		device, err := readCommonBlock(client)
+		if err != nil {
+			// Drop the connection after a timeout or garbled response, so a late response can't mix up the next unit.
+			if err != errNoCommonBlock && isTransportError(err) {
+				handler.Close()
+			}
+			continue
+		}
+
+		device.Host, device.Port, device.UnitId = host, port, unitId
+		if device.Serial != "" && serials[device.Serial] {
+			continue
+		}
+		serials[device.Serial] = true
+
+		infoLog.Printf("Found %s %s (serial %s) at %s, unit id %d.", device.Manufacturer, device.Model, device.Serial, address, unitId)
+		if config.OnFound != nil {
+			config.OnFound(*device)
+		}
+		devices = append(devices, *device)
+	}
+	return devices
+}
+
+var errNoCommonBlock = errors.New("no SunSpec common block")
+
+/*
+	Locate the SunSpec map of the currently addressed unit and read its common block.
+	Unlike findBaseAddress, gives up on the first transport error (e.g. timeout), as there's no unit to answer.
+*/
+func readCommonBlock(client *ModbusClient) (*ScannedDevice, error) {
+	base, found := uint16(0), false
+	for _, candidate := range SunSpecBaseAddresses {
+		result, err := client.Handler.ReadHoldingRegisters(candidate, 2)
+		if isTransportError(err) {
+			return nil, err
+		}
+		if err == nil && utilities.BytesToUint32(result) == sunspec.SUNSPEC_ID {
+			base, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, errNoCommonBlock
+	}
+
+	address := base + 2
+	header, err := client.Handler.ReadHoldingRegisters(address, 2)
+	if err != nil {
+		return nil, err
+	}
+	if utilities.BytesToUInt16(header[0:2]) != sunspec.Model_COMMON {
+		return nil, errNoCommonBlock
+	}
+
+	length := utilities.BytesToUInt16(header[2:4])
+	registers := sunspec.BuildRegisters([]sunspec.DiscoveredModel{{Id: sunspec.Model_COMMON, Address: address, Length: length}})
+	if length > MAX_REGISTERS_PER_READ {
+		length = MAX_REGISTERS_PER_READ
+	}
+	block, err := client.Handler.ReadHoldingRegisters(address+2, length)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	for key, element := range registers {
+		offset := int(element.Address-address-2) * 2
+		size := int(RegisterCount(element)) * 2
+		if offset < 0 || offset+size > len(block) {
+			continue
+		}
+		if value, ok := DecodeRegister(element, block[offset:offset+size]); ok {
+			values[key] = value
+		}
+	}
+
+	device := &ScannedDevice{BaseAddress: base}
+	device.Manufacturer, _ = values["C_Manufacturer"].(string)
+	device.Model, _ = values["C_Model"].(string)
+	device.Version, _ = values["C_Version"].(string)
+	device.Serial, _ = values["C_SerialNumber"].(string)
+	return device, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func uint32ToIP(address uint32) net.IP {
+	return net.IPv4(byte(address>>24), byte(address>>16), byte(address>>8), byte(address))
+}
+
+func compareIPs(a string, b string) int {
+	ipA, ipB := net.ParseIP(a).To4(), net.ParseIP(b).To4()
+	if ipA == nil || ipB == nil {
+		if a < b {
+			return -1
+		}
+		return 1
+	}
+	switch x, y := ipToUint32(ipA), ipToUint32(ipB); {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
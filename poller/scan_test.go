@@ -0,0 +1,125 @@
+package modbus_test
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+	"github.com/stefannilsson/solaredgedc/simulator"
+)
+
+func TestScanHosts(t *testing.T) {
+	tests := []struct {
+		target string
+		count  int
+		first  string
+		last   string
+	}{
+		{"192.168.0.100", 1, "192.168.0.100", "192.168.0.100"},
+		{"192.168.0.0/24", 254, "192.168.0.1", "192.168.0.254"},
+		{"192.168.0.77/24", 254, "192.168.0.1", "192.168.0.254"}, // host bits ignored
+		{"10.0.0.8/30", 2, "10.0.0.9", "10.0.0.10"},
+		{"10.0.0.8/31", 2, "10.0.0.8", "10.0.0.9"}, // point-to-point, no network & broadcast address
+		{"10.0.0.8/32", 1, "10.0.0.8", "10.0.0.8"},
+		{"172.16.0.0/16", 65534, "172.16.0.1", "172.16.255.254"},
+		{"255.255.255.252/30", 2, "255.255.255.253", "255.255.255.254"}, // end of the address space
+		{"::1", 1, "::1", "::1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			hosts, err := modbus.ScanHosts(test.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hosts) != test.count || hosts[0] != test.first || hosts[len(hosts)-1] != test.last {
+				t.Errorf("%d hosts %s..%s, want %d hosts %s..%s", len(hosts), hosts[0], hosts[len(hosts)-1], test.count, test.first, test.last)
+			}
+		})
+	}
+}
+
+func TestScanHostsErrors(t *testing.T) {
+	tests := []struct {
+		target string
+		err    string
+	}{
+		{"inverter.local", "invalid address or CIDR range"},
+		{"192.168.0.0/33", "invalid address or CIDR range"},
+		{"192.168.0/24", "invalid address or CIDR range"},
+		{"", "invalid address or CIDR range"},
+		{"fd00::/120", "only IPv4 ranges"},
+		{"10.0.0.0/15", "too large"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			hosts, err := modbus.ScanHosts(test.target)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ScanHosts() = %d hosts, %v, want error %q", len(hosts), err, test.err)
+			}
+		})
+	}
+}
+
+func TestScanTooManyHosts(t *testing.T) {
+	if _, err := modbus.Scan([]string{"10.0.0.0/16", "10.1.0.0/29"}, modbus.ScanConfig{}); err == nil || !strings.Contains(err.Error(), "too many hosts") {
+		t.Errorf("error %v, want too many hosts", err)
+	}
+	if _, err := modbus.Scan([]string{"10.0.0.1", "inverter.local"}, modbus.ScanConfig{}); err == nil {
+		t.Error("no error scanning an invalid target")
+	}
+}
+
+func TestScanSimulator(t *testing.T) {
+	sim, err := simulator.New(simulator.Config{Listen: "127.0.0.1:0", UnitId: 3, Model: "SE10K-RW0TEBNN4", Serial: "7E16A12F"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	host, port, _ := net.SplitHostPort(sim.Addr())
+	portNumber, _ := strconv.Atoi(port)
+
+	// Another port of the same host without a listener is skipped.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	found := []modbus.ScannedDevice{}
+	devices, err := modbus.Scan([]string{host + "/32"}, modbus.ScanConfig{
+		Ports:   []int{closedPort, portNumber},
+		UnitIds: []byte{1, 2, 3, 4},
+		Timeout: 200 * time.Millisecond,
+		OnFound: func(device modbus.ScannedDevice) { found = append(found, device) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []modbus.ScannedDevice{{
+		Host:         host,
+		Port:         portNumber,
+		UnitId:       3,
+		BaseAddress:  40000,
+		Manufacturer: simulator.DEFAULT_MANUFACTURER,
+		Model:        "SE10K-RW0TEBNN4",
+		Version:      simulator.DEFAULT_VERSION,
+		Serial:       "7E16A12F",
+	}}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("found %+v, want %+v", devices, want)
+	}
+	if !reflect.DeepEqual(found, devices) {
+		t.Errorf("reported %+v, want %+v", found, devices)
+	}
+}
@@ -0,0 +1,173 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	models "github.com/stefannilsson/solaredgedc/datamodels"
+)
+
+const DEFAULT_HOMEASSISTANT_PREFIX = "homeassistant"
+
+// Home Assistant sensor of a PVSolarReading field, see https://www.home-assistant.io/integrations/sensor.mqtt/
+type homeAssistantSensor struct {
+	field          string // PVSolarReading field, i.e. JSON key of the published reading
+	name           string
+	deviceClass    string
+	stateClass     string
+	unit           string
+	entityCategory string // "diagnostic" for values not of interest on a dashboard
+}
+
+// Published fields of PVSolarReading. Identity fields (serial, manufacturer, model, version) go into the device block.
+var homeAssistantSensors = []homeAssistantSensor{
+	{field: "AC_Current", name: "AC current", deviceClass: "current", stateClass: "measurement", unit: "A"},
+	{field: "AC_Current_L1", name: "AC current L1", deviceClass: "current", stateClass: "measurement", unit: "A"},
+	{field: "AC_Current_L2", name: "AC current L2", deviceClass: "current", stateClass: "measurement", unit: "A"},
+	{field: "AC_Current_L3", name: "AC current L3", deviceClass: "current", stateClass: "measurement", unit: "A"},
+	{field: "AC_Voltage_L1_L2", name: "AC voltage L1-L2", deviceClass: "voltage", stateClass: "measurement", unit: "V"},
+	{field: "AC_Voltage_L2_L3", name: "AC voltage L2-L3", deviceClass: "voltage", stateClass: "measurement", unit: "V"},
+	{field: "AC_Voltage_L3_L1", name: "AC voltage L3-L1", deviceClass: "voltage", stateClass: "measurement", unit: "V"},
+	{field: "AC_Voltage_L1_N", name: "AC voltage L1-N", deviceClass: "voltage", stateClass: "measurement", unit: "V"},
+	{field: "AC_Voltage_L2_N", name: "AC voltage L2-N", deviceClass: "voltage", stateClass: "measurement", unit: "V"},
+	{field: "AC_Voltage_L3_N", name: "AC voltage L3-N", deviceClass: "voltage", stateClass: "measurement", unit: "V"},
+	{field: "AC_Power", name: "AC power", deviceClass: "power", stateClass: "measurement", unit: "W"},
+	{field: "AC_Frequency", name: "AC frequency", deviceClass: "frequency", stateClass: "measurement", unit: "Hz"},
+	{field: "AC_VA", name: "AC apparent power", deviceClass: "apparent_power", stateClass: "measurement", unit: "VA"},
+	{field: "AC_VAR", name: "AC reactive power", deviceClass: "reactive_power", stateClass: "measurement", unit: "var"},
+	{field: "AC_PF", name: "AC power factor", deviceClass: "power_factor", stateClass: "measurement", unit: "%"}, // SunSpec PF is a percentage
+	{field: "AC_Energy_WH", name: "AC energy", deviceClass: "energy", stateClass: "total_increasing", unit: "Wh"},
+	{field: "DC_Current", name: "DC current", deviceClass: "current", stateClass: "measurement", unit: "A"},
+	{field: "DC_Voltage", name: "DC voltage", deviceClass: "voltage", stateClass: "measurement", unit: "V"},
+	{field: "DC_Power", name: "DC power", deviceClass: "power", stateClass: "measurement", unit: "W"},
+	{field: "Temp_Sink", name: "Heat sink temperature", deviceClass: "temperature", stateClass: "measurement", unit: "°C"},
+	{field: "InverterStatusName", name: "Status"},
+	{field: "InverterStatus", name: "Status code", entityCategory: "diagnostic"},
+	{field: "InverterStatusVendor", name: "Vendor status code", entityCategory: "diagnostic"},
+	{field: "InverterStatusVendorDescription", name: "Vendor status", entityCategory: "diagnostic"},
+	{field: "PhaseConfiguration", name: "SunSpec inverter model", entityCategory: "diagnostic"},
+	{field: "SuppressedValues", name: "Suppressed values", stateClass: "measurement", entityCategory: "diagnostic"},
+}
+
+// Discovery config payload (abbreviations are avoided for readability).
+type homeAssistantConfig struct {
+	Name              string                      `json:"name"`
+	UniqueId          string                      `json:"unique_id"`
+	ObjectId          string                      `json:"object_id"`
+	StateTopic        string                      `json:"state_topic"`
+	ValueTemplate     string                      `json:"value_template"`
+	DeviceClass       string                      `json:"device_class,omitempty"`
+	StateClass        string                      `json:"state_class,omitempty"`
+	UnitOfMeasurement string                      `json:"unit_of_measurement,omitempty"`
+	EntityCategory    string                      `json:"entity_category,omitempty"`
+	Availability      []homeAssistantAvailability `json:"availability,omitempty"`
+	AvailabilityMode  string                      `json:"availability_mode,omitempty"`
+	Device            homeAssistantDevice         `json:"device"`
+}
+
+type homeAssistantAvailability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+}
+
+type homeAssistantDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SwVersion    string   `json:"sw_version,omitempty"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+}
+
+type HomeAssistantTopics struct {
+	Prefix            string // discovery prefix, e.g. 'homeassistant'
+	StateTopic        string // topic of the published PVSolarReading JSON
+	AvailabilityTopic string // collector 'online'/'offline', optional
+	ModbusStatusTopic string // device Modbus 'connected'/'disconnected' (modbus.ConnectionState), optional
+}
+
+var regexpUnsafeId = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+/*
+	Discovery configs of all sensors of an inverter, keyed by config topic '{prefix}/sensor/{serial}/{field}/config'.
+	Returns an error if the reading lacks a serial number, as it identifies the device in Home Assistant.
+*/
+func HomeAssistantDiscovery(topics *HomeAssistantTopics, reading *models.PVSolarReading) (map[string][]byte, error) {
+	if reading == nil || reading.MeterId == nil || strings.TrimSpace(*reading.MeterId) == "" {
+		return nil, fmt.Errorf("home assistant discovery: inverter serial number unknown")
+	}
+	serial := regexpUnsafeId.ReplaceAllString(*reading.MeterId, "_")
+
+	device := homeAssistantDevice{
+		Identifiers:  []string{fmt.Sprintf("solaredgedc_%s", serial)},
+		Name:         fmt.Sprintf("SolarEdge %s", *reading.MeterId),
+		Manufacturer: stringValue(reading.Manufacturer),
+		Model:        stringValue(reading.Model),
+		SwVersion:    stringValue(reading.Version),
+		SerialNumber: *reading.MeterId,
+	}
+	if reading.Model != nil {
+		device.Name = fmt.Sprintf("%s (%s)", *reading.Model, *reading.MeterId)
+	}
+
+	availability := []homeAssistantAvailability{}
+	if topics.AvailabilityTopic != "" {
+		availability = append(availability, homeAssistantAvailability{Topic: topics.AvailabilityTopic, PayloadAvailable: AVAILABILITY_ONLINE, PayloadNotAvailable: AVAILABILITY_OFFLINE})
+	}
+	if topics.ModbusStatusTopic != "" {
+		availability = append(availability, homeAssistantAvailability{Topic: topics.ModbusStatusTopic, PayloadAvailable: "connected", PayloadNotAvailable: "disconnected"})
+	}
+
+	configs := map[string][]byte{}
+	for _, sensor := range homeAssistantSensors {
+		objectId := fmt.Sprintf("solaredgedc_%s_%s", serial, strings.ToLower(sensor.field))
+		config := homeAssistantConfig{
+			Name:              sensor.name,
+			UniqueId:          objectId,
+			ObjectId:          objectId,
+			StateTopic:        topics.StateTopic,
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", sensor.field),
+			DeviceClass:       sensor.deviceClass,
+			StateClass:        sensor.stateClass,
+			UnitOfMeasurement: sensor.unit,
+			EntityCategory:    sensor.entityCategory,
+			Availability:      availability,
+			Device:            device,
+		}
+		if len(availability) > 1 {
+			config.AvailabilityMode = "all"
+		}
+
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return nil, fmt.Errorf("home assistant discovery of '%s': %w", sensor.field, err)
+		}
+		configs[fmt.Sprintf("%s/sensor/%s/%s/config", topics.Prefix, serial, strings.ToLower(sensor.field))] = payload
+	}
+
+	return configs, nil
+}
+
+// Publish the (retained) discovery configs of an inverter.
+func PublishHomeAssistantDiscovery(client MQTT.Client, qos byte, topics *HomeAssistantTopics, reading *models.PVSolarReading) error {
+	configs, err := HomeAssistantDiscovery(topics, reading)
+	if err != nil {
+		return err
+	}
+
+	for topic, payload := range configs {
+		client.Publish(topic, qos, true, payload)
+	}
+	return nil
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
@@ -0,0 +1,244 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const INFLUX_HTTP_TIMEOUT = 10 * time.Second
+
+type InfluxConfig struct {
+	// 'http(s)://host:8086' (v2 write API), 'udp://host:8089' or 'file:///path/to/readings.lp'
+	URL string
+
+	// v2 write API only
+	Org    string
+	Bucket string
+	Token  string
+}
+
+/*
+	Writes readings as InfluxDB line protocol, one line per reading: the exported (non-nil) fields of the reading
+	become fields, 'MeterId'/'BatteryId' the 'serial' tag and 'Time' (unix ms) the timestamp.
+*/
+type InfluxWriter struct {
+	lock   sync.Mutex
+	config InfluxConfig
+	write  func(lines []byte) error
+	close  func() error
+}
+
+func NewInfluxWriter(config *InfluxConfig) (*InfluxWriter, error) {
+	target, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("influx: invalid URL '%s': %w", config.URL, err)
+	}
+
+	writer := &InfluxWriter{config: *config, close: func() error { return nil }}
+
+	switch target.Scheme {
+	case "http", "https":
+		writeURL := *target
+		writeURL.Path = strings.TrimRight(writeURL.Path, "/") + "/api/v2/write"
+		writeURL.RawQuery = url.Values{"org": {config.Org}, "bucket": {config.Bucket}, "precision": {"ns"}}.Encode()
+		client := &http.Client{Timeout: INFLUX_HTTP_TIMEOUT}
+		writer.write = func(lines []byte) error {
+			return writeHTTP(client, writeURL.String(), config.Token, lines)
+		}
+
+	case "udp":
+		conn, err := net.Dial("udp", target.Host)
+		if err != nil {
+			return nil, fmt.Errorf("influx: %w", err)
+		}
+		writer.write = func(lines []byte) error {
+			_, err := conn.Write(lines)
+			return err
+		}
+		writer.close = conn.Close
+
+	case "file":
+		file, err := os.OpenFile(target.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("influx: %w", err)
+		}
+		writer.write = func(lines []byte) error {
+			_, err := file.Write(lines)
+			return err
+		}
+		writer.close = file.Close
+
+	default:
+		return nil, fmt.Errorf("influx: unsupported URL scheme '%s', expected one of http, https, udp, file", target.Scheme)
+	}
+
+	return writer, nil
+}
+
+func writeHTTP(client *http.Client, writeURL string, token string, lines []byte) error {
+	request, err := http.NewRequest(http.MethodPost, writeURL, bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token != "" {
+		request.Header.Set("Authorization", "Token "+token)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("influx: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("influx: write failed with %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Write a reading (pointer to a reading struct) to the given measurement, readings without any values are skipped.
+func (writer *InfluxWriter) Write(measurement string, tags map[string]string, reading interface{}) error {
+	line, ok := LineProtocol(measurement, tags, reading)
+	if !ok {
+		return nil
+	}
+
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.write([]byte(line))
+}
+
+// Measurement of each kind of reading.
+var influxMeasurements = map[string]string{
+	KIND_INVERTER: "solaredge_inverter",
+	KIND_METER:    "solaredge_meter",
+	KIND_BATTERY:  "solaredge_battery",
+}
+
+// Write inverter, meter & battery readings, tagged by device (and meter/battery index). Events are left out.
+func (writer *InfluxWriter) Publish(reading Reading) error {
+	measurement, found := influxMeasurements[reading.Kind]
+	if !found {
+		return nil
+	}
+
+	tags := map[string]string{"device": reading.Device}
+	if reading.Kind == KIND_METER || reading.Kind == KIND_BATTERY {
+		tags[reading.Kind] = strconv.Itoa(reading.Index)
+	}
+	return writer.Write(measurement, tags, reading.Value)
+}
+
+func (writer *InfluxWriter) Close() error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.close()
+}
+
+/*
+	Line protocol of a reading: 'measurement,serial=...,{tags} field=value,... timestamp(ns)\n'.
+	Returns false if the reading has no (non-nil) values.
+*/
+func LineProtocol(measurement string, tags map[string]string, reading interface{}) (string, bool) {
+	value := reflect.ValueOf(reading)
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return "", false
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return "", false
+	}
+
+	allTags := map[string]string{}
+	for key, tag := range tags {
+		allTags[key] = tag
+	}
+
+	fields := []string{}
+	var timestamp *int64
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		field := value.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() {
+			continue
+		}
+
+		switch v := field.Interface().(type) {
+		case *int64:
+			if name == "Time" {
+				timestamp = v
+				continue
+			}
+			fields = append(fields, fmt.Sprintf("%s=%di", escapeKey(name), *v))
+		case *string:
+			if name == "MeterId" || name == "BatteryId" {
+				allTags["serial"] = *v
+				continue
+			}
+			fields = append(fields, fmt.Sprintf(`%s="%s"`, escapeKey(name), fieldStringEscaper.Replace(*v)))
+		case *float64:
+			fields = append(fields, fmt.Sprintf("%s=%s", escapeKey(name), strconv.FormatFloat(*v, 'f', -1, 64)))
+		case *uint16:
+			fields = append(fields, fmt.Sprintf("%s=%di", escapeKey(name), *v))
+		case *uint32:
+			fields = append(fields, fmt.Sprintf("%s=%di", escapeKey(name), *v))
+		case *uint64:
+			// as float, integers ('i') overflow above MaxInt64 and unsigned integers ('u') aren't supported by InfluxDB 1.x
+			fields = append(fields, fmt.Sprintf("%s=%s", escapeKey(name), strconv.FormatFloat(float64(*v), 'f', -1, 64)))
+		case *int:
+			fields = append(fields, fmt.Sprintf("%s=%di", escapeKey(name), *v))
+		}
+	}
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	var line strings.Builder
+	line.WriteString(measurementEscaper.Replace(measurement))
+
+	keys := make([]string, 0, len(allTags))
+	for key := range allTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// empty tag values are not allowed
+		if allTags[key] == "" {
+			continue
+		}
+		fmt.Fprintf(&line, ",%s=%s", escapeKey(key), escapeKey(allTags[key]))
+	}
+
+	line.WriteString(" ")
+	line.WriteString(strings.Join(fields, ","))
+	if timestamp != nil {
+		fmt.Fprintf(&line, " %d", *timestamp*int64(time.Millisecond))
+	}
+	line.WriteString("\n")
+
+	return line.String(), true
+}
+
+var measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+var keyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+var fieldStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Escape tag keys, tag values and field keys.
+func escapeKey(key string) string {
+	return keyEscaper.Replace(key)
+}
@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"math"
+	"testing"
+)
+
+type lineProtocolReading struct {
+	MeterId  *string
+	Power    *float64
+	Status   *uint16
+	Energy   *uint64
+	Count    *int
+	Name     *string
+	Missing  *float64
+	Index    int // not a pointer, not written
+	Time     *int64
+	Sequence *int64
+}
+
+func TestLineProtocol(t *testing.T) {
+	serial, power, status, count, sequence := "7E16A12F", 2354.2, uint16(4), 3, int64(7)
+	energy := uint64(math.MaxUint64)
+	name := `say "hi" \ bye`
+	timestamp := int64(1601979914123)
+
+	tests := []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		reading     interface{}
+		want        string
+		written     bool
+	}{
+		{
+			name:        "fields, serial tag and timestamp in ns",
+			measurement: "solaredge_inverter",
+			reading:     &lineProtocolReading{MeterId: &serial, Power: &power, Status: &status, Count: &count, Time: &timestamp},
+			want:        "solaredge_inverter,serial=7E16A12F Power=2354.2,Status=4i,Count=3i 1601979914123000000\n",
+			written:     true,
+		},
+		{
+			name:        "tags sorted, empty tags left out",
+			measurement: "solaredge_meter",
+			tags:        map[string]string{"meter": "1", "device": "", "alias": "leader"},
+			reading:     lineProtocolReading{MeterId: &serial, Power: &power},
+			want:        "solaredge_meter,alias=leader,meter=1,serial=7E16A12F Power=2354.2\n",
+			written:     true,
+		},
+		{
+			name:        "escaping",
+			measurement: "solar edge,inverter",
+			tags:        map[string]string{"de vice": "lead=er,1"},
+			reading:     &lineProtocolReading{Name: &name},
+			want:        `solar\ edge\,inverter,de\ vice=lead\=er\,1 Name="say \"hi\" \\ bye"` + "\n",
+			written:     true,
+		},
+		{
+			name:        "uint64 beyond MaxInt64 as float",
+			measurement: "solaredge_battery",
+			reading:     &lineProtocolReading{Energy: &energy},
+			want:        "solaredge_battery Energy=18446744073709552000\n",
+			written:     true,
+		},
+		{
+			name:        "int64 fields other than Time",
+			measurement: "m",
+			reading:     &lineProtocolReading{Sequence: &sequence},
+			want:        "m Sequence=7i\n",
+			written:     true,
+		},
+		{
+			name:        "no values",
+			measurement: "m",
+			reading:     &lineProtocolReading{MeterId: &serial, Index: 1, Time: &timestamp},
+		},
+		{
+			name:        "nil reading",
+			measurement: "m",
+			reading:     (*lineProtocolReading)(nil),
+		},
+		{
+			name:        "no struct",
+			measurement: "m",
+			reading:     "reading",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line, written := LineProtocol(test.measurement, test.tags, test.reading)
+			if written != test.written || line != test.want {
+				t.Errorf("LineProtocol() = %q, %t, want %q, %t", line, written, test.want, test.written)
+			}
+		})
+	}
+}
@@ -1,8 +1,20 @@
 package mqtt
 
 import (
+	"fmt"
+	"os"
+	"time"
+
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	mapping "github.com/stefannilsson/solaredgedc/datamapping"
 	"github.com/stefannilsson/solaredgedc/logger"
+	"github.com/stefannilsson/solaredgedc/metrics"
+)
+
+// Retained payloads of the availability topic.
+const (
+	AVAILABILITY_ONLINE  = "online"  // birth message, published on every (re)connect
+	AVAILABILITY_OFFLINE = "offline" // last will, published by the broker if the connection is lost, or on shutdown
 )
 
 type MqttConfig struct {
@@ -15,10 +27,19 @@ type MqttConfig struct {
 	Qos          int
 	Topic        string
 	PollInterval int
+	TLS          TLSConfig
+
+	// Retained 'online'/'offline' status of the collector, disabled if empty.
+	AvailabilityTopic string
+
+	// Directory of the durable outbound buffer, in-memory if empty.
+	StoreDirectory   string
+	StoreMaxMessages int
+	StoreMaxAge      time.Duration // 0 = unlimited
 }
 
 func NewTelemetryMqtt(mqttConfig *MqttConfig) MQTT.Client {
-	errorLog, _, _ := logger.GetLoggers("mqtt")
+	errorLog, infoLog, _ := logger.GetLoggers("mqtt")
 
 	opts := MQTT.NewClientOptions()
 	opts.AddBroker(mqttConfig.URI)
@@ -26,16 +47,137 @@ func NewTelemetryMqtt(mqttConfig *MqttConfig) MQTT.Client {
 	opts.SetUsername(mqttConfig.Username)
 	opts.SetPassword(mqttConfig.Password)
 	opts.SetCleanSession(mqttConfig.CleanSession)
-	//TODO: Implement (optional) file based buffer
-	/*if *store != ":memory:" {
-		opts.SetStore(MQTT.NewFileStore(*store))
-	}*/
+	if mqttConfig.TLS.IsSet() {
+		tlsConfig, err := NewTLSConfig(&mqttConfig.TLS)
+		if err != nil {
+			errorLog.Errorln(err)
+			panic(err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	/*
+		Durable buffer: QoS 1/2 messages are kept on disk until acknowledged, and resumed after a restart. This requires
+		a persistent session (as a clean session resets the store on connect), and to keep retrying the initial connect
+		so that readings are buffered while the broker is down on startup.
+	*/
+	var store *BoundedStore
+	if mqttConfig.StoreDirectory != "" {
+		if err := os.MkdirAll(mqttConfig.StoreDirectory, 0770); err != nil {
+			errorLog.Errorln(err)
+			panic(err)
+		}
+		store = NewBoundedStore(mqttConfig.StoreDirectory, mqttConfig.StoreMaxMessages, mqttConfig.StoreMaxAge)
+		metrics.Default.Collect(store.collect)
+		opts.SetStore(store)
+		opts.SetCleanSession(false)
+		opts.SetConnectRetry(true)
+	}
+
+	if mqttConfig.AvailabilityTopic != "" {
+		opts.SetWill(mqttConfig.AvailabilityTopic, AVAILABILITY_OFFLINE, byte(mqttConfig.Qos), true)
+	}
+	connects := 0
+	opts.SetOnConnectHandler(func(client MQTT.Client) {
+		if connects++; connects > 1 {
+			metrics.Default.AddCounter("solaredgedc_mqtt_reconnects_total", "MQTT reconnects after a lost connection", nil, 1)
+		}
+		if store != nil {
+			infoLog.Printf("MQTT connection established, resuming %d buffered message(s).", store.Backlog())
+		} else {
+			infoLog.Println("MQTT connection established.")
+		}
+		if mqttConfig.AvailabilityTopic != "" {
+			client.Publish(mqttConfig.AvailabilityTopic, byte(mqttConfig.Qos), true, AVAILABILITY_ONLINE)
+		}
+		resubscribe(client)
+	})
+	opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+		errorLog.Errorf("MQTT connection lost: %v", err)
+	})
 
 	client := MQTT.NewClient(opts)
+	if store != nil {
+		// completes once connected, readings are buffered until then.
+		client.Connect()
+		if expired := store.Expired(); expired > 0 {
+			errorLog.Errorf("Expired %d buffered message(s) older than %v.", expired, mqttConfig.StoreMaxAge)
+		}
+		return &bufferedClient{Client: client, store: store}
+	}
+
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		errorLog.Println(token.Error())
+		errorLog.Errorln(token.Error())
 		panic(token.Error())
 	}
 
 	return client
 }
+
+/*
+	Gracefully disconnect, publishing the 'offline' availability first, as the broker only publishes the
+	last will if the connection is lost.
+*/
+func Disconnect(client MQTT.Client, mqttConfig *MqttConfig, quiesce uint) {
+	if mqttConfig.AvailabilityTopic != "" {
+		client.Publish(mqttConfig.AvailabilityTopic, byte(mqttConfig.Qos), true, AVAILABILITY_OFFLINE).WaitTimeout(time.Duration(quiesce) * time.Millisecond)
+	}
+	client.Disconnect(quiesce)
+}
+
+// Publishes readings as JSON to '{topic}[/{device}]', events to '.../event', meters & batteries to '.../meter/{n}' & '.../battery/{n}'.
+type MqttPublisher struct {
+	client     MQTT.Client
+	mqttConfig *MqttConfig
+}
+
+func NewMqttPublisher(client MQTT.Client, mqttConfig *MqttConfig) *MqttPublisher {
+	return &MqttPublisher{client: client, mqttConfig: mqttConfig}
+}
+
+// MQTT topic of a device: '{topic}' for the default (unnamed) device, otherwise '{topic}/{alias}'.
+func DeviceTopic(topic string, alias string) string {
+	if alias == "" {
+		return topic
+	}
+	return fmt.Sprintf("%s/%s", topic, alias)
+}
+
+func ReadingTopic(topic string, reading Reading) string {
+	deviceTopic := DeviceTopic(topic, reading.Device)
+	switch reading.Kind {
+	case KIND_EVENT:
+		return fmt.Sprintf("%s/event", deviceTopic)
+	case KIND_METER, KIND_BATTERY:
+		return fmt.Sprintf("%s/%s/%d", deviceTopic, reading.Kind, reading.Index)
+	default:
+		return deviceTopic
+	}
+}
+
+/*
+	Serialize a reading to JSON and publish it. Publishes are acknowledged asynchronously (if at all, while the
+	broker is down the message is buffered), failures are counted once they complete.
+*/
+func (publisher *MqttPublisher) Publish(reading Reading) error {
+	json, err := mapping.SerializeToJson(reading.Value)
+	if err != nil {
+		return err
+	}
+
+	topic := ReadingTopic(publisher.mqttConfig.Topic, reading)
+	token := publisher.client.Publish(topic, byte(publisher.mqttConfig.Qos), false, json)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			metrics.Default.AddCounter("solaredgedc_publish_errors_total", "Failed publishes per sink", metrics.Labels{"sink": "mqtt"}, 1)
+			_, _, debugLog := logger.GetLoggers("mqtt")
+			debugLog.Debugf("Failed to publish to '%s': %v", topic, token.Error())
+		}
+	}()
+	return nil
+}
+
+func (publisher *MqttPublisher) Close() error {
+	Disconnect(publisher.client, publisher.mqttConfig, 500)
+	return nil
+}
@@ -0,0 +1,166 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stefannilsson/solaredgedc/logger"
+	"github.com/stefannilsson/solaredgedc/metrics"
+)
+
+// Kinds of readings
+const (
+	KIND_INVERTER = "inverter" // *models.PVSolarReading
+	KIND_EVENT    = "event"    // *models.InverterStatusEvent
+	KIND_METER    = "meter"    // *models.MeterReading
+	KIND_BATTERY  = "battery"  // *models.BatteryReading
+)
+
+const (
+	SINK_QUEUE_SIZE     = 100             // readings queued per sink, newer readings are dropped while full
+	SINK_CLOSE_TIMEOUT  = 5 * time.Second // time given to sinks to drain their queue on shutdown
+	SINK_ERROR_INTERVAL = 1 * time.Minute // log repeating errors of a sink at most once per interval
+)
+
+// A reading of a device, as published to all sinks.
+type Reading struct {
+	Kind   string
+	Device string // alias of the Modbus device, "" for the default device
+	Index  int    // meter/battery index, 0 otherwise
+	Value  interface{}
+}
+
+// Output of readings, e.g. MQTT or InfluxDB.
+type Publisher interface {
+	Publish(reading Reading) error
+	Close() error
+}
+
+// A publisher with its own queue & goroutine, so that a slow or failing sink doesn't hold up others (or the poll loop).
+type sink struct {
+	name      string
+	publisher Publisher
+	queue     chan Reading
+	done      chan struct{}
+	lastError time.Time
+}
+
+/*
+	Fans out every reading to all registered publishers concurrently. Errors are isolated per sink: they are
+	logged and counted ('solaredgedc_publish_errors_total'), and readings are dropped for a sink that can't keep up
+	('solaredgedc_publish_dropped_total').
+*/
+type Registry struct {
+	lock     sync.RWMutex
+	sinks    []*sink
+	blocking bool
+
+	closing   chan struct{} // closed once closing, to release blocked publishes
+	closeOnce sync.Once
+}
+
+func NewRegistry() *Registry {
+	return &Registry{closing: make(chan struct{})}
+}
+
+func (registry *Registry) Add(name string, publisher Publisher) {
+	s := &sink{name: name, publisher: publisher, queue: make(chan Reading, SINK_QUEUE_SIZE), done: make(chan struct{})}
+	go s.run()
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.sinks = append(registry.sinks, s)
+}
+
+/*
+	Wait for room in the sinks' queues instead of dropping readings, e.g. when replaying a recording as fast as
+	possible. A sink that can't keep up then holds up polling (until the registry is closed).
+*/
+func (registry *Registry) SetBlocking(blocking bool) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.blocking = blocking
+}
+
+// Queue a reading for all sinks, never blocks (unless set to, see SetBlocking).
+func (registry *Registry) Publish(reading Reading) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	for _, s := range registry.sinks {
+		if registry.blocking {
+			select {
+			case s.queue <- reading:
+			case <-registry.closing:
+				return
+			}
+			continue
+		}
+		select {
+		case s.queue <- reading:
+		default:
+			metrics.Default.AddCounter("solaredgedc_publish_dropped_total", "Readings dropped as a sink couldn't keep up", metrics.Labels{"sink": s.name}, 1)
+		}
+	}
+}
+
+// Let all sinks drain their queue (within SINK_CLOSE_TIMEOUT) and close them.
+func (registry *Registry) Close() {
+	// A blocked publish holds the lock, release it first.
+	registry.closeOnce.Do(func() { close(registry.closing) })
+
+	registry.lock.Lock()
+	sinks := registry.sinks
+	registry.sinks = nil
+	registry.lock.Unlock()
+
+	timeout := time.After(SINK_CLOSE_TIMEOUT)
+	for _, s := range sinks {
+		close(s.queue)
+		select {
+		case <-s.done:
+		case <-timeout:
+		}
+	}
+
+	for _, s := range sinks {
+		if err := s.publisher.Close(); err != nil {
+			errorLog, _, _ := logger.GetLoggers("publisher")
+			errorLog.Errorf("Failed to close %s: %v", s.name, err)
+		}
+	}
+}
+
+func (s *sink) run() {
+	defer close(s.done)
+	for reading := range s.queue {
+		s.publish(reading)
+	}
+}
+
+func (s *sink) publish(reading Reading) {
+	// a panicking sink must not take down the collector.
+	defer func() {
+		if r := recover(); r != nil {
+			s.failed(fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	if err := s.publisher.Publish(reading); err != nil {
+		s.failed(err)
+	}
+}
+
+func (s *sink) failed(err error) {
+	metrics.Default.AddCounter("solaredgedc_publish_errors_total", "Failed publishes per sink", metrics.Labels{"sink": s.name}, 1)
+
+	if time.Since(s.lastError) >= SINK_ERROR_INTERVAL {
+		s.lastError = time.Now()
+		errorLog, _, _ := logger.GetLoggers("publisher")
+		errorLog.Errorf("Failed to publish to %s: %v", s.name, err)
+	} else {
+		_, _, debugLog := logger.GetLoggers("publisher")
+		debugLog.Debugf("Failed to publish to %s: %v", s.name, err)
+	}
+}
@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+// A sink that stops draining, until released.
+type stuckPublisher struct {
+	release chan struct{}
+}
+
+func (publisher *stuckPublisher) Publish(reading Reading) error {
+	<-publisher.release
+	return nil
+}
+
+func (publisher *stuckPublisher) Close() error {
+	return nil
+}
+
+func TestRegistryCloseReleasesBlockedPublish(t *testing.T) {
+	stuck := &stuckPublisher{release: make(chan struct{})}
+	registry := NewRegistry()
+	registry.Add("stuck", stuck)
+	registry.SetBlocking(true)
+
+	// One reading taken by the sink, a full queue, and one waiting for room.
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < SINK_QUEUE_SIZE+2; i++ {
+			registry.Publish(Reading{Kind: KIND_INVERTER})
+		}
+	}()
+	select {
+	case <-published:
+		t.Fatal("publish didn't block on a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		registry.Close()
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("blocked publish not released by Close")
+	}
+
+	// Close drains the sink once it's released, rather than waiting for SINK_CLOSE_TIMEOUT.
+	close(stuck.release)
+	select {
+	case <-closed:
+	case <-time.After(SINK_CLOSE_TIMEOUT / 2):
+		t.Fatal("Close didn't return")
+	}
+
+	// Closed, publishes are dropped.
+	registry.Publish(Reading{Kind: KIND_INVERTER})
+}
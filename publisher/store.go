@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stefannilsson/solaredgedc/logger"
+	"github.com/stefannilsson/solaredgedc/metrics"
+)
+
+const (
+	DEFAULT_STORE_MAX_MESSAGES = 10000 // ~14h of readings of a single inverter at the default poll interval
+	MAX_STORE_MESSAGES         = 65000 // stored QoS 1/2 messages each hold one of the 65535 MQTT message ids
+)
+
+var ErrStoreFull = errors.New("MQTT store full, message dropped")
+
+/*
+	Durable outbound buffer: Paho's file store (one file per in-flight QoS 1/2 message, surviving restarts and
+	broker downtime), capped by number of messages and age.
+
+	The number of messages is capped by refusing new publishes once full (see bufferedClient), rather than
+	dropping stored messages, as Paho keeps the message id of every stored message reserved until acknowledged.
+	For the same reason, messages older than the max age are only expired when the store is opened on startup, a
+	long broker outage without restart still delivers every buffered message (see the MQTT_STORE_MAX_AGE docs).
+*/
+type BoundedStore struct {
+	*MQTT.FileStore
+	directory   string
+	maxMessages int
+	maxAge      time.Duration // 0 = unlimited
+
+	lock     sync.Mutex
+	outbound map[string]bool // keys of stored outbound messages
+	dropped  uint64
+	expired  uint64
+}
+
+func NewBoundedStore(directory string, maxMessages int, maxAge time.Duration) *BoundedStore {
+	return &BoundedStore{
+		FileStore:   MQTT.NewFileStore(directory),
+		directory:   directory,
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+		outbound:    map[string]bool{},
+	}
+}
+
+func (store *BoundedStore) Open() {
+	store.FileStore.Open()
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.outbound = map[string]bool{}
+	for _, key := range store.FileStore.All() {
+		if store.maxAge > 0 && isOutbound(key) && store.age(key) > store.maxAge {
+			store.FileStore.Del(key)
+			store.expired++
+			continue
+		}
+		if isOutbound(key) {
+			store.outbound[key] = true
+		}
+	}
+}
+
+func (store *BoundedStore) Put(key string, message packets.ControlPacket) {
+	store.FileStore.Put(key, message)
+
+	if isOutbound(key) {
+		store.lock.Lock()
+		store.outbound[key] = true
+		store.lock.Unlock()
+	}
+}
+
+func (store *BoundedStore) Del(key string) {
+	store.FileStore.Del(key)
+
+	store.lock.Lock()
+	delete(store.outbound, key)
+	store.lock.Unlock()
+}
+
+func (store *BoundedStore) Reset() {
+	store.FileStore.Reset()
+
+	store.lock.Lock()
+	store.outbound = map[string]bool{}
+	store.lock.Unlock()
+}
+
+// Number of outbound messages not (yet) acknowledged by the broker.
+func (store *BoundedStore) Backlog() int {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return len(store.outbound)
+}
+
+func (store *BoundedStore) Full() bool {
+	return store.Backlog() >= store.maxMessages
+}
+
+// Number of messages dropped as the store was full, and expired on startup.
+func (store *BoundedStore) Dropped() uint64 {
+	return atomic.LoadUint64(&store.dropped)
+}
+
+func (store *BoundedStore) Expired() uint64 {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.expired
+}
+
+func (store *BoundedStore) drop() {
+	atomic.AddUint64(&store.dropped, 1)
+}
+
+// Export the store's state on every scrape.
+func (store *BoundedStore) collect(registry *metrics.Registry) {
+	registry.SetGauge("solaredgedc_mqtt_store_backlog", "Buffered MQTT messages waiting for the broker's acknowledgement", nil, float64(store.Backlog()))
+	registry.SetGauge("solaredgedc_mqtt_store_capacity", "Max number of buffered MQTT messages", nil, float64(store.maxMessages))
+	registry.SetCounter("solaredgedc_mqtt_store_dropped_total", "MQTT messages dropped as the buffer was full", nil, float64(store.Dropped()))
+	registry.SetCounter("solaredgedc_mqtt_store_expired_total", "Buffered MQTT messages expired on startup", nil, float64(store.Expired()))
+}
+
+// Age of a stored message, by the modification time of its file (Paho stores messages as '{key}.msg').
+func (store *BoundedStore) age(key string) time.Duration {
+	info, err := os.Stat(filepath.Join(store.directory, key+".msg"))
+	if err != nil {
+		return 0
+	}
+	return time.Since(info.ModTime())
+}
+
+// Paho prefixes keys of outbound messages with "o.", inbound with "i."
+func isOutbound(key string) bool {
+	return strings.HasPrefix(key, "o.")
+}
+
+// Client refusing QoS 1/2 publishes while the store is full. QoS 0 messages are never stored.
+type bufferedClient struct {
+	MQTT.Client
+	store *BoundedStore
+	full  int32 // 1 while publishes are refused, to log transitions only
+}
+
+func (client *bufferedClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	if qos > 0 && client.store.Full() {
+		client.store.drop()
+		if atomic.CompareAndSwapInt32(&client.full, 0, 1) {
+			errorLog, _, _ := logger.GetLoggers("mqtt")
+			errorLog.Errorf("MQTT store full (%d messages), dropping new messages until the broker is reachable again.", client.store.maxMessages)
+		}
+		return &failedToken{err: ErrStoreFull}
+	}
+	if atomic.CompareAndSwapInt32(&client.full, 1, 0) {
+		_, infoLog, _ := logger.GetLoggers("mqtt")
+		infoLog.Printf("MQTT store accepting messages again, %d message(s) dropped in total.", client.store.Dropped())
+	}
+	return client.Client.Publish(topic, qos, retained, payload)
+}
+
+// Completed token of a publish that never reached Paho.
+type failedToken struct {
+	err error
+}
+
+func (token *failedToken) Wait() bool                     { return true }
+func (token *failedToken) WaitTimeout(time.Duration) bool { return true }
+func (token *failedToken) Error() error                   { return token.err }
+func (token *failedToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
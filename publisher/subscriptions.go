@@ -0,0 +1,50 @@
+package mqtt
+
+import (
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stefannilsson/solaredgedc/logger"
+)
+
+type subscription struct {
+	qos     byte
+	handler MQTT.MessageHandler
+}
+
+// Subscriptions by topic, made again on every (re)connect as a clean session drops them with the connection.
+var subscriptions = map[string]subscription{}
+var subscriptionsLock sync.Mutex
+
+// Subscribe to a topic, now if connected, and again after every reconnect.
+func Subscribe(client MQTT.Client, topic string, qos byte, handler MQTT.MessageHandler) {
+	subscriptionsLock.Lock()
+	subscriptions[topic] = subscription{qos: qos, handler: handler}
+	subscriptionsLock.Unlock()
+
+	if client.IsConnectionOpen() {
+		subscribe(client, topic, qos, handler)
+	}
+}
+
+func resubscribe(client MQTT.Client) {
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+
+	for topic, s := range subscriptions {
+		subscribe(client, topic, s.qos, s.handler)
+	}
+}
+
+func subscribe(client MQTT.Client, topic string, qos byte, handler MQTT.MessageHandler) {
+	errorLog, infoLog, _ := logger.GetLoggers("mqtt")
+
+	token := client.Subscribe(topic, qos, handler)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			errorLog.Errorf("Failed to subscribe to '%s': %v", topic, token.Error())
+			return
+		}
+		infoLog.Printf("Subscribed to '%s'.", topic)
+	}()
+}
@@ -0,0 +1,79 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Supported minimum TLS versions, as configured (e.g. "1.2").
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+const DEFAULT_TLS_MIN_VERSION = "1.2"
+
+type TLSConfig struct {
+	CAFile             string // PEM encoded CA certificate(s) to verify the broker with, system roots if empty
+	CertFile           string // PEM encoded client certificate, for mutual TLS
+	KeyFile            string // PEM encoded client private key, for mutual TLS
+	ServerName         string // expected broker certificate name, if different from the broker URI's host
+	MinVersion         string // {1.0, 1.1, 1.2, 1.3} (default 1.2)
+	InsecureSkipVerify bool   // don't verify the broker certificate (self-signed brokers, testing only)
+}
+
+// Whether any TLS setting is given, i.e. the default system settings don't suffice.
+func (config *TLSConfig) IsSet() bool {
+	return config.CAFile != "" || config.CertFile != "" || config.KeyFile != "" ||
+		config.ServerName != "" || config.MinVersion != "" || config.InsecureSkipVerify
+}
+
+// Whether the given minimum TLS version is supported, an empty version selects the default.
+func IsValidTLSVersion(version string) bool {
+	_, found := tlsVersions[version]
+	return found || version == ""
+}
+
+// Build the crypto/tls configuration, loading the CA and client certificate files.
+func NewTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	minVersion := config.MinVersion
+	if minVersion == "" {
+		minVersion = DEFAULT_TLS_MIN_VERSION
+	}
+	version, found := tlsVersions[minVersion]
+	if !found {
+		return nil, fmt.Errorf("unsupported minimum TLS version '%s'", config.MinVersion)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         version,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file '%s': no PEM encoded certificates found", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,39 @@
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	mapping "github.com/stefannilsson/solaredgedc/datamapping"
+)
+
+/*
+	Writes readings as '{topic} {json}' lines (the MQTT topic and payload they would be published with), e.g. to
+	stdout when replaying a recording without a broker.
+*/
+type WriterPublisher struct {
+	lock   sync.Mutex
+	writer io.Writer
+	topic  string
+}
+
+func NewWriterPublisher(writer io.Writer, topic string) *WriterPublisher {
+	return &WriterPublisher{writer: writer, topic: topic}
+}
+
+func (publisher *WriterPublisher) Publish(reading Reading) error {
+	json, err := mapping.SerializeToJson(reading.Value)
+	if err != nil {
+		return err
+	}
+
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	_, err = fmt.Fprintf(publisher.writer, "%s %s\n", ReadingTopic(publisher.topic, reading), json)
+	return err
+}
+
+func (publisher *WriterPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	logger "github.com/stefannilsson/solaredgedc/logger"
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+)
+
+/*
+	'scan' subcommand: find SunSpec devices (inverters, meters behind their own unit id, ...) on a subnet, e.g.
+	'solaredgedc scan 192.168.0.0/24', and print their host, port, unit id & common block as table or JSON.
+*/
+func RunScan(args []string) int {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: solaredgedc scan [flags] CIDR|IP ...")
+		flags.PrintDefaults()
+	}
+	ports := flags.String("ports", "502,1502", "Comma separated list of TCP ports to probe")
+	units := flags.String("units", fmt.Sprintf("%d-%d", modbus.MIN_UNIT_ID, modbus.MAX_UNIT_ID), "Unit ids (slave ids) to probe, ex: 1-10,100")
+	connectTimeout := flags.Duration("connect_timeout", modbus.DEFAULT_SCAN_CONNECT_TIMEOUT, "TCP connect timeout per host & port")
+	timeout := flags.Duration("timeout", modbus.DEFAULT_SCAN_TIMEOUT, "Modbus request timeout, i.e. per unit id not answering")
+	concurrency := flags.Int("concurrency", modbus.DEFAULT_SCAN_CONCURRENCY, "Number of hosts probed at the same time")
+	format := flags.String("format", "table", "Output format - {table, json}")
+	logLevel := flags.String("log_level", "WARNING", "Log level - {DEBUG, INFO, WARNING, ERROR}")
+	flags.Parse(args)
+
+	errs := ConfigErrors{}
+	logging := LogFlags{logLevel: parseLogLevel(*logLevel, "log level", &errs), format: logger.FORMAT_TEXT}
+	config := modbus.ScanConfig{ConnectTimeout: *connectTimeout, Timeout: *timeout, Concurrency: *concurrency}
+
+	for _, port := range strings.Split(*ports, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(port))
+		if err != nil || value < 1 || value > 65535 {
+			errs.Add("invalid port '%s'", port)
+			continue
+		}
+		config.Ports = append(config.Ports, value)
+	}
+	config.UnitIds = parseUnitIds(*units, &errs)
+
+	switch *format {
+	case "table", "json":
+	default:
+		errs.Add("unknown output format '%s', expected one of table, json", *format)
+	}
+	if flags.NArg() == 0 {
+		errs.Add("no CIDR range or address to scan provided, ex: 192.168.0.0/24")
+	}
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, errs)
+		return 2
+	}
+	logger.Configure(LoggerConfig(&logging))
+
+	if *format == "table" {
+		fmt.Fprintf(os.Stderr, "Scanning %s, ports %s, unit ids %s...\n", strings.Join(flags.Args(), " "), *ports, *units)
+	}
+	devices, err := modbus.Scan(flags.Args(), config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(devices)
+		return 0
+	}
+
+	if len(devices) == 0 {
+		fmt.Fprintln(os.Stderr, "No SunSpec devices found.")
+		return 1
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "HOST\tPORT\tUNIT ID\tMANUFACTURER\tMODEL\tSERIAL\tVERSION")
+	for _, device := range devices {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", device.Host, device.Port, device.UnitId, device.Manufacturer, device.Model, device.Serial, device.Version)
+	}
+	table.Flush()
+	return 0
+}
+
+// Parse unit ids 'n,from-to,...' (1-247).
+func parseUnitIds(list string, errs *ConfigErrors) []byte {
+	unitIds := []byte{}
+	seen := map[int]bool{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		bounds := strings.SplitN(entry, "-", 2)
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		to := from
+		if err == nil && len(bounds) == 2 {
+			to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		}
+		if err != nil || from < modbus.MIN_UNIT_ID || to > modbus.MAX_UNIT_ID || from > to {
+			errs.Add("invalid unit ids '%s', expected %d-%d", entry, modbus.MIN_UNIT_ID, modbus.MAX_UNIT_ID)
+			continue
+		}
+		for unitId := from; unitId <= to; unitId++ {
+			if !seen[unitId] {
+				seen[unitId] = true
+				unitIds = append(unitIds, byte(unitId))
+			}
+		}
+	}
+	return unitIds
+}
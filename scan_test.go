@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUnitIds(t *testing.T) {
+	tests := []struct {
+		list string
+		want []byte
+	}{
+		{"1", []byte{1}},
+		{"1-3", []byte{1, 2, 3}},
+		{" 1 - 3 , 100 ", []byte{1, 2, 3, 100}},
+		{"5,2-4,3", []byte{5, 2, 3, 4}}, // in the given order, without duplicates
+		{"7-7", []byte{7}},
+		{"246-247", []byte{246, 247}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.list, func(t *testing.T) {
+			errs := ConfigErrors{}
+			unitIds := parseUnitIds(test.list, &errs)
+			if len(errs) > 0 || !reflect.DeepEqual(unitIds, test.want) {
+				t.Errorf("parseUnitIds() = %v, %v, want %v", unitIds, errs, test.want)
+			}
+		})
+	}
+}
+
+func TestParseUnitIdsErrors(t *testing.T) {
+	tests := []string{"", "0", "248", "0-10", "240-248", "10-5", "a", "1-b", "1-2-3", "-1", "1,,2"}
+
+	for _, list := range tests {
+		t.Run(list, func(t *testing.T) {
+			errs := ConfigErrors{}
+			unitIds := parseUnitIds(list, &errs)
+			if len(errs) != 1 {
+				t.Errorf("parseUnitIds() = %v, %d errors %v, want 1 error", unitIds, len(errs), errs)
+			}
+		})
+	}
+
+	// Valid entries are kept, every invalid one reported.
+	errs := ConfigErrors{}
+	if unitIds := parseUnitIds("1,x,3-2,4", &errs); !reflect.DeepEqual(unitIds, []byte{1, 4}) || len(errs) != 2 {
+		t.Errorf("parseUnitIds() = %v, %v, want [1 4] and 2 errors", unitIds, errs)
+	}
+}
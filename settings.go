@@ -3,17 +3,30 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	utilities "github.com/stefannilsson/solaredgedc/common"
+	logger "github.com/stefannilsson/solaredgedc/logger"
+	mqttPublisher "github.com/stefannilsson/solaredgedc/publisher"
 )
 
 const (
 	DEFAULT_MQTT_QOS      = 1
 	DEFAULT_POLL_INTERVAL = 15000
 	DEFAULT_MODBUS_PORT   = 502
+
+	DEFAULT_CONTROL_REVERT_TIMEOUT = 15 * time.Minute // power control changes without revert timeout of their own
+
+	// SolarEdge RS485 defaults
+	DEFAULT_MODBUS_BAUDRATE = 115200
+	DEFAULT_MODBUS_DATABITS = 8
+	DEFAULT_MODBUS_PARITY   = "N"
+	DEFAULT_MODBUS_STOPBITS = 1
 )
 
 const (
@@ -24,14 +37,47 @@ const (
 )
 
 type LogFlags struct {
-	logLevel int
+	logLevel        int
+	format          string         // 'text' (default) or 'json'
+	componentLevels map[string]int // per component log level, e.g. {"modbus": LOG_LEVEL_ERROR}
 }
 
 type ModbusFlags struct {
+	mode         string // 'tcp' (default), 'rtu' or 'replay'
 	hostname     string // hostname and/or IP address to Modbus server.
 	port         int    // default to : '502'
 	slaveId      int    // normally '1' in case of
 	pollInterval int64  // number of 'ms' between polls
+
+	devices []ModbusDeviceFlags // devices to poll, defaults to the single device above.
+
+	recordFile string // record all raw block reads to this file, disabled if empty
+	replayFile string // recording replayed instead of polling devices ('replay' mode)
+
+	serial ModbusSerialFlags // RTU mode only
+
+	control ModbusControlFlags
+}
+
+// Advanced power control (active power limiting) over MQTT, see PowerController.
+type ModbusControlFlags struct {
+	enabled       bool          // subscribe to '{device topic}/control/set'
+	revertTimeout time.Duration // default revert timeout of changes, 0 = never revert
+}
+
+type ModbusDeviceFlags struct {
+	alias    string // e.g. 'leader', used to derive the device's MQTT topic
+	hostname string // serial device path in RTU mode
+	port     int
+	slaveId  int
+}
+
+type ModbusSerialFlags struct {
+	device   string // e.g. '/dev/ttyUSB0'
+	baudRate int
+	dataBits int
+	parity   string // {N, E, O}
+	stopBits int
 }
 
 type MqttFlags struct {
@@ -41,174 +87,657 @@ type MqttFlags struct {
 	password string
 	qos      int
 	topic    string
+	tls      MqttTLSFlags
+
+	availabilityTopic string // retained 'online'/'offline' status, default '{topic}/availability'
+
+	homeAssistant       bool   // publish Home Assistant MQTT discovery configs
+	homeAssistantPrefix string // discovery prefix, default 'homeassistant'
+
+	store MqttStoreFlags
+}
+
+// Additional outputs, besides MQTT.
+type OutputFlags struct {
+	metricsListen string // Prometheus '/metrics' listen address, e.g. ':9100', disabled if empty
+	influx        InfluxFlags
+}
+
+type InfluxFlags struct {
+	url    string // 'http(s)://host:8086', 'udp://host:8089' or 'file:///path', disabled if empty
+	org    string
+	bucket string
+	token  string
+}
+
+type MqttStoreFlags struct {
+	directory   string // durable outbound buffer, in-memory if empty
+	maxMessages int
+	maxAge      time.Duration // 0 = unlimited
+}
+
+type MqttTLSFlags struct {
+	caFile             string // PEM CA certificate(s) to verify the broker, system roots if empty
+	certFile           string // PEM client certificate (mutual TLS)
+	keyFile            string // PEM client private key (mutual TLS)
+	serverName         string // broker certificate name, if different from the URI's host
+	minVersion         string // {1.0, 1.1, 1.2, 1.3}
+	insecureSkipVerify bool
+}
+
+/*
+	Parse application arguments/flags, read optional ENVironment variables and the optional config file.
+	App flags override ENVironment variables, which override the config file, which in turns overrides the default settings.
+	All invalid or missing settings are reported at once in the returned ConfigErrors.
+*/
+func ParseArgumentsConfig() (*LogFlags, *ModbusFlags, *MqttFlags, *OutputFlags, error) {
+	return parseArgumentsConfig(os.Args[1:], true)
 }
 
 /*
-	Parse application arguments/flags, and read optional ENVironment variables.
-	App flags override ENVironment variables, which in turns overrides the default settings.
+	Parse the given arguments (with any flags of a subcommand already defined on flag.CommandLine).
+	Subcommands only talking to devices (collector == false) don't require the MQTT and output settings.
 */
-func ParseArgumentsConfig() (*LogFlags, *ModbusFlags, *MqttFlags) {
+func parseArgumentsConfig(args []string, collector bool) (*LogFlags, *ModbusFlags, *MqttFlags, *OutputFlags, error) {
 	// init long-living app config variables w/ default settings.
-	logging := LogFlags{logLevel: LOG_LEVEL_INFO}
-	modbus := ModbusFlags{port: DEFAULT_MODBUS_PORT}
-	mqtt := MqttFlags{}
+	logging := LogFlags{logLevel: LOG_LEVEL_WARNING, format: logger.FORMAT_TEXT, componentLevels: map[string]int{}}
+	modbus := ModbusFlags{mode: "tcp", port: DEFAULT_MODBUS_PORT, pollInterval: DEFAULT_POLL_INTERVAL, control: ModbusControlFlags{revertTimeout: DEFAULT_CONTROL_REVERT_TIMEOUT}, serial: ModbusSerialFlags{baudRate: DEFAULT_MODBUS_BAUDRATE, dataBits: DEFAULT_MODBUS_DATABITS, parity: DEFAULT_MODBUS_PARITY, stopBits: DEFAULT_MODBUS_STOPBITS}}
+	mqtt := MqttFlags{qos: DEFAULT_MQTT_QOS, homeAssistantPrefix: mqttPublisher.DEFAULT_HOMEASSISTANT_PREFIX, store: MqttStoreFlags{maxMessages: mqttPublisher.DEFAULT_STORE_MAX_MESSAGES}}
+	output := OutputFlags{}
+	errs := ConfigErrors{}
+
+	// Config file
+	flagConfig := flag.String("config", "", "Path to YAML config file (ENV: SOLAREDGEDC_CONFIG). ex: /etc/solaredgedc.yaml")
 
 	// Modbus config parsing
-	envModbusHostname := os.Getenv("MODBUS_HOSTNAME")
+	flagModbusMode := flag.String("modbus_mode", "", "Modbus transport - {tcp, rtu, replay} (default tcp)")
+	flagModbusSerialDevice := flag.String("modbus_serial_device", "", "Modbus RTU serial device. ex: /dev/ttyUSB0")
+	flagModbusBaudRate := flag.Int("modbus_baudrate", 0, "Modbus RTU baud rate (default 115200)")
+	flagModbusDataBits := flag.Int("modbus_databits", 0, "Modbus RTU data bits {5,6,7,8} (default 8)")
+	flagModbusParity := flag.String("modbus_parity", "", "Modbus RTU parity {N,E,O} (default N)")
+	flagModbusStopBits := flag.Int("modbus_stopbits", 0, "Modbus RTU stop bits {1,2} (default 1)")
 	flagModbusHostname := flag.String("modbus_hostname", "", "Modbus TCP hostname/IP address")
-
-	envModbusPort := os.Getenv("MODBUS_PORT")
 	flagModbusPort := flag.Int("modbus_port", 0, "Modbus TCP port")
-
-	envModbusSlaveId := os.Getenv("MODBUS_SLAVEID")
 	flagModbusSlaveId := flag.Int("modbus_slaveid", 0, "Modbus TCP SlaveID")
-
-	envModbusPollInterval := os.Getenv("MODBUS_POLLINTERVAL")
-	flagModbusPollInterval := flag.Int64("modbus_pollinterval", -1, "Modbus Poll interval (number of 'ms' between registers polls)")
+	flagModbusDevices := flag.String("modbus_devices", "", "Comma separated list of Modbus devices to poll, as '[alias=]host[:port][/slaveid]'. Ex: leader=10.0.0.5:1502/1,follower=10.0.0.5:1502/2")
+	flagModbusPollInterval := flag.Int64("modbus_pollinterval", 0, "Modbus Poll interval (number of 'ms' between registers polls)")
+	flagModbusRecordFile := flag.String("modbus_record_file", "", "Record all raw Modbus block reads to this file (optional)")
+	flagModbusReplayFile := flag.String("modbus_replay_file", "", "Recording to replay instead of polling devices, in Modbus mode 'replay'")
+	flagModbusControlEnabled := flag.Bool("modbus_control_enabled", false, "Accept power control commands (active power limit) on '{device topic}/control/set'")
+	flagModbusControlRevertTimeout := flag.Duration("modbus_control_revert_timeout", 0, "Revert power control changes after this time, unless refreshed. ex: 5m, 0 = never (default 15m)")
 
 	// MQTT config parsing
-	envMqttUri := os.Getenv("MQTT_URI")
 	flagMqttUri := flag.String("mqtt_uri", "", "The broker URI. ex: tcp://10.10.1.1:1883")
-
-	envMqttClientId := os.Getenv("MQTT_CLIENTID")
 	flagMqttClientId := flag.String("mqtt_clientid", "", "The ClientID (optional)")
-
-	envMqttUsername := os.Getenv("MQTT_USERNAME")
 	flagMqttUsername := flag.String("mqtt_username", "", "The User (optional)")
-
-	envMqttPassword := os.Getenv("MQTT_PASSWORD")
 	flagMqttPassword := flag.String("mqtt_password", "", "The password")
-
-	envMqttQos := os.Getenv("MQTT_QOS")
-	flagMqttQos := flag.Int("mqtt_qos", -1, "The Quality of Service {0,1,2} (default 1)")
-
-	envMqttTopic := os.Getenv("MQTT_TOPIC")
+	flagMqttQos := flag.Int("mqtt_qos", 0, "The Quality of Service {0,1,2} (default 1)")
 	flagMqttTopic := flag.String("mqtt_topic", "", "The topic name to/from which to publish/subscribe")
+	flagMqttAvailabilityTopic := flag.String("mqtt_availability_topic", "", "Topic of the retained online/offline status (default {mqtt_topic}/availability)")
+	flagMqttHomeAssistant := flag.Bool("mqtt_homeassistant", false, "Publish Home Assistant MQTT discovery configs (retained)")
+	flagMqttHomeAssistantPrefix := flag.String("mqtt_homeassistant_prefix", "", "Home Assistant discovery prefix (default homeassistant)")
+	flagMqttStoreDir := flag.String("mqtt_store_dir", "", "Directory of the durable outbound buffer, surviving restarts & broker downtime (default in-memory)")
+	flagMqttStoreMaxMessages := flag.Int("mqtt_store_max_messages", 0, "Max number of buffered messages (default 10000)")
+	flagMqttStoreMaxAge := flag.Duration("mqtt_store_max_age", 0, "Max age of buffered messages, expired on startup only (not while running). ex: 72h (default unlimited)")
+	flagMqttCaFile := flag.String("mqtt_ca_file", "", "PEM CA certificate(s) to verify the broker with (optional, default system roots)")
+	flagMqttCertFile := flag.String("mqtt_cert_file", "", "PEM client certificate for mutual TLS (optional)")
+	flagMqttKeyFile := flag.String("mqtt_key_file", "", "PEM client private key for mutual TLS (optional)")
+	flagMqttTlsServerName := flag.String("mqtt_tls_server_name", "", "Expected broker certificate name, if different from the broker URI's host (optional)")
+	flagMqttTlsMinVersion := flag.String("mqtt_tls_min_version", "", "Minimum TLS version {1.0, 1.1, 1.2, 1.3} (default 1.2)")
+	flagMqttTlsInsecureSkipVerify := flag.Bool("mqtt_tls_insecure_skip_verify", false, "Don't verify the broker certificate, e.g. self-signed brokers (insecure)")
+
+	// Additional outputs
+	flagMetricsListen := flag.String("metrics_listen", "", "Serve Prometheus metrics on this address (http://{address}/metrics), ex: :9100 (optional)")
+
+	flagInfluxUrl := flag.String("influx_url", "", "Write readings as InfluxDB line protocol to http(s)://host:8086 (v2 write API), udp://host:8089 or file:///path (optional)")
+	flagInfluxOrg := flag.String("influx_org", "", "InfluxDB v2 organization")
+	flagInfluxBucket := flag.String("influx_bucket", "", "InfluxDB v2 bucket")
+	flagInfluxToken := flag.String("influx_token", "", "InfluxDB v2 API token")
 
 	// Log config parsing
-	envLogLevel := os.Getenv("LOG_LEVEL") // {DEBUG, INFO, WARNING, ERROR}
 	flagLog := flag.String("log_level", "", "Log level - {DEBUG, INFO, WARNING, ERROR}")
+	flagLogFormat := flag.String("log_format", "", "Log format - {text, json} (default text)")
+	flagLogComponentLevels := flag.String("log_component_levels", "", "Per component log level, ex: modbus=ERROR,mqtt=INFO (components: main, modbus, mapping, mqtt, publisher, metrics)")
+
+	flag.CommandLine.Parse(args)
+
+	settings := newSettingsLoader(&errs)
+
+	// Config file :: lowest priority after the defaults
+	var logLevel string
+	var componentLevels string
+	var devices string
+	var fileDevices []ConfigFileDevice
+	configPath := os.Getenv("SOLAREDGEDC_CONFIG")
+	settings.String(&configPath, "", "config", flagConfig)
+	if configPath != "" {
+		if file, err := LoadConfigFile(configPath); err != nil {
+			errs.Add("%v", err)
+		} else {
+			applyConfigFile(file, &logLevel, &logging, &modbus, &mqtt, &output, &errs)
+			for component, level := range file.Log.Components {
+				componentLevels += fmt.Sprintf(",%s=%s", component, level)
+			}
+			fileDevices = file.Modbus.Devices
+		}
+	}
 
-	flag.Parse()
+	// Modbus :: Mode, serial settings, hostname/port/slave id, device list & poll interval
+	settings.String(&modbus.mode, "MODBUS_MODE", "modbus_mode", flagModbusMode)
+	settings.String(&modbus.serial.device, "MODBUS_SERIAL_DEVICE", "modbus_serial_device", flagModbusSerialDevice)
+	settings.Int(&modbus.serial.baudRate, "MODBUS_BAUDRATE", "modbus_baudrate", flagModbusBaudRate)
+	settings.Int(&modbus.serial.dataBits, "MODBUS_DATABITS", "modbus_databits", flagModbusDataBits)
+	settings.String(&modbus.serial.parity, "MODBUS_PARITY", "modbus_parity", flagModbusParity)
+	settings.Int(&modbus.serial.stopBits, "MODBUS_STOPBITS", "modbus_stopbits", flagModbusStopBits)
+	settings.String(&modbus.hostname, "MODBUS_HOSTNAME", "modbus_hostname", flagModbusHostname)
+	settings.Int(&modbus.port, "MODBUS_PORT", "modbus_port", flagModbusPort)
+	settings.Int(&modbus.slaveId, "MODBUS_SLAVEID", "modbus_slaveid", flagModbusSlaveId)
+	settings.String(&devices, "MODBUS_DEVICES", "modbus_devices", flagModbusDevices)
+	settings.Int64(&modbus.pollInterval, "MODBUS_POLLINTERVAL", "modbus_pollinterval", flagModbusPollInterval)
+	settings.String(&modbus.recordFile, "MODBUS_RECORD_FILE", "modbus_record_file", flagModbusRecordFile)
+	settings.String(&modbus.replayFile, "MODBUS_REPLAY_FILE", "modbus_replay_file", flagModbusReplayFile)
+	settings.Bool(&modbus.control.enabled, "MODBUS_CONTROL_ENABLED", "modbus_control_enabled", flagModbusControlEnabled)
+	settings.Duration(&modbus.control.revertTimeout, "MODBUS_CONTROL_REVERT_TIMEOUT", "modbus_control_revert_timeout", flagModbusControlRevertTimeout)
+	modbus.mode = strings.ToLower(modbus.mode)
+	modbus.serial.parity = strings.ToUpper(modbus.serial.parity)
+
+	// Outputs :: Prometheus endpoint
+	settings.String(&output.metricsListen, "METRICS_LISTEN", "metrics_listen", flagMetricsListen)
+
+	// Outputs :: InfluxDB
+	settings.String(&output.influx.url, "INFLUX_URL", "influx_url", flagInfluxUrl)
+	settings.String(&output.influx.org, "INFLUX_ORG", "influx_org", flagInfluxOrg)
+	settings.String(&output.influx.bucket, "INFLUX_BUCKET", "influx_bucket", flagInfluxBucket)
+	settings.String(&output.influx.token, "INFLUX_TOKEN", "influx_token", flagInfluxToken)
+
+	// Log level, format & per component levels selection
+	settings.String(&logLevel, "LOG_LEVEL", "log_level", flagLog)
+	settings.String(&logging.format, "LOG_FORMAT", "log_format", flagLogFormat)
+	settings.String(&componentLevels, "LOG_COMPONENT_LEVELS", "log_component_levels", flagLogComponentLevels)
+	logging.format = strings.ToLower(logging.format)
+
+	// MQTT :: URI, client id, credentials, QoS & topic
+	settings.String(&mqtt.uri, "MQTT_URI", "mqtt_uri", flagMqttUri)
+	settings.String(&mqtt.clientId, "MQTT_CLIENTID", "mqtt_clientid", flagMqttClientId)
+	settings.String(&mqtt.username, "MQTT_USERNAME", "mqtt_username", flagMqttUsername)
+	settings.String(&mqtt.password, "MQTT_PASSWORD", "mqtt_password", flagMqttPassword)
+	settings.Int(&mqtt.qos, "MQTT_QOS", "mqtt_qos", flagMqttQos)
+	settings.String(&mqtt.topic, "MQTT_TOPIC", "mqtt_topic", flagMqttTopic)
+	settings.String(&mqtt.availabilityTopic, "MQTT_AVAILABILITY_TOPIC", "mqtt_availability_topic", flagMqttAvailabilityTopic)
+
+	// MQTT :: Durable outbound buffer
+	settings.String(&mqtt.store.directory, "MQTT_STORE_DIR", "mqtt_store_dir", flagMqttStoreDir)
+	settings.Int(&mqtt.store.maxMessages, "MQTT_STORE_MAX_MESSAGES", "mqtt_store_max_messages", flagMqttStoreMaxMessages)
+	settings.Duration(&mqtt.store.maxAge, "MQTT_STORE_MAX_AGE", "mqtt_store_max_age", flagMqttStoreMaxAge)
+
+	// MQTT :: Home Assistant discovery
+	settings.Bool(&mqtt.homeAssistant, "MQTT_HOMEASSISTANT", "mqtt_homeassistant", flagMqttHomeAssistant)
+	settings.String(&mqtt.homeAssistantPrefix, "MQTT_HOMEASSISTANT_PREFIX", "mqtt_homeassistant_prefix", flagMqttHomeAssistantPrefix)
+
+	// MQTT :: TLS (used for ssl://, tls://, mqtts:// broker URIs)
+	settings.String(&mqtt.tls.caFile, "MQTT_CA_FILE", "mqtt_ca_file", flagMqttCaFile)
+	settings.String(&mqtt.tls.certFile, "MQTT_CERT_FILE", "mqtt_cert_file", flagMqttCertFile)
+	settings.String(&mqtt.tls.keyFile, "MQTT_KEY_FILE", "mqtt_key_file", flagMqttKeyFile)
+	settings.String(&mqtt.tls.serverName, "MQTT_TLS_SERVER_NAME", "mqtt_tls_server_name", flagMqttTlsServerName)
+	settings.String(&mqtt.tls.minVersion, "MQTT_TLS_MIN_VERSION", "mqtt_tls_min_version", flagMqttTlsMinVersion)
+	settings.Bool(&mqtt.tls.insecureSkipVerify, "MQTT_TLS_INSECURE_SKIP_VERIFY", "mqtt_tls_insecure_skip_verify", flagMqttTlsInsecureSkipVerify)
+
+	// Log level :: {DEBUG, INFO, WARNING, ERROR}
+	if logLevel != "" {
+		logging.logLevel = parseLogLevel(logLevel, "log level", &errs)
+	}
 
-	// Modbus :: Hostname selection
-	if *flagModbusHostname != "" {
-		modbus.hostname = *flagModbusHostname
-	} else if envModbusHostname != "" {
-		modbus.hostname = envModbusHostname
-	} else {
-		panic("No Modbus TCP hostname provided.")
+	// Log level :: per component 'component=LEVEL,...'
+	for _, componentLevel := range strings.Split(componentLevels, ",") {
+		if strings.TrimSpace(componentLevel) == "" {
+			continue
+		}
+		parts := strings.SplitN(componentLevel, "=", 2)
+		if len(parts) != 2 {
+			errs.Add("invalid component log level '%s', expected component=LEVEL", componentLevel)
+			continue
+		}
+		component := strings.ToLower(strings.TrimSpace(parts[0]))
+		logging.componentLevels[component] = parseLogLevel(parts[1], fmt.Sprintf("log level of component '%s'", component), &errs)
 	}
 
-	// Modbus :: Port selection
-	if *flagModbusPort != 0 {
-		modbus.port = *flagModbusPort
-	} else if envModbusPort != "" {
-		modbus.port, _ = strconv.Atoi(envModbusPort)
+	switch logging.format {
+	case logger.FORMAT_TEXT, logger.FORMAT_JSON:
+	default:
+		errs.Add("unknown log format '%s', expected one of text, json", logging.format)
 	}
 
-	// Modbus :: Slave id selection
-	if *flagModbusSlaveId != 0 {
-		modbus.slaveId = *flagModbusSlaveId
-	} else if envModbusSlaveId != "" {
-		modbus.slaveId, _ = strconv.Atoi(envModbusSlaveId)
+	// RTU devices are addressed by serial device instead of hostname.
+	if modbus.mode == "rtu" && modbus.hostname == "" {
+		modbus.hostname = modbus.serial.device
 	}
 
-	// Modbus :: Slave id selection
-	if *flagModbusPollInterval != -1 {
-		modbus.pollInterval = *flagModbusPollInterval
-	} else if envModbusPollInterval != "" {
-		envModbusPollIntervalInt64, _ := strconv.Atoi(envModbusPollInterval)
-		modbus.pollInterval = int64(envModbusPollIntervalInt64)
+	// Modbus :: Device list (flags/env, then config file), using the above hostname/port/slave id as defaults.
+	if devices != "" {
+		modbus.devices = parseModbusDevices(devices, modbus.hostname, modbus.port, modbus.slaveId, &errs)
+	} else if len(fileDevices) > 0 {
+		modbus.devices = configFileDevices(fileDevices, modbus.hostname, modbus.port, modbus.slaveId, &errs)
 	} else {
-		modbus.pollInterval = DEFAULT_POLL_INTERVAL // default is to poll every 15 second.
+		modbus.devices = []ModbusDeviceFlags{{hostname: modbus.hostname, port: modbus.port, slaveId: modbus.slaveId}}
 	}
 
-	// Log level selection
-	switch strings.ToUpper(*flagLog) {
+	// MQTT :: Default ClientId to random /[a-z0-9]{12}/
+	if mqtt.clientId == "" {
+		mqtt.clientId = fmt.Sprintf("auto-%s", utilities.RandomString(12))
+	}
+
+	// MQTT :: Default availability topic next to the readings
+	if mqtt.availabilityTopic == "" && mqtt.topic != "" {
+		mqtt.availabilityTopic = fmt.Sprintf("%s/availability", mqtt.topic)
+	}
+
+	validateModbus(&modbus, &errs)
+	if collector {
+		validateOutputs(&modbus, &mqtt, &output, &errs)
+	}
+
+	if len(errs) > 0 {
+		return &logging, &modbus, &mqtt, &output, errs
+	}
+	return &logging, &modbus, &mqtt, &output, nil
+}
+
+// Parse a log level {DEBUG, INFO, WARNING, ERROR}.
+func parseLogLevel(level string, setting string, errs *ConfigErrors) int {
+	switch strings.ToUpper(strings.TrimSpace(level)) {
 	case "DEBUG":
-		logging.logLevel = LOG_LEVEL_DEBUG
+		return LOG_LEVEL_DEBUG
 	case "INFO":
-		logging.logLevel = LOG_LEVEL_INFO
+		return LOG_LEVEL_INFO
 	case "WARNING":
-		logging.logLevel = LOG_LEVEL_WARNING
+		return LOG_LEVEL_WARNING
 	case "ERROR":
-		logging.logLevel = LOG_LEVEL_ERROR
+		return LOG_LEVEL_ERROR
 	default:
-		switch envLogLevel {
-		case "DEBUG":
-			logging.logLevel = LOG_LEVEL_DEBUG
-		case "INFO":
-			logging.logLevel = LOG_LEVEL_INFO
-		case "WARNING":
-			logging.logLevel = LOG_LEVEL_WARNING
-		case "ERROR":
-			logging.logLevel = LOG_LEVEL_ERROR
+		errs.Add("unknown %s '%s', expected one of DEBUG, INFO, WARNING, ERROR", setting, level)
+		return LOG_LEVEL_WARNING
+	}
+}
+
+// Logger configuration of the parsed log settings.
+func LoggerConfig(logging *LogFlags) logger.Config {
+	levels := map[int]logrus.Level{
+		LOG_LEVEL_ERROR:   logrus.ErrorLevel,
+		LOG_LEVEL_WARNING: logrus.WarnLevel,
+		LOG_LEVEL_INFO:    logrus.InfoLevel,
+		LOG_LEVEL_DEBUG:   logrus.DebugLevel,
+	}
+
+	componentLevels := map[string]logrus.Level{}
+	for component, level := range logging.componentLevels {
+		componentLevels[component] = levels[level]
+	}
+
+	return logger.Config{Level: levels[logging.logLevel], ComponentLevels: componentLevels, Format: logging.format}
+}
+
+// Check the resulting Modbus settings, collecting all errors.
+func validateModbus(modbus *ModbusFlags, errs *ConfigErrors) {
+	switch modbus.mode {
+	case "tcp":
+	case "rtu":
+		if modbus.serial.device == "" && modbus.hostname == "" {
+			errs.Add("no Modbus RTU serial device provided (MODBUS_SERIAL_DEVICE / -modbus_serial_device / modbus.serial.device)")
+		}
+		if modbus.serial.baudRate <= 0 {
+			errs.Add("invalid Modbus RTU baud rate %d", modbus.serial.baudRate)
+		}
+		if modbus.serial.dataBits < 5 || modbus.serial.dataBits > 8 {
+			errs.Add("invalid Modbus RTU data bits %d, expected 5-8", modbus.serial.dataBits)
+		}
+		switch modbus.serial.parity {
+		case "N", "E", "O":
 		default:
-			logging.logLevel = LOG_LEVEL_WARNING
+			errs.Add("unknown Modbus RTU parity '%s', expected one of N, E, O", modbus.serial.parity)
 		}
+		if modbus.serial.stopBits != 1 && modbus.serial.stopBits != 2 {
+			errs.Add("invalid Modbus RTU stop bits %d, expected 1 or 2", modbus.serial.stopBits)
+		}
+	case "replay":
+		if modbus.replayFile == "" {
+			errs.Add("no recording to replay provided (MODBUS_REPLAY_FILE / -modbus_replay_file / modbus.replay_file)")
+		} else if _, err := os.Stat(modbus.replayFile); err != nil {
+			errs.Add("Modbus replay: %v", err)
+		}
+		if modbus.recordFile != "" {
+			errs.Add("a recording can't be recorded while replaying one (MODBUS_RECORD_FILE)")
+		}
+	default:
+		errs.Add("unknown Modbus mode '%s', expected one of tcp, rtu, replay", modbus.mode)
 	}
 
-	// MQTT :: URI select
-	if *flagMqttUri != "" {
-		mqtt.uri = *flagMqttUri
-	} else if envMqttUri != "" {
-		mqtt.uri = envMqttUri
-	} else {
-		panic("No MQTT hostname provided.")
+	for _, device := range modbus.devices {
+		name := device.alias
+		if name == "" {
+			name = "default"
+		}
+		if device.hostname == "" && modbus.mode == "tcp" {
+			errs.Add("no Modbus TCP hostname provided for device '%s' (MODBUS_HOSTNAME / -modbus_hostname / modbus.hostname)", name)
+		}
+		if modbus.mode == "tcp" && (device.port < 1 || device.port > 65535) {
+			errs.Add("invalid Modbus TCP port %d for device '%s'", device.port, name)
+		}
+		if device.slaveId < 0 || device.slaveId > 255 {
+			errs.Add("invalid Modbus slave id %d for device '%s', expected 0-255", device.slaveId, name)
+		}
 	}
 
-	// MQTT :: ClientId select
-	if *flagMqttClientId != "" {
-		mqtt.clientId = *flagMqttClientId
-	} else if envMqttClientId != "" {
-		mqtt.clientId = envMqttClientId
-	} else {
-		mqtt.clientId = fmt.Sprintf("auto-%s", utilities.RandomString(12)) // Default to random /[a-z0-9]{12}/
+	if modbus.pollInterval <= 0 {
+		errs.Add("invalid Modbus poll interval %d ms", modbus.pollInterval)
 	}
-
-	// MQTT :: Username select.
-	if *flagMqttUsername != "" {
-		mqtt.username = *flagMqttUsername
-	} else if envMqttUsername != "" {
-		mqtt.username = envMqttUsername
+	if modbus.control.revertTimeout < 0 {
+		errs.Add("invalid power control revert timeout %v", modbus.control.revertTimeout)
 	}
+}
 
-	// MQTT :: Password select
-	if *flagMqttPassword != "" {
-		mqtt.password = *flagMqttPassword
-	} else if envMqttPassword != "" {
-		mqtt.password = envMqttPassword
+// Check the resulting MQTT & output settings (collector only), collecting all errors.
+func validateOutputs(modbus *ModbusFlags, mqtt *MqttFlags, output *OutputFlags, errs *ConfigErrors) {
+	// MQTT (optional when replaying a recording, readings are written to stdout instead)
+	if mqtt.uri == "" && modbus.mode != "replay" {
+		errs.Add("no MQTT broker URI provided (MQTT_URI / -mqtt_uri / mqtt.uri)")
+	}
+	switch mqtt.qos {
+	case 0, 1, 2:
+	default:
+		errs.Add("unknown MQTT QoS %d, expected one of 0, 1, 2", mqtt.qos)
+	}
+	if mqtt.topic == "" && mqtt.uri != "" {
+		errs.Add("no MQTT topic provided (MQTT_TOPIC / -mqtt_topic / mqtt.topic)")
+	}
+	if modbus.control.enabled && (mqtt.uri == "" || modbus.mode == "replay") {
+		errs.Add("power control commands require an MQTT broker and a device, i.e. not replaying a recording (MODBUS_CONTROL_ENABLED)")
+	}
+	if (mqtt.tls.certFile == "") != (mqtt.tls.keyFile == "") {
+		errs.Add("MQTT client certificate and key must be provided together (MQTT_CERT_FILE / MQTT_KEY_FILE)")
+	}
+	for _, file := range []string{mqtt.tls.caFile, mqtt.tls.certFile, mqtt.tls.keyFile} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			errs.Add("MQTT TLS: %v", err)
+		}
+	}
+	if mqtt.store.directory != "" {
+		if mqtt.store.maxMessages < 1 || mqtt.store.maxMessages > mqttPublisher.MAX_STORE_MESSAGES {
+			errs.Add("invalid MQTT store max messages %d, expected 1-%d", mqtt.store.maxMessages, mqttPublisher.MAX_STORE_MESSAGES)
+		}
+		if mqtt.store.maxAge < 0 {
+			errs.Add("invalid MQTT store max age %v", mqtt.store.maxAge)
+		}
+		if mqtt.qos == 0 {
+			errs.Add("MQTT store requires QoS 1 or 2, QoS 0 messages are never buffered")
+		}
+	}
+	if mqtt.homeAssistant && strings.Trim(mqtt.homeAssistantPrefix, "/") == "" {
+		errs.Add("no Home Assistant discovery prefix provided (MQTT_HOMEASSISTANT_PREFIX / -mqtt_homeassistant_prefix / mqtt.homeassistant.prefix)")
+	}
+	if !mqttPublisher.IsValidTLSVersion(mqtt.tls.minVersion) {
+		errs.Add("unknown MQTT minimum TLS version '%s', expected one of 1.0, 1.1, 1.2, 1.3", mqtt.tls.minVersion)
 	}
 
-	// MQTT :: QoS select
-	if *flagMqttQos != -1 {
-		switch *flagMqttQos {
-		case 0, 1, 2:
-			mqtt.qos = *flagMqttQos
+	// InfluxDB
+	if output.influx.url != "" {
+		target, err := url.Parse(output.influx.url)
+		switch {
+		case err != nil:
+			errs.Add("invalid InfluxDB URL '%s': %v", output.influx.url, err)
+		case target.Scheme == "http" || target.Scheme == "https":
+			if output.influx.org == "" || output.influx.bucket == "" {
+				errs.Add("InfluxDB v2 write API requires an organization and bucket (INFLUX_ORG / INFLUX_BUCKET)")
+			}
+		case target.Scheme == "udp" || target.Scheme == "file":
 		default:
-			panic("Unknown QoS specified.")
+			errs.Add("unsupported InfluxDB URL '%s', expected http(s)://, udp:// or file://", output.influx.url)
 		}
-	} else if envMqttQos != "" {
-		qos, _ := strconv.Atoi(envMqttQos)
-		switch qos {
-		case 0, 1, 2:
-			mqtt.qos = qos
-		default:
-			panic("Unknown QoS specified.")
+	}
+}
+
+// Apply the settings present in the config file.
+func applyConfigFile(file *ConfigFile, logLevel *string, logging *LogFlags, modbus *ModbusFlags, mqtt *MqttFlags, output *OutputFlags, errs *ConfigErrors) {
+	setString(logLevel, file.Log.Level)
+	setString(&logging.format, file.Log.Format)
+
+	setString(&modbus.mode, file.Modbus.Mode)
+	setString(&modbus.hostname, file.Modbus.Hostname)
+	setInt(&modbus.port, file.Modbus.Port)
+	setInt(&modbus.slaveId, file.Modbus.SlaveId)
+	if file.Modbus.PollInterval != nil {
+		modbus.pollInterval = *file.Modbus.PollInterval
+	}
+	setString(&modbus.recordFile, file.Modbus.RecordFile)
+	setString(&modbus.replayFile, file.Modbus.ReplayFile)
+	setString(&modbus.serial.device, file.Modbus.Serial.Device)
+	setInt(&modbus.serial.baudRate, file.Modbus.Serial.BaudRate)
+	setInt(&modbus.serial.dataBits, file.Modbus.Serial.DataBits)
+	setString(&modbus.serial.parity, file.Modbus.Serial.Parity)
+	setInt(&modbus.serial.stopBits, file.Modbus.Serial.StopBits)
+	if file.Modbus.Control.Enabled != nil {
+		modbus.control.enabled = *file.Modbus.Control.Enabled
+	}
+	if file.Modbus.Control.RevertTimeout != nil {
+		revertTimeout, err := time.ParseDuration(*file.Modbus.Control.RevertTimeout)
+		if err != nil {
+			errs.Add("modbus.control.revert_timeout: '%s' is not a duration", *file.Modbus.Control.RevertTimeout)
 		}
-	} else {
-		mqtt.qos = DEFAULT_MQTT_QOS
+		modbus.control.revertTimeout = revertTimeout
 	}
 
-	// MQTT :: Topic select
-	if *flagMqttTopic != "" {
-		mqtt.topic = *flagMqttTopic
-	} else if envMqttTopic != "" {
-		mqtt.topic = envMqttTopic
-	} else {
-		panic("No MQTT topic provided.")
+	setString(&mqtt.uri, file.Mqtt.URI)
+	setString(&mqtt.clientId, file.Mqtt.ClientId)
+	setString(&mqtt.username, file.Mqtt.Username)
+	setString(&mqtt.password, file.Mqtt.Password)
+	setInt(&mqtt.qos, file.Mqtt.Qos)
+	setString(&mqtt.topic, file.Mqtt.Topic)
+	setString(&mqtt.availabilityTopic, file.Mqtt.AvailabilityTopic)
+	setString(&mqtt.store.directory, file.Mqtt.Store.Directory)
+	setInt(&mqtt.store.maxMessages, file.Mqtt.Store.MaxMessages)
+	if file.Mqtt.Store.MaxAge != nil {
+		maxAge, err := time.ParseDuration(*file.Mqtt.Store.MaxAge)
+		if err != nil {
+			errs.Add("mqtt.store.max_age: '%s' is not a duration", *file.Mqtt.Store.MaxAge)
+		}
+		mqtt.store.maxAge = maxAge
+	}
+	if file.Mqtt.HomeAssistant.Discovery != nil {
+		mqtt.homeAssistant = *file.Mqtt.HomeAssistant.Discovery
+	}
+	setString(&mqtt.homeAssistantPrefix, file.Mqtt.HomeAssistant.Prefix)
+	setString(&mqtt.tls.caFile, file.Mqtt.TLS.CAFile)
+	setString(&mqtt.tls.certFile, file.Mqtt.TLS.CertFile)
+	setString(&mqtt.tls.keyFile, file.Mqtt.TLS.KeyFile)
+	setString(&mqtt.tls.serverName, file.Mqtt.TLS.ServerName)
+	setString(&mqtt.tls.minVersion, file.Mqtt.TLS.MinVersion)
+
+	setString(&output.metricsListen, file.Metrics.Listen)
+	setString(&output.influx.url, file.Influx.URL)
+	setString(&output.influx.org, file.Influx.Org)
+	setString(&output.influx.bucket, file.Influx.Bucket)
+	setString(&output.influx.token, file.Influx.Token)
+	if file.Mqtt.TLS.InsecureSkipVerify != nil {
+		mqtt.tls.insecureSkipVerify = *file.Mqtt.TLS.InsecureSkipVerify
+	}
+}
+
+func setString(target *string, value *string) {
+	if value != nil {
+		*target = *value
+	}
+}
+
+func setInt(target *int, value *int) {
+	if value != nil {
+		*target = *value
+	}
+}
+
+/*
+	Layered lookup of a single setting: the ENVironment variable (if set) overrides the current value,
+	and the app flag (if given on the command line) overrides both.
+*/
+type settingsLoader struct {
+	flags map[string]bool // flags given on the command line
+	errs  *ConfigErrors
+}
+
+func newSettingsLoader(errs *ConfigErrors) *settingsLoader {
+	flags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { flags[f.Name] = true })
+	return &settingsLoader{flags: flags, errs: errs}
+}
+
+func (settings *settingsLoader) String(target *string, env string, flagName string, flagValue *string) {
+	if value, found := os.LookupEnv(env); found && env != "" && value != "" {
+		*target = value
+	}
+	if settings.flags[flagName] {
+		*target = *flagValue
+	}
+}
+
+func (settings *settingsLoader) Int(target *int, env string, flagName string, flagValue *int) {
+	if value, found := os.LookupEnv(env); found && value != "" {
+		parsed, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			settings.errs.Add("%s: '%s' is not a number", env, value)
+		} else {
+			*target = parsed
+		}
+	}
+	if settings.flags[flagName] {
+		*target = *flagValue
+	}
+}
+
+func (settings *settingsLoader) Int64(target *int64, env string, flagName string, flagValue *int64) {
+	if value, found := os.LookupEnv(env); found && value != "" {
+		parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			settings.errs.Add("%s: '%s' is not a number", env, value)
+		} else {
+			*target = parsed
+		}
+	}
+	if settings.flags[flagName] {
+		*target = *flagValue
+	}
+}
+
+func (settings *settingsLoader) Bool(target *bool, env string, flagName string, flagValue *bool) {
+	if value, found := os.LookupEnv(env); found && value != "" {
+		parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			settings.errs.Add("%s: '%s' is not a boolean", env, value)
+		} else {
+			*target = parsed
+		}
+	}
+	if settings.flags[flagName] {
+		*target = *flagValue
+	}
+}
+
+func (settings *settingsLoader) Duration(target *time.Duration, env string, flagName string, flagValue *time.Duration) {
+	if value, found := os.LookupEnv(env); found && value != "" {
+		parsed, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			settings.errs.Add("%s: '%s' is not a duration (ex: 72h)", env, value)
+		} else {
+			*target = parsed
+		}
+	}
+	if settings.flags[flagName] {
+		*target = *flagValue
+	}
+}
+
+/*
+	Parse a comma separated device list of the form '[alias=]host[:port][/slaveid]'.
+	Devices without an alias are named 'unit{slaveid}', devices without a host use the default hostname (or serial device).
+*/
+func parseModbusDevices(devices string, defaultHostname string, defaultPort int, defaultSlaveId int, errs *ConfigErrors) []ModbusDeviceFlags {
+	parsed := []ModbusDeviceFlags{}
+
+	for _, device := range strings.Split(devices, ",") {
+		device = strings.TrimSpace(device)
+		if device == "" {
+			continue
+		}
+
+		flags := ModbusDeviceFlags{port: defaultPort, slaveId: defaultSlaveId}
+		spec := device
+
+		if i := strings.Index(device, "="); i != -1 {
+			flags.alias = device[:i]
+			device = device[i+1:]
+		}
+
+		if i := strings.LastIndex(device, "/"); i != -1 {
+			slaveId, err := strconv.Atoi(device[i+1:])
+			if err != nil {
+				errs.Add("invalid Modbus slave id in device '%s'", spec)
+			}
+			flags.slaveId = slaveId
+			device = device[:i]
+		}
+
+		if i := strings.LastIndex(device, ":"); i != -1 {
+			port, err := strconv.Atoi(device[i+1:])
+			if err != nil {
+				errs.Add("invalid Modbus port in device '%s'", spec)
+			}
+			flags.port = port
+			device = device[:i]
+		}
+
+		flags.hostname = device
+		if flags.hostname == "" {
+			flags.hostname = defaultHostname
+		}
+
+		parsed = append(parsed, flags)
+	}
+
+	return nameModbusDevices(parsed, errs)
+}
+
+// Devices of the config file, missing settings default to the given hostname/port/slave id.
+func configFileDevices(devices []ConfigFileDevice, defaultHostname string, defaultPort int, defaultSlaveId int, errs *ConfigErrors) []ModbusDeviceFlags {
+	parsed := []ModbusDeviceFlags{}
+
+	for _, device := range devices {
+		flags := ModbusDeviceFlags{alias: device.Alias, hostname: device.Hostname, port: defaultPort, slaveId: defaultSlaveId}
+		if flags.hostname == "" {
+			flags.hostname = defaultHostname
+		}
+		setInt(&flags.port, device.Port)
+		setInt(&flags.slaveId, device.SlaveId)
+
+		parsed = append(parsed, flags)
+	}
+
+	return nameModbusDevices(parsed, errs)
+}
+
+// Name devices without an alias 'unit{slaveid}', and check aliases are unique.
+func nameModbusDevices(devices []ModbusDeviceFlags, errs *ConfigErrors) []ModbusDeviceFlags {
+	aliases := map[string]bool{}
+
+	for i := range devices {
+		if devices[i].alias == "" {
+			devices[i].alias = fmt.Sprintf("unit%d", devices[i].slaveId)
+		}
+		if aliases[devices[i].alias] {
+			errs.Add("duplicate Modbus device alias '%s'", devices[i].alias)
+		}
+		aliases[devices[i].alias] = true
+	}
+
+	if len(devices) == 0 {
+		errs.Add("no Modbus devices provided")
 	}
 
-	return &logging, &modbus, &mqtt
+	return devices
 }
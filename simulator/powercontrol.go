@@ -0,0 +1,111 @@
+package simulator
+
+import (
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+)
+
+// Power control register values after a 'restore defaults'.
+var powerControlDefaults = map[string]uint32{
+	"PC_ActivePowerLimit":       sunspec.PC_ACTIVE_POWER_LIMIT_MAX,
+	"PC_ReactivePowerConfig":    sunspec.PC_REACTIVE_FIXED_COSPHI,
+	"PC_AdvancedPowerControlEn": 0,
+}
+
+// Upper bounds of the power control registers, writes beyond are rejected with an 'illegal data value' exception.
+var powerControlMaximums = map[string]uint32{
+	"PC_ActivePowerLimit":       sunspec.PC_ACTIVE_POWER_LIMIT_MAX,
+	"PC_ReactivePowerConfig":    sunspec.PC_REACTIVE_CONFIG_MAXIMUM,
+	"PC_AdvancedPowerControlEn": 1,
+}
+
+// Lay out the (writable) power control registers with their defaults.
+func (registers registerMap) layoutPowerControl() {
+	registers[sunspec.PC_COMMIT_ADDRESS] = 0
+	registers[sunspec.PC_RESTORE_DEFAULTS_ADDRESS] = 0
+	registers.restorePowerControl()
+}
+
+func (registers registerMap) restorePowerControl() {
+	for name, value := range powerControlDefaults {
+		element := sunspec.PowerControlRegisters[name]
+		if element.Type == sunspec.Dt_uint16 {
+			registers[element.Address] = uint16(value)
+		} else {
+			registers.setUint32(element, value)
+		}
+	}
+}
+
+func (registers registerMap) powerControlValue(name string) uint32 {
+	element := sunspec.PowerControlRegisters[name]
+	if element.Type == sunspec.Dt_uint16 {
+		return uint32(registers[element.Address])
+	}
+	high, low := registers[element.Address], registers[element.Address+1]
+	if element.WordSwap {
+		high, low = low, high
+	}
+	return uint32(high)<<16 | uint32(low)
+}
+
+// Whether a register can be written, i.e. is a power control register.
+func writable(address uint16) bool {
+	if address == sunspec.PC_COMMIT_ADDRESS || address == sunspec.PC_RESTORE_DEFAULTS_ADDRESS {
+		return true
+	}
+	for _, element := range sunspec.PowerControlRegisters {
+		if address >= element.Address && address < element.Address+modbus.RegisterCount(element) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Write registers starting at 'address', returning the Modbus exception code (0 if written). Only the power control
+	registers are writable, and only with values within their bounds. Committing (and restoring the defaults) takes
+	effect immediately and the register reads back 0, i.e. success, unless faults are injected (see Config.IgnoreWrites
+	and Config.CommitError).
+*/
+func (simulator *Simulator) write(address uint16, values []uint16) byte {
+	simulator.lock.Lock()
+	defer simulator.lock.Unlock()
+
+	updated := registerMap{}
+	for address, value := range simulator.registers {
+		updated[address] = value
+	}
+	for i, value := range values {
+		if !writable(address + uint16(i)) {
+			return EXCEPTION_ILLEGAL_DATA_ADDRESS
+		}
+		updated[address+uint16(i)] = value
+	}
+	for name, maximum := range powerControlMaximums {
+		if updated.powerControlValue(name) > maximum {
+			return EXCEPTION_ILLEGAL_DATA_VALUE
+		}
+	}
+
+	if simulator.config.IgnoreWrites {
+		debugLog.Debugf("Injected ignored write of %d registers at %d.", len(values), address)
+		return 0
+	}
+
+	if updated[sunspec.PC_RESTORE_DEFAULTS_ADDRESS] != 0 {
+		updated.restorePowerControl()
+		updated[sunspec.PC_RESTORE_DEFAULTS_ADDRESS] = 0
+	}
+	updated[sunspec.PC_COMMIT_ADDRESS] = 0
+	committed := address <= sunspec.PC_COMMIT_ADDRESS && uint32(sunspec.PC_COMMIT_ADDRESS) < uint32(address)+uint32(len(values))
+	if committed && simulator.config.CommitError != 0 {
+		debugLog.Debugf("Injected commit error %d.", simulator.config.CommitError)
+		updated[sunspec.PC_COMMIT_ADDRESS] = simulator.config.CommitError
+	}
+
+	simulator.registers = updated
+	infoLog.Printf("Power control: active power limit %d%%, reactive power config %d, advanced power control %d.", updated.powerControlValue("PC_ActivePowerLimit"), updated.powerControlValue("PC_ReactivePowerConfig"), updated.powerControlValue("PC_AdvancedPowerControlEn"))
+	simulator.update()
+	return 0
+}
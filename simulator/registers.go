@@ -0,0 +1,124 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+)
+
+// Register image of the simulated device, keyed by (PDU) address.
+type registerMap map[uint16]uint16
+
+// Lay out the SunSpec map: 'SunS' marker, common block, inverter model and end marker.
+func layout(models []sunspec.DiscoveredModel) registerMap {
+	registers := registerMap{}
+
+	base := models[0].Address - 2
+	registers[base] = uint16(sunspec.SUNSPEC_ID >> 16)
+	registers[base+1] = uint16(sunspec.SUNSPEC_ID & 0xFFFF)
+
+	end := base + 2
+	for _, model := range models {
+		registers[model.Address] = model.Id
+		registers[model.Address+1] = model.Length
+		for offset := uint16(2); offset < model.Length+2; offset++ {
+			registers[model.Address+offset] = 0
+		}
+		end = model.Address + model.Length + 2
+	}
+	registers[end] = sunspec.SUNSPEC_END_MODEL_ID
+	registers[end+1] = 0
+
+	return registers
+}
+
+// Encode a value into its register(s), scaled down by the given scale factor.
+func (registers registerMap) setValue(element sunspec.ModbusAddress, value float64, scaleFactor int16) error {
+	raw := math.Round(value / math.Pow10(int(scaleFactor)))
+
+	switch element.Type {
+	case sunspec.Dt_uint16:
+		registers[element.Address] = uint16(clamp(raw, 0, math.MaxUint16))
+	case sunspec.Dt_int16:
+		registers[element.Address] = uint16(int16(clamp(raw, math.MinInt16, math.MaxInt16)))
+	case sunspec.Dt_uint32, sunspec.Dt_acc32:
+		registers.setUint32(element, uint32(clamp(raw, 0, math.MaxUint32)))
+	case sunspec.Dt_float32:
+		registers.setUint32(element, math.Float32bits(float32(value)))
+	case sunspec.Dt_uint64:
+		bytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(bytes, uint64(clamp(raw, 0, math.MaxUint64)))
+		for i := uint16(0); i < 4; i++ {
+			registers[element.Address+i] = binary.BigEndian.Uint16(bytes[i*2:])
+		}
+	case sunspec.Dt_string:
+		return fmt.Errorf("string registers can't be set to a number")
+	default:
+		return fmt.Errorf("unsupported data type %d", element.Type)
+	}
+	return nil
+}
+
+func (registers registerMap) setUint32(element sunspec.ModbusAddress, value uint32) {
+	high, low := uint16(value>>16), uint16(value&0xFFFF)
+	if element.WordSwap {
+		high, low = low, high
+	}
+	registers[element.Address] = high
+	registers[element.Address+1] = low
+}
+
+// Encode a string, NUL padded to the register's size.
+func (registers registerMap) setString(element sunspec.ModbusAddress, value string) {
+	bytes := make([]byte, element.Size*2)
+	copy(bytes, value)
+	for i := uint16(0); i < element.Size; i++ {
+		registers[element.Address+i] = binary.BigEndian.Uint16(bytes[i*2:])
+	}
+}
+
+// Scale factor register of each scaled inverter register.
+var scaleFactors = map[string]string{
+	"I_AC_Current":   "I_AC_Current_SF",
+	"I_AC_CurrentA":  "I_AC_Current_SF",
+	"I_AC_CurrentB":  "I_AC_Current_SF",
+	"I_AC_CurrentC":  "I_AC_Current_SF",
+	"I_AC_VoltageAB": "I_AC_Voltage_SF",
+	"I_AC_VoltageBC": "I_AC_Voltage_SF",
+	"I_AC_VoltageCA": "I_AC_Voltage_SF",
+	"I_AC_VoltageAN": "I_AC_Voltage_SF",
+	"I_AC_VoltageBN": "I_AC_Voltage_SF",
+	"I_AC_VoltageCN": "I_AC_Voltage_SF",
+	"I_AC_Power":     "I_AC_Power_SF",
+	"I_AC_Frequency": "I_AC_Frequency_SF",
+	"I_AC_VA":        "I_AC_VA_SF",
+	"I_AC_VAR":       "I_AC_VAR_SF",
+	"I_AC_PF":        "I_AC_PF_SF",
+	"I_AC_Energy_WH": "I_AC_Energy_WH_SF",
+	"I_DC_Current":   "I_DC_Current_SF",
+	"I_DC_Voltage":   "I_DC_Voltage_SF",
+	"I_DC_Power":     "I_DC_Power_SF",
+	"I_Temp_Sink":    "I_Temp_SF",
+}
+
+// Default scale factors, i.e. the resolution of the simulated values (as reported by a SE10K).
+var DefaultScaleFactors = map[string]int16{
+	"I_AC_Current_SF":   -2,
+	"I_AC_Voltage_SF":   -1,
+	"I_AC_Power_SF":     0,
+	"I_AC_Frequency_SF": -2,
+	"I_AC_VA_SF":        0,
+	"I_AC_VAR_SF":       0,
+	"I_AC_PF_SF":        -2,
+	"I_AC_Energy_WH_SF": 0,
+	"I_DC_Current_SF":   -3,
+	"I_DC_Voltage_SF":   -1,
+	"I_DC_Power_SF":     0,
+	"I_Temp_SF":         -2,
+}
+
+func clamp(value float64, min float64, max float64) float64 {
+	return math.Max(min, math.Min(max, value))
+}
@@ -0,0 +1,251 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	MBAP_HEADER_SIZE = 7   // transaction id, protocol id, length, unit id
+	MAX_PDU_SIZE     = 253 // function code + data
+	MAX_READ_COUNT   = 125 // registers per 'Read Holding Registers' request
+	MAX_WRITE_COUNT  = 123 // registers per 'Write Multiple Registers' request
+	IDLE_TIMEOUT     = 5 * time.Minute
+)
+
+// Modbus function codes
+const (
+	FUNC_READ_HOLDING_REGISTERS   = 0x03
+	FUNC_WRITE_SINGLE_REGISTER    = 0x06
+	FUNC_WRITE_MULTIPLE_REGISTERS = 0x10
+)
+
+// Modbus exception codes
+const (
+	EXCEPTION_ILLEGAL_FUNCTION      = 0x01
+	EXCEPTION_ILLEGAL_DATA_ADDRESS  = 0x02
+	EXCEPTION_ILLEGAL_DATA_VALUE    = 0x03
+	EXCEPTION_SERVER_DEVICE_FAILURE = 0x04
+	EXCEPTION_GATEWAY_TARGET_FAILED = 0x0B
+)
+
+// Listen on the configured address and serve Modbus TCP requests in the background, until closed.
+func (simulator *Simulator) Start() error {
+	listener, err := net.Listen("tcp", simulator.config.Listen)
+	if err != nil {
+		return fmt.Errorf("simulator: %w", err)
+	}
+
+	simulator.lock.Lock()
+	simulator.listener = listener
+	simulator.lock.Unlock()
+
+	infoLog.Printf("Simulating %s %s (serial %s, unit id %d) on %s.", simulator.config.Manufacturer, simulator.config.Model, simulator.config.Serial, simulator.config.UnitId, listener.Addr())
+
+	simulator.wg.Add(1)
+	go simulator.accept(listener)
+	return nil
+}
+
+// Start and block until closed.
+func (simulator *Simulator) Serve() error {
+	if err := simulator.Start(); err != nil {
+		return err
+	}
+	simulator.wg.Wait()
+	return nil
+}
+
+// Stop listening and drop all connections.
+func (simulator *Simulator) Close() error {
+	simulator.lock.Lock()
+	simulator.closed = true
+	listener := simulator.listener
+	for conn := range simulator.connections {
+		conn.Close()
+	}
+	simulator.lock.Unlock()
+
+	if listener == nil {
+		return nil
+	}
+	err := listener.Close()
+	simulator.wg.Wait()
+	return err
+}
+
+func (simulator *Simulator) accept(listener net.Listener) {
+	defer simulator.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			simulator.lock.Lock()
+			closed := simulator.closed
+			simulator.lock.Unlock()
+			if !closed {
+				errorLog.Errorf("Failed to accept connection: %v", err)
+			}
+			return
+		}
+
+		simulator.lock.Lock()
+		if simulator.closed {
+			simulator.lock.Unlock()
+			conn.Close()
+			return
+		}
+		simulator.connections[conn] = true
+		simulator.lock.Unlock()
+
+		debugLog.Debugf("Client %s connected.", conn.RemoteAddr())
+		simulator.wg.Add(1)
+		go simulator.serve(conn)
+	}
+}
+
+// Serve requests of a single client, one at a time (as SolarEdge inverters do).
+func (simulator *Simulator) serve(conn net.Conn) {
+	defer simulator.wg.Done()
+	defer func() {
+		simulator.lock.Lock()
+		delete(simulator.connections, conn)
+		simulator.lock.Unlock()
+		conn.Close()
+		debugLog.Debugf("Client %s disconnected.", conn.RemoteAddr())
+	}()
+
+	header := make([]byte, MBAP_HEADER_SIZE)
+	for {
+		conn.SetReadDeadline(time.Now().Add(IDLE_TIMEOUT))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if !errors.Is(err, io.EOF) {
+				debugLog.Debugf("Client %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		length := binary.BigEndian.Uint16(header[4:6])
+		if binary.BigEndian.Uint16(header[2:4]) != 0 || length < 2 || length-1 > MAX_PDU_SIZE {
+			errorLog.Errorf("Client %s: invalid MBAP header %x, closing connection.", conn.RemoteAddr(), header)
+			return
+		}
+		request := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+
+		simulator.delay()
+		if _, disconnectRate := simulator.faults(); simulator.chance(disconnectRate) {
+			debugLog.Debugf("Injected disconnect of client %s.", conn.RemoteAddr())
+			return
+		}
+
+		response := simulator.handle(header[6], request)
+		frame := make([]byte, MBAP_HEADER_SIZE, MBAP_HEADER_SIZE+len(response))
+		copy(frame, header[0:4])
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(response)+1))
+		frame[6] = header[6]
+		if _, err := conn.Write(append(frame, response...)); err != nil {
+			return
+		}
+	}
+}
+
+// Response PDU of a request PDU addressed to the given unit.
+func (simulator *Simulator) handle(unitId byte, request []byte) []byte {
+	function := request[0]
+
+	if unitId != simulator.config.UnitId {
+		return exception(function, EXCEPTION_GATEWAY_TARGET_FAILED)
+	}
+	if errorRate, _ := simulator.faults(); simulator.chance(errorRate) {
+		debugLog.Debugln("Injected server device failure.")
+		return exception(function, EXCEPTION_SERVER_DEVICE_FAILURE)
+	}
+
+	switch function {
+	case FUNC_READ_HOLDING_REGISTERS:
+		if len(request) != 5 {
+			return exception(function, EXCEPTION_ILLEGAL_DATA_VALUE)
+		}
+		address := binary.BigEndian.Uint16(request[1:3])
+		quantity := binary.BigEndian.Uint16(request[3:5])
+		if quantity < 1 || quantity > MAX_READ_COUNT {
+			return exception(function, EXCEPTION_ILLEGAL_DATA_VALUE)
+		}
+		if uint32(address)+uint32(quantity) > 0x10000 {
+			return exception(function, EXCEPTION_ILLEGAL_DATA_ADDRESS)
+		}
+
+		values, ok := simulator.read(address, quantity)
+		if !ok {
+			return exception(function, EXCEPTION_ILLEGAL_DATA_ADDRESS)
+		}
+		response := make([]byte, 2+2*len(values))
+		response[0] = function
+		response[1] = byte(2 * len(values))
+		for i, value := range values {
+			binary.BigEndian.PutUint16(response[2+2*i:], value)
+		}
+		return response
+
+	case FUNC_WRITE_SINGLE_REGISTER:
+		if len(request) != 5 {
+			return exception(function, EXCEPTION_ILLEGAL_DATA_VALUE)
+		}
+		address := binary.BigEndian.Uint16(request[1:3])
+		if code := simulator.write(address, []uint16{binary.BigEndian.Uint16(request[3:5])}); code != 0 {
+			return exception(function, code)
+		}
+		return request
+
+	case FUNC_WRITE_MULTIPLE_REGISTERS:
+		if len(request) < 6 {
+			return exception(function, EXCEPTION_ILLEGAL_DATA_VALUE)
+		}
+		address := binary.BigEndian.Uint16(request[1:3])
+		quantity := binary.BigEndian.Uint16(request[3:5])
+		if quantity < 1 || quantity > MAX_WRITE_COUNT || int(request[5]) != 2*int(quantity) || len(request) != 6+2*int(quantity) {
+			return exception(function, EXCEPTION_ILLEGAL_DATA_VALUE)
+		}
+		if uint32(address)+uint32(quantity) > 0x10000 {
+			return exception(function, EXCEPTION_ILLEGAL_DATA_ADDRESS)
+		}
+
+		values := make([]uint16, quantity)
+		for i := range values {
+			values[i] = binary.BigEndian.Uint16(request[6+2*i:])
+		}
+		if code := simulator.write(address, values); code != 0 {
+			return exception(function, code)
+		}
+		return request[0:5]
+
+	default:
+		return exception(function, EXCEPTION_ILLEGAL_FUNCTION)
+	}
+}
+
+func exception(function byte, code byte) []byte {
+	return []byte{function | 0x80, code}
+}
+
+// Injected latency
+func (simulator *Simulator) delay() {
+	latency := simulator.config.Latency
+	if simulator.config.LatencyJitter > 0 {
+		latency += time.Duration(rand.Int63n(int64(simulator.config.LatencyJitter)))
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
+
+func (simulator *Simulator) chance(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
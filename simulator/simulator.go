@@ -0,0 +1,424 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sunspec "github.com/stefannilsson/solaredgedc/datamodels/sunspec"
+	"github.com/stefannilsson/solaredgedc/logger"
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+)
+
+const (
+	DEFAULT_LISTEN        = ":1502"
+	DEFAULT_UNIT_ID       = 1
+	DEFAULT_MANUFACTURER  = "SolarEdge"
+	DEFAULT_VERSION       = "0004.0019.0036"
+	DEFAULT_SERIAL        = "7E0000001"
+	DEFAULT_PEAK_POWER    = 10000 // W
+	DEFAULT_SUNRISE       = 6 * time.Hour
+	DEFAULT_SUNSET        = 20 * time.Hour
+	NOMINAL_VOLTAGE       = 230.0 // V, phase to neutral
+	NOMINAL_FREQUENCY     = 50.0  // Hz
+	INVERTER_EFFICIENCY   = 0.975
+	AMBIENT_TEMPERATURE   = 25.0 // °C, heat sink temperature at night
+	HEAT_SINK_TEMPERATURE = 20.0 // °C, heat sink temperature rise at peak power
+)
+
+// Default models by inverter model: three phase (103) or single phase (101).
+var defaultModels = map[uint16]string{
+	sunspec.Model_INVERTER_THREE_PHASE:  "SE10K-RW0TEBNN4",
+	sunspec.Model_INVERTER_SINGLE_PHASE: "SE5000H-RW000BNN4",
+}
+
+type Config struct {
+	// Address to listen on for Modbus TCP, e.g. ':1502'
+	Listen string
+	UnitId byte
+
+	// Common block
+	Manufacturer string
+	Model        string
+	Version      string
+	Serial       string
+
+	// sunspec.Model_INVERTER_THREE_PHASE (default) or sunspec.Model_INVERTER_SINGLE_PHASE
+	InverterModel uint16
+
+	// Day curve: AC power follows a sine from sunrise to sunset (time of day), peaking at PeakPower (W).
+	PeakPower float64
+	Sunrise   time.Duration
+	Sunset    time.Duration
+
+	// Simulated time starts at Start (default now) and runs Speed times as fast as real time (default 1).
+	Start time.Time
+	Speed float64
+
+	// Initial lifetime energy (Wh)
+	Energy float64
+
+	// Scale factor overrides, e.g. {"I_AC_Power_SF": -1}
+	ScaleFactors map[string]int16
+
+	// Fixed (scaled) values overriding the curve, e.g. {"I_Status": 7, "I_Temp_Sink": 85.5}
+	Values map[string]float64
+
+	// Fault injection: fraction (0-1) of requests answered with a 'server device failure' exception or dropping
+	// the connection, and the response latency (plus a random jitter of up to LatencyJitter).
+	ErrorRate      float64
+	DisconnectRate float64
+	Latency        time.Duration
+	LatencyJitter  time.Duration
+
+	// Power control fault injection: writes acknowledged without taking effect (i.e. failing to read back), and the
+	// error code reading back from the commit register after a commit (0, i.e. success, by default).
+	IgnoreWrites bool
+	CommitError  uint16
+}
+
+/*
+	SolarEdge inverter simulated as Modbus TCP server, serving the SunSpec map (common block and inverter model at
+	40000) with values following a day/night curve. Meant for development and testing without an inverter.
+*/
+type Simulator struct {
+	config      Config
+	registers   registerMap
+	definitions map[string]sunspec.ModbusAddress
+
+	lock        sync.Mutex
+	energy      float64   // Wh
+	lastUpdate  time.Time // simulated time of the last update
+	started     time.Time // real time the simulation started
+	overrides   map[string]float64
+	listener    net.Listener
+	connections map[net.Conn]bool
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+var errorLog, infoLog, debugLog = logger.GetLoggers("simulator")
+
+func New(config Config) (*Simulator, error) {
+	if config.Listen == "" {
+		config.Listen = DEFAULT_LISTEN
+	}
+	if config.UnitId == 0 {
+		config.UnitId = DEFAULT_UNIT_ID
+	}
+	if config.InverterModel == 0 {
+		config.InverterModel = sunspec.Model_INVERTER_THREE_PHASE
+	}
+	if _, found := defaultModels[config.InverterModel]; !found {
+		return nil, fmt.Errorf("unsupported inverter model %d, expected %d or %d", config.InverterModel, sunspec.Model_INVERTER_SINGLE_PHASE, sunspec.Model_INVERTER_THREE_PHASE)
+	}
+	if config.Manufacturer == "" {
+		config.Manufacturer = DEFAULT_MANUFACTURER
+	}
+	if config.Model == "" {
+		config.Model = defaultModels[config.InverterModel]
+	}
+	if config.Version == "" {
+		config.Version = DEFAULT_VERSION
+	}
+	if config.Serial == "" {
+		config.Serial = DEFAULT_SERIAL
+	}
+	if config.PeakPower == 0 {
+		config.PeakPower = DEFAULT_PEAK_POWER
+	}
+	if config.Sunrise == 0 && config.Sunset == 0 {
+		config.Sunrise, config.Sunset = DEFAULT_SUNRISE, DEFAULT_SUNSET
+	}
+	if config.Sunrise < 0 || config.Sunset > 24*time.Hour || config.Sunrise >= config.Sunset {
+		return nil, fmt.Errorf("invalid day from %v to %v, sunrise must be before sunset (within 24h)", config.Sunrise, config.Sunset)
+	}
+	if config.Start.IsZero() {
+		config.Start = time.Now()
+	}
+	if config.Speed <= 0 {
+		config.Speed = 1
+	}
+	if err := validateRates(config.ErrorRate, config.DisconnectRate); err != nil {
+		return nil, err
+	}
+
+	models := []sunspec.DiscoveredModel{
+		{Id: sunspec.Model_COMMON, Address: sunspec.DefaultModels[0].Address, Length: sunspec.DefaultModels[0].Length},
+		{Id: config.InverterModel, Address: sunspec.DefaultModels[1].Address, Length: sunspec.DefaultModels[1].Length},
+	}
+	simulator := &Simulator{
+		config:      config,
+		registers:   layout(models),
+		definitions: sunspec.BuildRegisters(models),
+		energy:      config.Energy,
+		lastUpdate:  config.Start,
+		overrides:   map[string]float64{},
+		connections: map[net.Conn]bool{},
+	}
+
+	for name, value := range config.Values {
+		if err := simulator.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	for name, scaleFactor := range config.ScaleFactors {
+		if _, found := DefaultScaleFactors[name]; !found {
+			return nil, fmt.Errorf("unknown scale factor '%s', expected one of %s", name, strings.Join(scaleFactorNames(), ", "))
+		}
+		if scaleFactor < -10 || scaleFactor > 10 {
+			return nil, fmt.Errorf("invalid scale factor %s=%d, expected -10 to 10", name, scaleFactor)
+		}
+	}
+
+	common := simulator.definitions
+	simulator.registers.setString(common["C_Manufacturer"], config.Manufacturer)
+	simulator.registers.setString(common["C_Model"], config.Model)
+	simulator.registers.setString(common["C_Version"], config.Version)
+	simulator.registers.setString(common["C_SerialNumber"], config.Serial)
+	simulator.registers[common["C_DeviceAddress"].Address] = uint16(config.UnitId)
+	simulator.registers.layoutPowerControl()
+
+	simulator.started = time.Now()
+	simulator.update()
+
+	return simulator, nil
+}
+
+// Override the curve with a fixed (scaled) value, e.g. Set("I_Status", 7).
+func (simulator *Simulator) Set(name string, value float64) error {
+	element, found := simulator.definitions[name]
+	if !found || element.Type == sunspec.Dt_string {
+		return fmt.Errorf("unknown register '%s'", name)
+	}
+	if _, isScaleFactor := DefaultScaleFactors[name]; isScaleFactor {
+		return fmt.Errorf("scale factor '%s' can't be set as a value, set it as scale factor instead", name)
+	}
+
+	simulator.lock.Lock()
+	defer simulator.lock.Unlock()
+	simulator.overrides[name] = value
+	return nil
+}
+
+// Remove the override of a value, i.e. let it follow the curve again.
+func (simulator *Simulator) Unset(name string) {
+	simulator.lock.Lock()
+	defer simulator.lock.Unlock()
+	delete(simulator.overrides, name)
+}
+
+// Change the injected error and disconnect rates (0-1) while running, e.g. to test recovering from a flaky connection.
+func (simulator *Simulator) SetFaults(errorRate float64, disconnectRate float64) error {
+	if err := validateRates(errorRate, disconnectRate); err != nil {
+		return err
+	}
+
+	simulator.lock.Lock()
+	defer simulator.lock.Unlock()
+	simulator.config.ErrorRate = errorRate
+	simulator.config.DisconnectRate = disconnectRate
+	return nil
+}
+
+// Change the power control fault injection while running, e.g. to test a revert failing (and being retried).
+func (simulator *Simulator) SetPowerControlFaults(ignoreWrites bool, commitError uint16) {
+	simulator.lock.Lock()
+	defer simulator.lock.Unlock()
+	simulator.config.IgnoreWrites = ignoreWrites
+	simulator.config.CommitError = commitError
+}
+
+func (simulator *Simulator) faults() (errorRate float64, disconnectRate float64) {
+	simulator.lock.Lock()
+	defer simulator.lock.Unlock()
+	return simulator.config.ErrorRate, simulator.config.DisconnectRate
+}
+
+func validateRates(errorRate float64, disconnectRate float64) error {
+	for name, rate := range map[string]float64{"error rate": errorRate, "disconnect rate": disconnectRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid %s %v, expected 0-1", name, rate)
+		}
+	}
+	return nil
+}
+
+// Current simulated time.
+func (simulator *Simulator) Now() time.Time {
+	elapsed := time.Since(simulator.started)
+	return simulator.config.Start.Add(time.Duration(float64(elapsed) * simulator.config.Speed))
+}
+
+// Recompute all values for the current simulated time (with the lock held).
+func (simulator *Simulator) update() {
+	now := simulator.Now()
+	values := simulator.curve(now)
+
+	for name, value := range simulator.overrides {
+		values[name] = value
+	}
+
+	// Integrate the lifetime energy over the time since the last update, unless fixed.
+	hours := now.Sub(simulator.lastUpdate).Hours()
+	if hours > 0 {
+		simulator.energy += values["I_AC_Power"] * hours
+	}
+	simulator.lastUpdate = now
+	if energy, fixed := simulator.overrides["I_AC_Energy_WH"]; fixed {
+		simulator.energy = energy
+	}
+	values["I_AC_Energy_WH"] = simulator.energy
+
+	for name, scaleFactor := range DefaultScaleFactors {
+		if override, found := simulator.config.ScaleFactors[name]; found {
+			scaleFactor = override
+		}
+		if element, found := simulator.definitions[name]; found {
+			simulator.registers[element.Address] = uint16(scaleFactor)
+		}
+	}
+
+	for name, value := range values {
+		element, found := simulator.definitions[name]
+		if !found {
+			continue
+		}
+		if math.IsNaN(value) {
+			simulator.setNotImplemented(element)
+			continue
+		}
+		var scaleFactor int16
+		if sfName, scaled := scaleFactors[name]; scaled {
+			scaleFactor = int16(simulator.registers[simulator.definitions[sfName].Address])
+		}
+		if err := simulator.registers.setValue(element, value, scaleFactor); err != nil {
+			debugLog.Debugf("Failed to set '%s': %v", name, err)
+		}
+	}
+}
+
+func (simulator *Simulator) setNotImplemented(element sunspec.ModbusAddress) {
+	switch element.Type {
+	case sunspec.Dt_int16:
+		simulator.registers[element.Address] = 0x8000
+	case sunspec.Dt_acc32:
+		simulator.registers.setUint32(element, sunspec.NOT_IMPLEMENTED_ACC32)
+	default:
+		for i := uint16(0); i < modbus.RegisterCount(element); i++ {
+			simulator.registers[element.Address+i] = 0xFFFF
+		}
+	}
+}
+
+// Values (unscaled, NaN = not implemented) of the inverter at the given time of day.
+func (simulator *Simulator) curve(now time.Time) map[string]float64 {
+	config := simulator.config
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	timeOfDay := now.Sub(midnight)
+
+	power := 0.0
+	status := float64(sunspec.Ivs_I_STATUS_SLEEPING)
+	if timeOfDay > config.Sunrise && timeOfDay < config.Sunset {
+		daylight := float64(timeOfDay-config.Sunrise) / float64(config.Sunset-config.Sunrise)
+		power = config.PeakPower * math.Sin(math.Pi*daylight)
+		status = sunspec.Ivs_I_STATUS_MPPT
+
+		// Active power limit (% of peak power), written over Modbus.
+		limit := config.PeakPower * float64(simulator.registers.powerControlValue("PC_ActivePowerLimit")) / 100
+		if power > limit {
+			power = limit
+			status = sunspec.Ivs_I_STATUS_THROTTLED
+		}
+	}
+
+	values := map[string]float64{
+		"I_AC_Power":      power,
+		"I_AC_VA":         power,
+		"I_AC_VAR":        0,
+		"I_AC_PF":         100,
+		"I_AC_Frequency":  NOMINAL_FREQUENCY,
+		"I_Temp_Sink":     AMBIENT_TEMPERATURE + HEAT_SINK_TEMPERATURE*power/config.PeakPower,
+		"I_Status":        status,
+		"I_Status_Vendor": 0,
+	}
+
+	if config.InverterModel == sunspec.Model_INVERTER_THREE_PHASE {
+		current := power / 3 / NOMINAL_VOLTAGE
+		lineVoltage := NOMINAL_VOLTAGE * math.Sqrt(3)
+		values["I_AC_Current"] = current * 3
+		values["I_AC_CurrentA"], values["I_AC_CurrentB"], values["I_AC_CurrentC"] = current, current, current
+		values["I_AC_VoltageAN"], values["I_AC_VoltageBN"], values["I_AC_VoltageCN"] = NOMINAL_VOLTAGE, NOMINAL_VOLTAGE, NOMINAL_VOLTAGE
+		values["I_AC_VoltageAB"], values["I_AC_VoltageBC"], values["I_AC_VoltageCA"] = lineVoltage, lineVoltage, lineVoltage
+	} else {
+		current := power / NOMINAL_VOLTAGE
+		values["I_AC_Current"], values["I_AC_CurrentA"] = current, current
+		values["I_AC_VoltageAB"], values["I_AC_VoltageAN"] = NOMINAL_VOLTAGE, NOMINAL_VOLTAGE
+		for _, name := range []string{"I_AC_CurrentB", "I_AC_CurrentC", "I_AC_VoltageBC", "I_AC_VoltageCA", "I_AC_VoltageBN", "I_AC_VoltageCN"} {
+			values[name] = math.NaN()
+		}
+	}
+
+	// DC side: MPP voltage while producing, the DC power covering the conversion losses.
+	dcVoltage, dcPower, dcCurrent := 0.0, 0.0, 0.0
+	if power > 0 {
+		dcVoltage = 750
+		if config.InverterModel != sunspec.Model_INVERTER_THREE_PHASE {
+			dcVoltage = 380
+		}
+		dcPower = power / INVERTER_EFFICIENCY
+		dcCurrent = dcPower / dcVoltage
+	}
+	values["I_DC_Voltage"], values["I_DC_Power"], values["I_DC_Current"] = dcVoltage, dcPower, dcCurrent
+
+	return values
+}
+
+// Copy of 'quantity' registers starting at 'address', false if any of them isn't mapped.
+func (simulator *Simulator) read(address uint16, quantity uint16) ([]uint16, bool) {
+	simulator.lock.Lock()
+	defer simulator.lock.Unlock()
+	simulator.update()
+
+	result := make([]uint16, quantity)
+	for i := uint16(0); i < quantity; i++ {
+		value, found := simulator.registers[address+i]
+		if !found {
+			return nil, false
+		}
+		result[i] = value
+	}
+	return result, true
+}
+
+// Address the simulator listens on (e.g. to find the port when listening on ':0'), "" if not started.
+func (simulator *Simulator) Addr() string {
+	simulator.lock.Lock()
+	defer simulator.lock.Unlock()
+	if simulator.listener == nil {
+		return ""
+	}
+	return simulator.listener.Addr().String()
+}
+
+func scaleFactorNames() []string {
+	names := make([]string, 0, len(DefaultScaleFactors))
+	for name := range DefaultScaleFactors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse a time of day, e.g. '06:30' => 6h30m.
+func ParseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', expected HH:MM", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
@@ -0,0 +1,231 @@
+package simulator_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mapping "github.com/stefannilsson/solaredgedc/datamapping"
+	models "github.com/stefannilsson/solaredgedc/datamodels"
+	modbus "github.com/stefannilsson/solaredgedc/poller"
+	mqtt "github.com/stefannilsson/solaredgedc/publisher"
+	"github.com/stefannilsson/solaredgedc/simulator"
+)
+
+// Noon of a day from 06:00 to 18:00, i.e. the peak of the curve, which barely changes while testing.
+var noon = time.Date(2026, 6, 1, 12, 0, 0, 0, time.Local)
+
+func startSimulator(t *testing.T, config simulator.Config) *simulator.Simulator {
+	t.Helper()
+	if config.Listen == "" {
+		config.Listen = "127.0.0.1:0"
+	}
+	config.Start, config.Sunrise, config.Sunset = noon, 6*time.Hour, 18*time.Hour
+
+	sim, err := simulator.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	return sim
+}
+
+// Connection state transitions of a poller.
+type stateRecorder struct {
+	lock   sync.Mutex
+	states []modbus.ConnectionState
+}
+
+func (recorder *stateRecorder) record(state modbus.ConnectionState) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.states = append(recorder.states, state)
+}
+
+func (recorder *stateRecorder) String() string {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	names := []string{}
+	for _, state := range recorder.states {
+		names = append(names, state.String())
+	}
+	return strings.Join(names, " -> ")
+}
+
+func newPoller(t *testing.T, address string, alias string) (*modbus.ModbusClient, *stateRecorder) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+
+	recorder := &stateRecorder{}
+	client := modbus.NewPoller(&modbus.ModbusConfiguration{
+		Mode:          modbus.MODE_TCP,
+		Hostname:      host,
+		Port:          portNumber,
+		SlaveId:       simulator.DEFAULT_UNIT_ID,
+		Alias:         alias,
+		OnStateChange: recorder.record,
+	})
+	return client, recorder
+}
+
+func TestPollMapPublish(t *testing.T) {
+	sim := startSimulator(t, simulator.Config{
+		Serial:       "7E16A12F",
+		ScaleFactors: map[string]int16{"I_AC_Power_SF": 1},
+		Values:       map[string]float64{"I_AC_Energy_WH": 2467612, "I_AC_VAR": math.NaN()},
+	})
+	client, _ := newPoller(t, sim.Addr(), "pipeline")
+
+	registerValues := modbus.PollRegisters(client)
+	if len(*registerValues) == 0 {
+		t.Fatal("no registers read")
+	}
+	parsed, err := mapping.ParseValues(registerValues, client.PollTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reading := mapping.ToPVSolarReading(parsed)
+
+	output := &bytes.Buffer{}
+	publishers := mqtt.NewRegistry()
+	publishers.Add("writer", mqtt.NewWriterPublisher(output, "pvsolar"))
+	publishers.Publish(mqtt.Reading{Kind: mqtt.KIND_INVERTER, Device: "pipeline", Value: reading})
+	publishers.Close()
+
+	line := strings.TrimSpace(output.String())
+	prefix := "pvsolar/pipeline "
+	if !strings.HasPrefix(line, prefix) {
+		t.Fatalf("published %q, want topic %q", line, prefix)
+	}
+	published := &models.PVSolarReading{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, prefix)), published); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peak power 10 kW split over three phases at 230 V, at the default resolution of each register.
+	floats := map[string]struct {
+		value *float64
+		want  float64
+	}{
+		"AC_Power":         {published.AC_Power, 10000},
+		"AC_Current":       {published.AC_Current, 43.48},
+		"AC_Current_L1":    {published.AC_Current_L1, 14.49},
+		"AC_Voltage_L1_N":  {published.AC_Voltage_L1_N, 230},
+		"AC_Voltage_L1_L2": {published.AC_Voltage_L1_L2, 398.4},
+		"AC_Frequency":     {published.AC_Frequency, 50},
+		"AC_PF":            {published.AC_PF, 100},
+		"AC_Energy_WH":     {published.AC_Energy_WH, 2467612},
+		"DC_Voltage":       {published.DC_Voltage, 750},
+		"Temp_Sink":        {published.Temp_Sink, 45},
+	}
+	for name, field := range floats {
+		if field.value == nil {
+			t.Errorf("%s = null, want %v", name, field.want)
+		} else if math.Abs(*field.value-field.want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", name, *field.value, field.want)
+		}
+	}
+
+	if published.AC_VAR != nil || published.SuppressedValues == nil || *published.SuppressedValues != 1 {
+		t.Errorf("AC_VAR = %v, SuppressedValues = %v, want not implemented AC_VAR suppressed", published.AC_VAR, published.SuppressedValues)
+	}
+	if published.MeterId == nil || *published.MeterId != "7E16A12F" || published.Manufacturer == nil || *published.Manufacturer != simulator.DEFAULT_MANUFACTURER {
+		t.Errorf("MeterId = %v, Manufacturer = %v", published.MeterId, published.Manufacturer)
+	}
+	if published.PhaseConfiguration == nil || *published.PhaseConfiguration != 103 {
+		t.Errorf("PhaseConfiguration = %v, want 103", published.PhaseConfiguration)
+	}
+	if published.InverterStatusName == nil || *published.InverterStatusName != "MPPT" {
+		t.Errorf("InverterStatusName = %v, want MPPT", published.InverterStatusName)
+	}
+	if published.Time == nil || *published.Time != *reading.Time {
+		t.Errorf("Time = %v, want %d", published.Time, *reading.Time)
+	}
+}
+
+func TestPollInjectedErrors(t *testing.T) {
+	sim := startSimulator(t, simulator.Config{})
+	client, recorder := newPoller(t, sim.Addr(), "errors")
+
+	// Exceptions fail the reads but keep the connection.
+	if err := sim.SetFaults(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if values := modbus.PollRegisters(client); len(*values) != 0 {
+		t.Errorf("%d registers read despite server device failures", len(*values))
+	}
+	if client.State() != modbus.STATE_CONNECTED {
+		t.Errorf("connection %s after Modbus exceptions, want connected", client.State())
+	}
+
+	sim.SetFaults(0, 0)
+	if values := modbus.PollRegisters(client); len(*values) == 0 {
+		t.Error("no registers read after the errors stopped")
+	}
+	if recorder.String() != "connected" {
+		t.Errorf("connection states %s, want connected only", recorder)
+	}
+}
+
+func TestPollReconnectsAfterDisconnect(t *testing.T) {
+	sim := startSimulator(t, simulator.Config{})
+	client, recorder := newPoller(t, sim.Addr(), "disconnects")
+
+	if err := sim.SetFaults(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if values := modbus.PollRegisters(client); len(*values) != 0 {
+		t.Errorf("%d registers read from a dropped connection", len(*values))
+	}
+	if client.State() != modbus.STATE_DISCONNECTED {
+		t.Errorf("connection %s after a disconnect, want disconnected", client.State())
+	}
+
+	// A lost connection is re-established right away on the next poll.
+	sim.SetFaults(0, 0)
+	if values := modbus.PollRegisters(client); len(*values) == 0 {
+		t.Error("no registers read after reconnecting")
+	}
+	if want := "connected -> disconnected -> connected"; recorder.String() != want {
+		t.Errorf("connection states %s, want %s", recorder, want)
+	}
+}
+
+func TestPollReconnectsAfterRestart(t *testing.T) {
+	sim := startSimulator(t, simulator.Config{})
+	address := sim.Addr()
+	client, recorder := newPoller(t, address, "restart")
+
+	// Polls fail while the inverter is down, reconnects are attempted with backoff.
+	sim.Close()
+	for i := 0; i < 3; i++ {
+		if values := modbus.PollRegisters(client); len(*values) != 0 {
+			t.Fatalf("%d registers read from a stopped simulator", len(*values))
+		}
+	}
+
+	startSimulator(t, simulator.Config{Listen: address})
+	deadline := time.Now().Add(modbus.RECONNECT_BACKOFF_MIN * 8)
+	for len(*modbus.PollRegisters(client)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reconnected within %v, connection states %s", modbus.RECONNECT_BACKOFF_MIN*8, recorder)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if want := "connected -> disconnected -> connected"; recorder.String() != want {
+		t.Errorf("connection states %s, want %s", recorder, want)
+	}
+}